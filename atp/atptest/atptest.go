@@ -0,0 +1,112 @@
+// Package atptest provides a conformance test suite for plugins speaking the Arcaflow Transport Protocol. The suite
+// runs against any plugin a ClientChannel can be opened to, including plugin executables written in other languages.
+package atptest
+
+import (
+	"context"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"io"
+	"testing"
+	"time"
+)
+
+// DefaultTimeout is the default time the suite waits for each message from the plugin.
+const DefaultTimeout = 30 * time.Second
+
+// DefaultParallelRuns is the default number of runs the suite starts at the same time.
+const DefaultParallelRuns = 4
+
+// minimumVersion is the first ATP version with runtime messages, which the suite relies on.
+const minimumVersion = 2
+
+// clientVersions lists the ATP versions the suite offers to the plugin.
+var clientVersions = []int64{1, 3, atp.ProtocolVersion}
+
+// ChannelFactory opens a new session with the plugin under test. Every scenario of the suite uses its own session,
+// and closes the channel when it is done. The channel must return io.EOF once the plugin ended the session.
+type ChannelFactory func(t *testing.T) atp.ClientChannel
+
+// Options holds the settings of the conformance suite. Fields left at their zero value use the default setting.
+type Options struct {
+	// StepID is the ID of a step that finishes successfully with Input. The scenarios that need a successful run are
+	// skipped if it is empty.
+	StepID string
+	// Input is the input data for the step with StepID.
+	Input any
+	// Timeout is the time the suite waits for each message from the plugin. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// ParallelRuns is the number of runs the suite starts at the same time. Defaults to DefaultParallelRuns.
+	ParallelRuns int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.ParallelRuns <= 0 {
+		o.ParallelRuns = DefaultParallelRuns
+	}
+	return o
+}
+
+// Run runs the conformance suite against the plugin sessions the factory opens. Every scenario runs as a subtest.
+func Run(t *testing.T, factory ChannelFactory, options Options) {
+	options = options.withDefaults()
+	scenarios := []struct {
+		name string
+		run  func(t *testing.T, s *session, options Options)
+	}{
+		{"Handshake", testHandshake},
+		{"LegacyHandshake", testLegacyHandshake},
+		{"Schema", testSchema},
+		{"UnknownStep", testUnknownStep},
+		{"InvalidInput", testInvalidInput},
+		{"UnknownSignal", testUnknownSignal},
+		{"ParallelRuns", testParallelRuns},
+		{"ClientDone", testClientDone},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			scenario.run(t, newSession(t, factory(t), options.Timeout), options)
+		})
+	}
+}
+
+// RunExecutable runs the conformance suite against a plugin executable. The executable is started with the
+// given arguments for every scenario, and must run an ATP session on its stdin and stdout.
+func RunExecutable(t *testing.T, path string, args []string, options Options) {
+	Run(t, ExecutableFactory(path, args...), options)
+}
+
+// SchemaFactory returns a ChannelFactory that runs an ATP server with the given schema in the test process.
+func SchemaFactory(pluginSchema *schema.CallableSchema, serverOptions atp.ServerOptions) ChannelFactory {
+	return func(t *testing.T) atp.ClientChannel {
+		stdinReader, stdinWriter := io.Pipe()
+		stdoutReader, stdoutWriter := io.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_ = atp.RunATPServerWithOptions(ctx, stdinReader, stdoutWriter, pluginSchema, serverOptions)
+			// Let the suite see the end of the session.
+			_ = stdoutWriter.Close()
+		}()
+		t.Cleanup(func() {
+			cancel()
+			_ = stdinWriter.Close()
+			_ = stdoutReader.Close()
+			<-done
+		})
+		return &pipeChannel{stdoutReader, stdinWriter}
+	}
+}
+
+type pipeChannel struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p *pipeChannel) Close() error {
+	return p.PipeWriter.Close()
+}
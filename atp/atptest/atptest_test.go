@@ -0,0 +1,98 @@
+package atptest_test
+
+import (
+	"context"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/atp/atptest"
+	"go.flow.arcalot.io/pluginsdk/plugin"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"os"
+	"testing"
+)
+
+type helloWorldInput struct {
+	Name string `json:"name"`
+}
+
+type helloWorldOutput struct {
+	Message string `json:"message"`
+}
+
+var helloWorldSchema = schema.NewCallableSchema(
+	schema.NewCallableStep[helloWorldInput](
+		"hello-world",
+		schema.NewScopeSchema(
+			schema.NewStructMappedObjectSchema[helloWorldInput](
+				"Input",
+				map[string]*schema.PropertySchema{
+					"name": schema.NewPropertySchema(
+						schema.NewStringSchema(nil, nil, nil),
+						nil,
+						true,
+						nil,
+						nil,
+						nil,
+						nil,
+						nil,
+					),
+				},
+			),
+		),
+		map[string]*schema.StepOutputSchema{
+			"success": schema.NewStepOutputSchema(
+				schema.NewScopeSchema(
+					schema.NewStructMappedObjectSchema[helloWorldOutput](
+						"Output",
+						map[string]*schema.PropertySchema{
+							"message": schema.NewPropertySchema(
+								schema.NewStringSchema(nil, nil, nil),
+								nil,
+								true,
+								nil,
+								nil,
+								nil,
+								nil,
+								nil,
+							),
+						},
+					),
+				),
+				nil,
+				false,
+			),
+		},
+		nil,
+		func(_ context.Context, input helloWorldInput) (string, any) {
+			return "success", helloWorldOutput{Message: "Hello, " + input.Name + "!"}
+		},
+	),
+)
+
+var suiteOptions = atptest.Options{
+	StepID: "hello-world",
+	Input:  map[string]any{"name": "Arca Lot"},
+}
+
+// runPluginEnv makes the test binary run the plugin instead of the tests, so it can be used as plugin executable.
+const runPluginEnv = "ATPTEST_RUN_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runPluginEnv) != "" {
+		plugin.Run(helloWorldSchema)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRun(t *testing.T) {
+	atptest.Run(t, atptest.SchemaFactory(helloWorldSchema, atp.ServerOptions{}), suiteOptions)
+}
+
+func TestRun_WithoutStep(t *testing.T) {
+	atptest.Run(t, atptest.SchemaFactory(helloWorldSchema, atp.ServerOptions{}), atptest.Options{})
+}
+
+func TestRunExecutable(t *testing.T) {
+	t.Setenv(runPluginEnv, "1")
+	atptest.RunExecutable(t, os.Args[0], []string{"--atp"}, suiteOptions)
+}
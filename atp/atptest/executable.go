@@ -0,0 +1,73 @@
+package atptest
+
+import (
+	"errors"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// executableStopTimeout is the time a plugin executable has to exit after its stdin was closed, before it is killed.
+const executableStopTimeout = 5 * time.Second
+
+// ExecutableFactory returns a ChannelFactory that starts the plugin executable with the given arguments for every
+// session, and talks to it over its stdin and stdout. The stderr of the plugin is passed through.
+func ExecutableFactory(path string, args ...string) ChannelFactory {
+	return func(t *testing.T) atp.ClientChannel {
+		cmd := exec.Command(path, args...) //nolint:gosec // Running the plugin under test is the point.
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatalf("failed to create stdin pipe for plugin %s (%v)", path, err)
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatalf("failed to create stdout pipe for plugin %s (%v)", path, err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("failed to start plugin %s (%v)", path, err)
+		}
+		channel := &executableChannel{cmd, stdin, stdout}
+		t.Cleanup(func() {
+			_ = channel.Close()
+		})
+		return channel
+	}
+}
+
+type executableChannel struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func (e *executableChannel) Read(p []byte) (int, error) {
+	return e.stdout.Read(p)
+}
+
+func (e *executableChannel) Write(p []byte) (int, error) {
+	return e.stdin.Write(p)
+}
+
+// Close closes the stdin of the plugin, and waits for it to exit. The plugin is killed if it does not exit in time.
+// The exit status is ignored, since the suite checks the behavior of the plugin over ATP only.
+func (e *executableChannel) Close() error {
+	if err := e.stdin.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		_ = e.cmd.Wait()
+	}()
+	select {
+	case <-exited:
+	case <-time.After(executableStopTimeout):
+		_ = e.cmd.Process.Kill()
+		<-exited
+	}
+	return nil
+}
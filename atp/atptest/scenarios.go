@@ -0,0 +1,156 @@
+package atptest
+
+import (
+	"fmt"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"slices"
+	"testing"
+)
+
+// unknownID is used as step and signal ID that no plugin is expected to have.
+const unknownID = "atptest-unknown-id"
+
+func testHandshake(t *testing.T, s *session, _ Options) {
+	features := []string{atp.FeatureLogStreaming, atp.FeatureBlobStreaming, atp.FeatureStructuredErrors,
+		atp.FeatureTraceContext, atp.FeatureResourceUsage, atp.FeatureRunStatus, atp.FeatureSignalReplies, unknownID}
+	hello := s.handshake(atp.StartMessage{Versions: clientVersions, Features: features})
+	if !slices.Contains(clientVersions, hello.Version) {
+		t.Errorf("plugin chose ATP v%d, which the client does not support (%v)", hello.Version, clientVersions)
+	}
+	for _, capability := range hello.Capabilities {
+		if !slices.Contains(features, capability) || capability == unknownID {
+			t.Errorf("plugin enabled feature '%s', which the client did not ask for or does not know", capability)
+		}
+	}
+	s.finish()
+}
+
+func testLegacyHandshake(t *testing.T, s *session, _ Options) {
+	// Clients before ATP v4 send an empty start message, and do not know about the hello message capabilities.
+	hello := s.handshake(nil)
+	if hello.Version > 3 {
+		t.Errorf("plugin chose ATP v%d for a client that sent an empty start message", hello.Version)
+	}
+	if len(hello.Capabilities) != 0 {
+		t.Errorf("plugin enabled features %v for a client that sent an empty start message", hello.Capabilities)
+	}
+	s.finish()
+}
+
+func testSchema(t *testing.T, s *session, options Options) {
+	hello := s.start()
+	pluginSchema, err := schema.UnserializeSchema(hello.Schema)
+	if err != nil {
+		t.Fatalf("plugin sent an invalid schema (%v)", err)
+	}
+	if len(pluginSchema.Steps()) == 0 {
+		t.Errorf("plugin schema has no steps")
+	}
+	if options.StepID != "" {
+		if _, found := pluginSchema.Steps()[options.StepID]; !found {
+			t.Errorf("plugin schema has no step with ID '%s'", options.StepID)
+		}
+	}
+	s.finish()
+}
+
+func testUnknownStep(t *testing.T, s *session, _ Options) {
+	s.start()
+	runID := t.Name()
+	s.sendRuntimeMessage(atp.MessageTypeWorkStart, runID, atp.WorkStartMessage{
+		StepID: unknownID,
+		Config: map[string]any{},
+	})
+	s.expectStepFatalError(runID)
+	s.finish()
+}
+
+func testInvalidInput(t *testing.T, s *session, options Options) {
+	if options.StepID == "" {
+		t.Skip("no step ID given")
+	}
+	s.start()
+	runID := t.Name()
+	s.sendRuntimeMessage(atp.MessageTypeWorkStart, runID, atp.WorkStartMessage{
+		StepID: options.StepID,
+		// Step inputs are objects, which do not accept unknown properties.
+		Config: map[string]any{unknownID: unknownID},
+	})
+	s.expectStepFatalError(runID)
+	s.finish()
+}
+
+func testUnknownSignal(t *testing.T, s *session, options Options) {
+	if options.StepID == "" {
+		t.Skip("no step ID given")
+	}
+	s.start()
+	runID := t.Name()
+	s.sendRuntimeMessage(atp.MessageTypeWorkStart, runID, atp.WorkStartMessage{
+		StepID: options.StepID,
+		Config: options.Input,
+	})
+	s.sendRuntimeMessage(atp.MessageTypeSignal, runID, atp.SignalMessage{
+		SignalID: unknownID,
+		Data:     map[string]any{},
+	})
+	// The signal must be rejected without failing the run, whether it arrived before or after the run finished.
+	workDone, signalRejected := false, false
+	for !workDone || !signalRejected {
+		message := s.receiveRuntimeMessage()
+		switch message.MessageID {
+		case atp.MessageTypeWorkDone:
+			var doneMessage atp.WorkDoneMessage
+			s.decodeData(message, &doneMessage)
+			workDone = true
+		case atp.MessageTypeError:
+			errorMessage := s.decodeError(message)
+			if errorMessage.StepFatal || errorMessage.ServerFatal {
+				t.Fatalf("unknown signal failed the run: %s", errorMessage.ToString(message.RunID))
+			}
+			signalRejected = true
+		default:
+			t.Fatalf("unexpected message %d for run '%s'", message.MessageID, message.RunID)
+		}
+	}
+	s.finish()
+}
+
+func testParallelRuns(t *testing.T, s *session, options Options) {
+	if options.StepID == "" {
+		t.Skip("no step ID given")
+	}
+	s.start()
+	pending := map[string]bool{}
+	for i := 0; i < options.ParallelRuns; i++ {
+		runID := fmt.Sprintf("%s-%d", t.Name(), i)
+		pending[runID] = true
+		s.sendRuntimeMessage(atp.MessageTypeWorkStart, runID, atp.WorkStartMessage{
+			StepID: options.StepID,
+			Config: options.Input,
+		})
+	}
+	for len(pending) > 0 {
+		message := s.receiveRuntimeMessage()
+		if message.MessageID != atp.MessageTypeWorkDone {
+			t.Fatalf("expected a work done message, got message %d for run '%s'", message.MessageID, message.RunID)
+		}
+		if !pending[message.RunID] {
+			t.Fatalf("unexpected work done message for run '%s'", message.RunID)
+		}
+		var doneMessage atp.WorkDoneMessage
+		s.decodeData(message, &doneMessage)
+		if doneMessage.StepID != options.StepID {
+			t.Errorf("work done message for run '%s' has step ID '%s' instead of '%s'",
+				message.RunID, doneMessage.StepID, options.StepID)
+		}
+		delete(pending, message.RunID)
+	}
+	s.finish()
+}
+
+func testClientDone(_ *testing.T, s *session, _ Options) {
+	s.start()
+	s.finish()
+}
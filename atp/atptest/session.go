@@ -0,0 +1,164 @@
+package atptest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"io"
+	"testing"
+	"time"
+)
+
+// session is a raw ATP session with the plugin under test. It checks the shape of every message it decodes.
+type session struct {
+	t       *testing.T
+	channel atp.ClientChannel
+	encoder *cbor.Encoder
+	decoder *cbor.Decoder
+	decMode cbor.DecMode
+	timeout time.Duration
+}
+
+func newSession(t *testing.T, channel atp.ClientChannel, timeout time.Duration) *session {
+	decMode, err := cbor.DecOptions{
+		ExtraReturnErrors: cbor.ExtraDecErrorUnknownField,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() {
+		_ = channel.Close()
+	})
+	return &session{
+		t:       t,
+		channel: channel,
+		encoder: cbor.NewEncoder(channel),
+		decoder: decMode.NewDecoder(channel),
+		decMode: decMode,
+		timeout: timeout,
+	}
+}
+
+func (s *session) send(message any) {
+	s.t.Helper()
+	if err := s.encoder.Encode(message); err != nil {
+		s.t.Fatalf("failed to send message to the plugin (%v)", err)
+	}
+}
+
+func (s *session) sendRuntimeMessage(messageID uint32, runID string, data any) {
+	s.t.Helper()
+	s.send(atp.RuntimeMessage{
+		MessageID:   messageID,
+		RunID:       runID,
+		MessageData: data,
+	})
+}
+
+// receive decodes the next message from the plugin, failing the test if it does not arrive within the timeout.
+func (s *session) receive(message any) {
+	s.t.Helper()
+	if err := s.tryReceive(message); err != nil {
+		s.t.Fatalf("failed to receive message from the plugin (%v)", err)
+	}
+}
+
+// tryReceive decodes the next message from the plugin, and returns the error if that fails. The channel is closed if
+// the message does not arrive within the timeout, since the decoder cannot be interrupted otherwise.
+func (s *session) tryReceive(message any) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- s.decoder.Decode(message)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(s.timeout):
+		_ = s.channel.Close()
+		<-result
+		return fmt.Errorf("no message received within %s", s.timeout)
+	}
+}
+
+// handshake sends the start message, and returns the hello message of the plugin.
+func (s *session) handshake(startMessage any) atp.HelloMessage {
+	s.t.Helper()
+	s.send(startMessage)
+	var hello atp.HelloMessage
+	s.receive(&hello)
+	if hello.Version < minimumVersion {
+		s.t.Fatalf("plugin chose ATP v%d, the conformance suite requires v%d or later", hello.Version, minimumVersion)
+	}
+	return hello
+}
+
+// start performs the handshake without requesting optional features.
+func (s *session) start() atp.HelloMessage {
+	s.t.Helper()
+	return s.handshake(atp.StartMessage{Versions: clientVersions})
+}
+
+// receiveRuntimeMessage returns the next runtime message that is not a log message.
+func (s *session) receiveRuntimeMessage() atp.DecodedRuntimeMessage {
+	s.t.Helper()
+	for {
+		var message atp.DecodedRuntimeMessage
+		s.receive(&message)
+		if message.MessageID != atp.MessageTypeLog {
+			return message
+		}
+	}
+}
+
+// decodeData decodes the data of a runtime message, failing the test if it has unknown fields.
+func (s *session) decodeData(message atp.DecodedRuntimeMessage, data any) {
+	s.t.Helper()
+	if err := s.decMode.Unmarshal(message.RawMessageData, data); err != nil {
+		s.t.Fatalf("invalid data in message %d for run '%s' (%v)", message.MessageID, message.RunID, err)
+	}
+}
+
+// decodeError decodes an error message, and checks its shape.
+func (s *session) decodeError(message atp.DecodedRuntimeMessage) atp.ErrorMessage {
+	s.t.Helper()
+	var errorMessage atp.ErrorMessage
+	s.decodeData(message, &errorMessage)
+	if errorMessage.Error == "" {
+		s.t.Errorf("error message for run '%s' has no error text", message.RunID)
+	}
+	return errorMessage
+}
+
+// expectStepFatalError expects an error message for the run that fails the run, but not the session.
+func (s *session) expectStepFatalError(runID string) {
+	s.t.Helper()
+	message := s.receiveRuntimeMessage()
+	if message.MessageID != atp.MessageTypeError {
+		s.t.Fatalf("expected an error message for run '%s', got message %d for run '%s'",
+			runID, message.MessageID, message.RunID)
+	}
+	errorMessage := s.decodeError(message)
+	if message.RunID != runID {
+		s.t.Errorf("error message has run ID '%s' instead of '%s'", message.RunID, runID)
+	}
+	if !errorMessage.StepFatal || errorMessage.ServerFatal {
+		s.t.Errorf("expected a step fatal, but not server fatal error for run '%s', got %s",
+			runID, errorMessage.ToString(message.RunID))
+	}
+}
+
+// finish sends the client done message, and expects the plugin to end the session.
+func (s *session) finish() {
+	s.t.Helper()
+	s.sendRuntimeMessage(atp.MessageTypeClientDone, "", map[string]any{})
+	var message atp.DecodedRuntimeMessage
+	err := s.tryReceive(&message)
+	switch {
+	case err == nil:
+		s.t.Errorf("plugin sent message %d for run '%s' after the client done message",
+			message.MessageID, message.RunID)
+	case !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.ErrClosedPipe):
+		s.t.Errorf("plugin did not end the session after the client done message (%v)", err)
+	}
+}
@@ -0,0 +1,223 @@
+package atp
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// BlobReader reads a named binary stream a step sends while it is running. The client acknowledges the data to the
+// plugin as it is read, so a step writing faster than the stream is read waits for the reader. A stream that is not
+// needed should be closed, which discards the rest of its data.
+type BlobReader struct {
+	client  *client
+	runID   string
+	name    string
+	lock    sync.Mutex
+	cond    *sync.Cond
+	chunks  [][]byte
+	pending int64 // Bytes consumed, but not acknowledged to the plugin yet.
+	eof     bool
+	err     error
+	closed  bool
+}
+
+func newBlobReader(c *client, runID string, name string) *BlobReader {
+	reader := &BlobReader{
+		client: c,
+		runID:  runID,
+		name:   name,
+	}
+	reader.cond = sync.NewCond(&reader.lock)
+	return reader
+}
+
+// Name returns the name of the stream, as set by the step.
+func (r *BlobReader) Name() string {
+	return r.name
+}
+
+// Read reads the next bytes of the stream, blocking until the step sends them. It returns io.EOF once the step
+// closed the stream, or an error wrapping io.ErrUnexpectedEOF if the run finished before that.
+func (r *BlobReader) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	for len(r.chunks) == 0 && !r.eof && r.err == nil && !r.closed {
+		r.cond.Wait()
+	}
+	switch {
+	case r.closed:
+		r.lock.Unlock()
+		return 0, io.ErrClosedPipe
+	case len(r.chunks) > 0:
+		n := 0
+		for len(r.chunks) > 0 && n < len(p) {
+			copied := copy(p[n:], r.chunks[0])
+			n += copied
+			if copied == len(r.chunks[0]) {
+				r.chunks = r.chunks[1:]
+			} else {
+				r.chunks[0] = r.chunks[0][copied:]
+			}
+		}
+		r.pending += int64(n)
+		// Acknowledging every read would flood the plugin with small messages, so wait for a full chunk, unless
+		// the plugin may be waiting for the reader to catch up.
+		var acknowledged int64
+		if r.pending >= blobChunkSize || len(r.chunks) == 0 {
+			acknowledged = r.pending
+			r.pending = 0
+		}
+		r.lock.Unlock()
+		r.acknowledge(acknowledged)
+		return n, nil
+	case r.err != nil:
+		err := r.err
+		r.lock.Unlock()
+		return 0, err
+	default:
+		r.lock.Unlock()
+		return 0, io.EOF
+	}
+}
+
+// Close discards the rest of the stream. The step can still write to the stream, but its data is dropped.
+func (r *BlobReader) Close() error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	r.closed = true
+	acknowledged := r.pending
+	for _, chunk := range r.chunks {
+		acknowledged += int64(len(chunk))
+	}
+	r.chunks = nil
+	r.pending = 0
+	r.cond.Broadcast()
+	r.lock.Unlock()
+	r.acknowledge(acknowledged)
+	return nil
+}
+
+// push adds a chunk received from the plugin to the stream.
+func (r *BlobReader) push(data []byte, eof bool) {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		r.acknowledge(int64(len(data)))
+		return
+	}
+	if r.eof {
+		r.lock.Unlock()
+		r.client.logger.Warningf("Step with run ID '%s' sent data for blob stream '%s' after it ended.",
+			r.runID, r.name)
+		return
+	}
+	if len(data) > 0 {
+		r.chunks = append(r.chunks, data)
+	}
+	r.eof = eof
+	r.cond.Broadcast()
+	r.lock.Unlock()
+}
+
+// fail ends a stream the plugin did not close before the run finished.
+func (r *BlobReader) fail(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.eof || r.err != nil {
+		return
+	}
+	r.err = err
+	r.cond.Broadcast()
+}
+
+func (r *BlobReader) acknowledge(consumed int64) {
+	if consumed == 0 {
+		return
+	}
+	r.client.acknowledgeBlob(r.runID, r.name, consumed)
+}
+
+// runBlobs holds the blob streams received for a run started with RunStarter.Start.
+type runBlobs struct {
+	channel chan<- *BlobReader
+	readers map[string]*BlobReader // Maps stream name to reader
+}
+
+func (c *client) acknowledgeBlob(runID string, stream string, consumed int64) {
+	if err := c.sendCBOR(RuntimeMessage{
+		MessageID: MessageTypeBlobAck,
+		RunID:     runID,
+		MessageData: BlobAckMessage{
+			Stream: stream,
+			Bytes:  consumed,
+		},
+	}); err != nil {
+		c.logger.Warningf("Failed to acknowledge blob stream '%s' of run ID '%s': %v", stream, runID, err)
+	}
+}
+
+func (c *client) handleBlobChunkMessage(runtimeMessage DecodedRuntimeMessage) {
+	var chunkMessage BlobChunkMessage
+	if err := c.messageDecMode.Unmarshal(runtimeMessage.RawMessageData, &chunkMessage); err != nil {
+		c.logger.Errorf("ATP client for run ID '%s' failed to decode blob chunk message: %v",
+			runtimeMessage.RunID, err)
+		return
+	}
+	c.mutex.Lock()
+	blobs, found := c.runningStepBlobs[runtimeMessage.RunID]
+	if !found {
+		c.mutex.Unlock()
+		c.logger.Warningf(
+			"Step with run ID '%s' sent data for blob stream '%s'. Ignoring; the run was not started with Start.",
+			runtimeMessage.RunID, chunkMessage.Stream)
+		// Acknowledge the data anyway, so the step does not wait for a reader that does not exist.
+		if len(chunkMessage.Data) > 0 {
+			c.acknowledgeBlob(runtimeMessage.RunID, chunkMessage.Stream, int64(len(chunkMessage.Data)))
+		}
+		return
+	}
+	reader, found := blobs.readers[chunkMessage.Stream]
+	if !found {
+		c.logger.Debugf("Step with run ID '%s' opened blob stream '%s'", runtimeMessage.RunID,
+			chunkMessage.Stream)
+		reader = newBlobReader(c, runtimeMessage.RunID, chunkMessage.Stream)
+		// Hold the lock until the reader is sent to prevent premature closing of the channel. The read loop must not
+		// wait for the caller while holding the lock, so the run fails if the caller does not read the blob streams.
+		select {
+		case blobs.channel <- reader:
+			blobs.readers[chunkMessage.Stream] = reader
+		default:
+			c.abandonRunLocked(runtimeMessage.RunID, fmt.Errorf(
+				"run '%s' opened more than %d blob streams that were not read from RunHandle.Blobs",
+				runtimeMessage.RunID, cap(blobs.channel),
+			))
+			c.mutex.Unlock()
+			// The step may wait for the data to be acknowledged.
+			if len(chunkMessage.Data) > 0 {
+				c.acknowledgeBlob(runtimeMessage.RunID, chunkMessage.Stream, int64(len(chunkMessage.Data)))
+			}
+			return
+		}
+	}
+	c.mutex.Unlock()
+	reader.push(chunkMessage.Data, chunkMessage.EOF)
+}
+
+// finishBlobs ends the blob streams of a finished run, and closes its blob channel.
+// The caller must have the mutex locked while calling this function.
+func (c *client) finishBlobs(runID string) {
+	blobs, found := c.runningStepBlobs[runID]
+	if !found {
+		return
+	}
+	delete(c.runningStepBlobs, runID)
+	for _, reader := range blobs.readers {
+		reader.fail(fmt.Errorf(
+			"run '%s' finished before blob stream '%s' ended (%w)", runID, reader.name, io.ErrUnexpectedEOF,
+		))
+	}
+	close(blobs.channel)
+}
@@ -0,0 +1,246 @@
+package atp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"io"
+	"sync"
+)
+
+// DefaultBlobWindowSize is the default number of bytes of a blob stream the server sends before it waits for the
+// client to acknowledge them.
+const DefaultBlobWindowSize = 1024 * 1024
+
+// blobChunkSize is the maximum number of bytes sent in a single blob chunk message.
+const blobChunkSize = 64 * 1024
+
+type blobStreamsContextKey struct{}
+
+// OpenBlobStream opens a named stream to send binary data to the client while the step is running. The data written
+// is sent in chunks as it is written, and writes block while the client is behind by the blob window size, or until the
+// context is done. Closing the writer ends the stream. Streams left open are closed when the step returns. An error is
+// returned if the context was not passed to a step handler by the ATP server, or if the client does not support blob
+// streaming.
+func OpenBlobStream(ctx context.Context, name string) (io.WriteCloser, error) {
+	streams, ok := ctx.Value(blobStreamsContextKey{}).(*blobStreams)
+	if !ok {
+		return nil, schema.IllegalStateError{
+			Cause: fmt.Errorf("cannot open blob stream '%s' outside of a step run by the ATP server", name),
+		}
+	}
+	if streams == nil {
+		return nil, schema.IllegalStateError{
+			Cause: fmt.Errorf("cannot open blob stream '%s', the client does not support blob streaming", name),
+		}
+	}
+	return streams.open(ctx, name)
+}
+
+func withBlobStreams(ctx context.Context, streams *blobStreams) context.Context {
+	return context.WithValue(ctx, blobStreamsContextKey{}, streams)
+}
+
+// blobStreams holds the blob streams of a single run.
+type blobStreams struct {
+	session    *atpServerSession
+	runID      string
+	windowSize int
+	lock       sync.Mutex
+	cond       *sync.Cond
+	writers    map[string]*blobWriter // Maps stream name to writer
+	done       bool                   // Set when the run is finished, or the client can no longer acknowledge data.
+}
+
+func newBlobStreams(session *atpServerSession, runID string) *blobStreams {
+	streams := &blobStreams{
+		session:    session,
+		runID:      runID,
+		windowSize: session.options.BlobWindowSize,
+		writers:    map[string]*blobWriter{},
+	}
+	streams.cond = sync.NewCond(&streams.lock)
+	return streams
+}
+
+func (b *blobStreams) open(ctx context.Context, name string) (io.WriteCloser, error) {
+	if name == "" {
+		return nil, schema.BadArgumentError{Message: "blob stream name is empty"}
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.done {
+		return nil, schema.IllegalStateError{
+			Cause: fmt.Errorf("cannot open blob stream '%s' after run '%s' finished", name, b.runID),
+		}
+	}
+	if _, found := b.writers[name]; found {
+		return nil, schema.BadArgumentError{
+			Message: fmt.Sprintf("blob stream '%s' is already open for run '%s'", name, b.runID),
+		}
+	}
+	writer := &blobWriter{
+		streams: b,
+		name:    name,
+		ctx:     ctx,
+	}
+	// Wake up the writes waiting for the client once the step is cancelled.
+	writer.stopWakeup = context.AfterFunc(ctx, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.cond.Broadcast()
+	})
+	b.writers[name] = writer
+	return writer, nil
+}
+
+// acknowledge frees up the window of the stream after the client consumed the given number of bytes.
+func (b *blobStreams) acknowledge(name string, consumed int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	writer, found := b.writers[name]
+	if !found {
+		return
+	}
+	writer.unacknowledged = max(writer.unacknowledged-int(consumed), 0)
+	b.cond.Broadcast()
+}
+
+// close ends all streams left open once the run is finished, and fails further writes.
+func (b *blobStreams) close() {
+	b.lock.Lock()
+	writers := make([]*blobWriter, 0, len(b.writers))
+	for _, writer := range b.writers {
+		writers = append(writers, writer)
+	}
+	b.lock.Unlock()
+	for _, writer := range writers {
+		_ = writer.Close()
+	}
+	b.abort()
+}
+
+// abort wakes up and fails all writes waiting for the client, for example because the client is gone.
+func (b *blobStreams) abort() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.done = true
+	b.cond.Broadcast()
+}
+
+type blobWriter struct {
+	streams        *blobStreams
+	name           string
+	ctx            context.Context // The context of the step that opened the stream.
+	stopWakeup     func() bool
+	unacknowledged int // Guarded by the lock of the streams.
+	closed         bool
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		w.streams.lock.Lock()
+		for !w.closed && !w.streams.done && w.ctx.Err() == nil && w.unacknowledged >= w.streams.windowSize {
+			w.streams.cond.Wait()
+		}
+		if err := w.ctx.Err(); err != nil {
+			w.streams.lock.Unlock()
+			return written, err
+		}
+		if w.closed || w.streams.done {
+			w.streams.lock.Unlock()
+			return written, schema.IllegalStateError{
+				Cause: fmt.Errorf("cannot write to closed blob stream '%s' of run '%s'", w.name, w.streams.runID),
+			}
+		}
+		size := min(len(p)-written, w.streams.windowSize-w.unacknowledged, blobChunkSize)
+		w.unacknowledged += size
+		w.streams.lock.Unlock()
+
+		// The chunk is copied, because the encoder may still be using it after a send timeout.
+		if err := w.streams.session.sendRuntimeMessage(
+			MessageTypeBlobChunk,
+			w.streams.runID,
+			BlobChunkMessage{
+				Stream: w.name,
+				Data:   bytes.Clone(p[written : written+size]),
+			},
+		); err != nil {
+			return written, fmt.Errorf("failed to send chunk of blob stream '%s' (%w)", w.name, err)
+		}
+		written += size
+	}
+	return written, nil
+}
+
+func (w *blobWriter) Close() error {
+	w.streams.lock.Lock()
+	if w.closed {
+		w.streams.lock.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.streams.cond.Broadcast()
+	w.streams.lock.Unlock()
+	w.stopWakeup()
+	if err := w.streams.session.sendRuntimeMessage(
+		MessageTypeBlobChunk,
+		w.streams.runID,
+		BlobChunkMessage{
+			Stream: w.name,
+			EOF:    true,
+		},
+	); err != nil {
+		return fmt.Errorf("failed to send end of blob stream '%s' (%w)", w.name, err)
+	}
+	return nil
+}
+
+// startBlobStreams creates the blob streams of a run. It returns nil if the client does not support blob streaming.
+func (s *atpServerSession) startBlobStreams(runID string) *blobStreams {
+	if !s.blobStreaming {
+		return nil
+	}
+	streams := newBlobStreams(s, runID)
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+	if s.blobsAborted {
+		streams.abort()
+	}
+	s.runBlobStreams[runID] = streams
+	return streams
+}
+
+// finishBlobStreams closes the blob streams of a finished run.
+func (s *atpServerSession) finishBlobStreams(runID string, streams *blobStreams) {
+	if streams == nil {
+		return
+	}
+	streams.close()
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+	delete(s.runBlobStreams, runID)
+}
+
+func (s *atpServerSession) handleBlobAckMessage(runID string, ackMessage BlobAckMessage) {
+	s.blobLock.Lock()
+	streams, found := s.runBlobStreams[runID]
+	s.blobLock.Unlock()
+	if !found {
+		// The run may have finished while the client was reading the last chunks.
+		return
+	}
+	streams.acknowledge(ackMessage.Stream, ackMessage.Bytes)
+}
+
+// abortBlobStreams fails the writes of all runs once the client can no longer acknowledge data.
+func (s *atpServerSession) abortBlobStreams() {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+	s.blobsAborted = true
+	for _, streams := range s.runBlobStreams {
+		streams.abort()
+	}
+}
@@ -7,12 +7,14 @@ import (
 	"go.arcalot.io/log/v2"
 	"go.flow.arcalot.io/pluginsdk/schema"
 	"io"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 )
 
-var supportedServerVersions = []int64{1, 3}
+var supportedServerVersions = []int64{1, 3, 4}
 
 // ClientChannel holds the methods to talking to an ATP server (plugin).
 type ClientChannel interface {
@@ -25,10 +27,16 @@ type ExecutionResult struct {
 	OutputID   string
 	OutputData any
 	Error      error
+	// TraceContext is the trace context of the plugin's span of the run. It is only valid if the run was started with
+	// a trace context, and the plugin supports FeatureTraceContext.
+	TraceContext TraceContext
+	// ResourceUsage holds the resources the plugin process used during the run. It is only set for successful runs
+	// if the plugin supports FeatureResourceUsage.
+	ResourceUsage *ResourceUsage
 }
 
 func NewErrorExecutionResult(err error) ExecutionResult {
-	return ExecutionResult{"", nil, err}
+	return ExecutionResult{"", nil, err, TraceContext{}, nil}
 }
 
 // Client is the way to read information from the ATP server and then send a task to it in the form of a step.
@@ -49,6 +57,17 @@ type Client interface {
 	Decoder() *cbor.Decoder
 }
 
+// RunStarter is implemented by the clients that can start runs without waiting for their result. All clients created by
+// this package implement it:
+//
+//	handle, err := client.(atp.RunStarter).Start(ctx, input)
+type RunStarter interface {
+	// Start starts a step without waiting for its result, and returns a handle to control the run. Assumes you
+	// called ReadSchema first. When the context is cancelled, the client sends the cancel signal to the step, and
+	// fails the run if it does not finish within the cancel timeout set in the ClientOptions.
+	Start(ctx context.Context, input schema.Input) (RunHandle, error)
+}
+
 // NewClient creates a new ATP client (part of the engine code).
 // Currently used only by tests in the Python- and Test-deployers.
 //
@@ -59,28 +78,107 @@ func NewClient(
 	return NewClientWithLogger(channel, nil)
 }
 
+// ClientOptions holds the settings of an ATP client. Fields left at their zero value use the default setting.
+type ClientOptions struct {
+	// Logger receives the logs of the client and the plugin. Defaults to a logger that discards all messages.
+	Logger log.Logger
+	// CancelTimeout is the time a run started with RunStarter.Start has to finish after its context was cancelled,
+	// before the client fails it. Defaults to DefaultCancelTimeout.
+	CancelTimeout time.Duration
+	// SignalReplyTimeout is the maximum time RunHandle.SendSignalWithReply waits for the reply. Defaults to
+	// DefaultSignalReplyTimeout.
+	SignalReplyTimeout time.Duration
+	// Features lists the optional protocol features the client asks the plugin to enable. Defaults to all features
+	// the client supports if nil.
+	Features []string
+	// ValidateSteps makes the client check the step ID and input of every run against the plugin schema before
+	// starting it, and the output ID and data the plugin returns against the output schemas the step declares. The
+	// output data of successful runs is unserialized with the output schema. Requires calling ReadSchema first.
+	ValidateSteps bool
+	// Metrics receives the metrics the client records for each run. Defaults to discarding them.
+	Metrics MetricsSink
+	// Tracer creates the client's spans of the runs, which the plugin's spans become children of. Without a tracer,
+	// the trace context of the context passed to RunStarter.Start is sent to the plugin as the parent of the run.
+	Tracer Tracer
+	// DecoderLimits limits the size and complexity of the messages the client accepts from the plugin. A message
+	// exceeding them fails all running steps. If the limits are out of range, every call that uses the client fails.
+	DecoderLimits DecoderLimits
+	// Format is the encoding of the messages. The plugin must use the same format, see StartPlugin.
+	// If the format is not supported, every call of the client returns an error. Defaults to FormatCBOR.
+	Format Format
+}
+
 // NewClientWithLogger creates a new ATP client (part of the engine code) with a logger.
 func NewClientWithLogger(
 	channel ClientChannel,
 	logger log.Logger,
 ) Client {
-	decMode, err := cbor.DecOptions{
-		ExtraReturnErrors: cbor.ExtraDecErrorUnknownField,
-	}.DecMode()
-	if err != nil {
-		panic(err)
-	}
+	return NewClientWithOptions(channel, ClientOptions{Logger: logger})
+}
+
+// NewClientWithLogStreaming creates a new ATP client (part of the engine code) with a logger, which asks the plugin to
+// stream the logs of running steps. The plugin sends them as log messages since ATP v4, and the client writes them
+// to the logger with the run ID attached. Plugins speaking older versions send them with the debug logs instead.
+func NewClientWithLogStreaming(
+	channel ClientChannel,
+	logger log.Logger,
+) Client {
+	return NewClientWithOptions(channel, ClientOptions{Logger: logger, Features: []string{FeatureLogStreaming}})
+}
+
+// NewClientWithOptions creates a new ATP client (part of the engine code) with the given settings.
+func NewClientWithOptions(
+	channel ClientChannel,
+	options ClientOptions,
+) Client {
+	decoderLimits := options.DecoderLimits.withDefaults()
+	var optionsErr error
+	if _, err := decoderLimits.decOptions().DecMode(); err != nil {
+		// The client is only used to report the error, so the default limits, which are valid, are used instead.
+		optionsErr = fmt.Errorf("invalid decoder limits (%w)", err)
+		decoderLimits = DecoderLimits{}.withDefaults()
+	}
+	// The data of the runtime messages is decoded leniently, so newer plugins can add fields to it.
+	messageDecMode, _ := decoderLimits.decOptions().DecMode()
+	decOptions := decoderLimits.decOptions()
+	decOptions.ExtraReturnErrors = cbor.ExtraDecErrorUnknownField
+	decMode, _ := decOptions.DecMode()
+	logger := options.Logger
 	if logger == nil {
 		logger = log.NewLogger(log.LevelDebug, log.NewNOOPLogger())
 	}
+	cancelTimeout := options.CancelTimeout
+	if cancelTimeout <= 0 {
+		cancelTimeout = DefaultCancelTimeout
+	}
+	signalReplyTimeout := options.SignalReplyTimeout
+	if signalReplyTimeout <= 0 {
+		signalReplyTimeout = DefaultSignalReplyTimeout
+	}
+	features := options.Features
+	if features == nil {
+		features = slices.Sorted(maps.Keys(featureVersions))
+	}
+	metrics := options.Metrics
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
+	format, err := ParseFormat(string(options.Format))
+	if err != nil && optionsErr == nil {
+		optionsErr = fmt.Errorf("invalid format (%w)", err)
+	}
+	if format == FormatJSONLines {
+		channel = newJSONLinesChannel(channel, decoderLimits.MaxMessageSize)
+	}
+	channelCounter := &countingWriter{Writer: channel}
 	ctx, cancel := context.WithCancel(context.Background())
 	return &client{
 		-1, // unknown
 		channel,
 		decMode,
 		logger,
-		decMode.NewDecoder(channel),
-		cbor.NewEncoder(channel),
+		decoderLimits.newLimitedDecoder(decMode, channel),
+		cbor.NewEncoder(channelCounter),
 		make([]schema.Input, 0),
 		make(map[string]*executionEntry),
 		make(map[string]chan<- schema.Input),
@@ -90,6 +188,24 @@ func NewClientWithLogger(
 		ctx,
 		cancel,
 		sync.WaitGroup{},
+		cancelTimeout,
+		make(map[string]struct{}),
+		features,
+		nil,
+		make(map[string]*runBlobs),
+		options.ValidateSteps,
+		nil,
+		metrics,
+		channelCounter,
+		options.Tracer,
+		decoderLimits,
+		messageDecMode,
+		newClientEvents(),
+		make(map[uint64]chan runStatusResult),
+		0,
+		signalReplyTimeout,
+		make(map[uint64]chan signalReplyResult),
+		optionsErr,
 	}
 }
 
@@ -122,18 +238,59 @@ type client struct {
 	context                          context.Context
 	cancelFunc                       context.CancelFunc
 	wg                               sync.WaitGroup // For the read loop.
+	cancelTimeout                    time.Duration
+	abandonedRuns                    map[string]struct{}  // Runs failed by the client that the plugin may still finish.
+	features                         []string             // The optional features the client asks for.
+	capabilities                     []string             // The optional features the plugin enabled.
+	runningStepBlobs                 map[string]*runBlobs // Run ID to the blob streams of runs started with Start
+	validateSteps                    bool                 // Whether to validate step inputs and outputs.
+	pluginSchema                     *schema.SchemaSchema // The schema the plugin sent, to validate steps with.
+	metrics                          MetricsSink
+	channelCounter                   *countingWriter // Counts the bytes sent, to measure the size of messages.
+	tracer                           Tracer          // Creates the spans of the runs if set.
+	decoderLimits                    DecoderLimits
+	messageDecMode                   cbor.DecMode // Decodes the data of runtime messages.
+	events                           *clientEvents
+	runStatusRequests                map[uint64]chan runStatusResult // Request ID to the run status requests waiting
+	nextRequestID                    uint64                          // The last ID of a run status or signal request
+	signalReplyTimeout               time.Duration
+	signalReplyRequests              map[uint64]chan signalReplyResult // Request ID to the signals waiting for a reply
+	optionsErr                       error                             // Returned by every call if options are invalid.
+}
+
+// newDecoder creates a decoder for the messages of the plugin that enforces the decoder limits.
+func (c *client) newDecoder() *cbor.Decoder {
+	return c.decoderLimits.newLimitedDecoder(c.decMode, c.rawAtpChannels)
 }
 
 func (c *client) sendCBOR(message any) error {
+	runID := ""
+	if runtimeMessage, ok := message.(RuntimeMessage); ok {
+		runID = runtimeMessage.RunID
+	}
+	waitStart := time.Now()
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	return c.encoder.Encode(message)
+	if runID == "" {
+		return c.encoder.Encode(message)
+	}
+	c.metrics.ObserveDuration(runID, MetricEncoderWait, time.Since(waitStart))
+	written := c.channelCounter.written.Load()
+	err := c.encoder.Encode(message)
+	c.metrics.AddCount(runID, MetricBytesOut, c.channelCounter.written.Load()-written)
+	return err
 }
 
 func (c *client) ReadSchema() (*schema.SchemaSchema, error) {
 	c.logger.Debugf("Reading plugin schema...")
+	if c.optionsErr != nil {
+		return nil, c.optionsErr
+	}
 
-	if err := c.sendCBOR(nil); err != nil {
+	if err := c.sendCBOR(StartMessage{
+		Versions: supportedServerVersions,
+		Features: c.features,
+	}); err != nil {
 		c.logger.Errorf("Failed to encode ATP start output message: %v", err)
 		return nil, fmt.Errorf("failed to encode start output message (%w)", err)
 	}
@@ -143,7 +300,8 @@ func (c *client) ReadSchema() (*schema.SchemaSchema, error) {
 		c.logger.Errorf("Failed to decode ATP hello message: %v", err)
 		return nil, fmt.Errorf("failed to decode hello message (%w)", err)
 	}
-	c.logger.Debugf("Hello message read, ATP version %d.", hello.Version)
+	c.logger.Debugf("Hello message read, ATP version %d, capabilities %v.", hello.Version, hello.Capabilities)
+	c.publishEvent(ClientEvent{Type: ClientEventHelloReceived})
 
 	err := c.validateVersion(hello.Version)
 
@@ -153,6 +311,7 @@ func (c *client) ReadSchema() (*schema.SchemaSchema, error) {
 		return nil, err
 	}
 	c.atpVersion = hello.Version
+	c.capabilities = hello.Capabilities
 
 	unserializedSchema, err := schema.UnserializeSchema(hello.Schema)
 	if err != nil {
@@ -160,6 +319,7 @@ func (c *client) ReadSchema() (*schema.SchemaSchema, error) {
 		return nil, fmt.Errorf("invalid schema (%w)", err)
 	}
 	c.logger.Debugf("Schema unserialization complete.")
+	c.pluginSchema = unserializedSchema
 
 	return unserializedSchema, nil
 }
@@ -179,15 +339,24 @@ func (c *client) Execute(
 	signalsFromStep chan<- schema.Input,
 ) ExecutionResult {
 	c.logger.Debugf("Executing plugin step %s/%s...", stepData.RunID, stepData.ID)
+	if c.optionsErr != nil {
+		return NewErrorExecutionResult(c.optionsErr)
+	}
 	if len(stepData.RunID) == 0 {
 		return NewErrorExecutionResult(fmt.Errorf("run ID is blank for step %s", stepData.ID))
 	}
+	if err := c.validateInput(stepData); err != nil {
+		c.logger.Errorf("Invalid input for step '%s': %v", stepData.ID, err)
+		return NewErrorExecutionResult(err)
+	}
+	traceParent, endSpan := c.startSpan(context.Background(), stepData)
 	var workStartMsg any
 	workStartMsg = WorkStartMessage{
-		StepID: stepData.ID,
-		Config: stepData.InputData,
+		StepID:      stepData.ID,
+		Config:      stepData.InputData,
+		TraceParent: traceParent,
 	}
-	cborReader := c.decMode.NewDecoder(c.rawAtpChannels)
+	cborReader := c.newDecoder()
 	if c.atpVersion > 1 {
 		// Wrap it in a runtime message.
 		workStartMsg = RuntimeMessage{RunID: stepData.RunID, MessageID: MessageTypeWorkStart, MessageData: workStartMsg}
@@ -200,18 +369,27 @@ func (c *client) Execute(
 			}()
 		}
 		// Setup channels for ATP v2
-		err := c.prepareResultChannels(cborReader, stepData, signalsFromStep)
+		err := c.prepareResultChannels(cborReader, stepData, signalsFromStep, nil)
 		if err != nil {
+			endSpan(err)
 			return NewErrorExecutionResult(err)
 		}
 	}
+	c.publishEvent(ClientEvent{Type: ClientEventRunStarted, RunID: stepData.RunID, StepID: stepData.ID})
+	started := time.Now()
 	if err := c.sendCBOR(workStartMsg); err != nil {
 		c.logger.Errorf("Step '%s' failed to write start work message: %v", stepData.ID, err)
-		return NewErrorExecutionResult(fmt.Errorf("failed to write work start message (%w)", err))
+		err = fmt.Errorf("failed to write work start message (%w)", err)
+		c.publishEvent(ClientEvent{Type: ClientEventError, RunID: stepData.RunID, Err: err})
+		endSpan(err)
+		return NewErrorExecutionResult(err)
 	}
 	c.logger.Debugf("Step '%s' started, waiting for response...", stepData.ID)
 
-	return c.getResult(stepData, cborReader)
+	result := c.getResult(stepData, cborReader)
+	c.metrics.ObserveDuration(stepData.RunID, MetricRunDuration, time.Since(started))
+	endSpan(result.Error)
+	return result
 }
 
 // Close Tells the client that it's done, and can stop listening for more requests.
@@ -224,13 +402,14 @@ func (c *client) Close() error {
 	}
 	c.done = true
 	c.mutex.Unlock()
+	defer c.events.close()
 	// Now tell the server we're done.
 	// Send the client done message
 	if c.atpVersion > 1 {
 		err := c.sendCBOR(RuntimeMessage{
-			MessageTypeClientDone,
-			"",
-			clientDoneMessage{},
+			MessageID:   MessageTypeClientDone,
+			RunID:       "",
+			MessageData: clientDoneMessage{},
 		})
 		if err != nil {
 			// add a timeout to the wait to prevent it from causing a deadlock.
@@ -244,8 +423,13 @@ func (c *client) Close() error {
 					c.getRunningStepIDs(), err))
 			}
 		}
+		c.publishEvent(ClientEvent{Type: ClientEventClientDoneSent})
 	}
 	c.wg.Wait()
+	c.mutex.Lock()
+	// No results arrive for the abandoned runs anymore.
+	clear(c.abandonedRuns)
+	c.mutex.Unlock()
 	return nil
 }
 
@@ -316,9 +500,9 @@ func (c *client) executeWriteLoop(
 			return
 		}
 		if err := c.sendCBOR(RuntimeMessage{
-			MessageTypeSignal,
-			signal.RunID,
-			SignalMessage{
+			MessageID: MessageTypeSignal,
+			RunID:     signal.RunID,
+			MessageData: SignalMessage{
 				SignalID: signal.ID,
 				Data:     signal.InputData,
 			}}); err != nil {
@@ -331,6 +515,8 @@ func (c *client) executeWriteLoop(
 			)
 			return
 		}
+		c.metrics.AddCount(signal.RunID, MetricSignalsSent, 1)
+		c.publishEvent(ClientEvent{Type: ClientEventSignalSent, RunID: signal.RunID, SignalID: signal.ID})
 		c.logger.Debugf("Successfully sent signal with ID '%s' to step with run ID '%s'", signal.ID, signal.RunID)
 	}
 }
@@ -345,10 +531,14 @@ func (c *client) sendExecutionResult(runID string, result ExecutionResult) {
 		// Send the result
 		resultEntry.result = &result
 		resultEntry.condition.Signal()
+	} else if _, abandoned := c.abandonedRuns[runID]; abandoned {
+		c.logger.Debugf("Ignoring result of abandoned run ID '%s'.", runID)
+		delete(c.abandonedRuns, runID)
 	} else {
 		c.logger.Errorf("Step result entry not found for run ID '%s'. This is either a bug in the ATP "+
 			"client, or the plugin erroneously sent a second result.", runID)
 	}
+	c.finishBlobs(runID)
 	// Now close the signal channel, since it's invalid to send a signal after the step is complete.
 	signalChannel, found := c.runningStepEmittedSignalChannels[runID]
 	if !found {
@@ -358,6 +548,54 @@ func (c *client) sendExecutionResult(runID string, result ExecutionResult) {
 	close(signalChannel)
 }
 
+// maxAbandonedRuns is the maximum number of abandoned runs the client remembers, so it can ignore their results.
+const maxAbandonedRuns = 1024
+
+// abandonRun fails the run with the given error without waiting for the plugin any longer. A result the plugin
+// sends for the run later is ignored.
+func (c *client) abandonRun(runID string, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.abandonRunLocked(runID, err)
+}
+
+// abandonRunLocked abandons the run like abandonRun. The caller must have the mutex locked while calling this function.
+func (c *client) abandonRunLocked(runID string, err error) {
+	resultEntry, found := c.runningStepResultEntries[runID]
+	if !found || resultEntry.result != nil {
+		return
+	}
+	c.sendExecutionResult(runID, NewErrorExecutionResult(err))
+	if len(c.abandonedRuns) >= maxAbandonedRuns {
+		// The plugin is unlikely to still answer all of them, so forget an arbitrary one.
+		for abandonedRunID := range c.abandonedRuns {
+			delete(c.abandonedRuns, abandonedRunID)
+			break
+		}
+	}
+	c.abandonedRuns[runID] = struct{}{}
+}
+
+// runFinished returns true if the result of the run arrived, or the run is unknown.
+func (c *client) runFinished(runID string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	resultEntry, found := c.runningStepResultEntries[runID]
+	return !found || resultEntry.result != nil
+}
+
+// removeResultChannels removes the result entry and signal channel of a run that could not be started.
+func (c *client) removeResultChannels(runID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.runningStepResultEntries, runID)
+	c.finishBlobs(runID)
+	if signalChannel, found := c.runningStepEmittedSignalChannels[runID]; found {
+		delete(c.runningStepEmittedSignalChannels, runID)
+		close(signalChannel)
+	}
+}
+
 func (c *client) sendErrorToAll(err error) {
 	result := NewErrorExecutionResult(err)
 	c.mutex.Lock()
@@ -370,11 +608,12 @@ func (c *client) sendErrorToAll(err error) {
 func (c *client) handleWorkDoneMessage(runtimeMessage DecodedRuntimeMessage) {
 	var doneMessage WorkDoneMessage
 	var result ExecutionResult
-	if err := cbor.Unmarshal(runtimeMessage.RawMessageData, &doneMessage); err != nil {
+	if err := c.messageDecMode.Unmarshal(runtimeMessage.RawMessageData, &doneMessage); err != nil {
 		c.logger.Errorf("Failed to decode work done message (%v) for run ID '%s' ", err, runtimeMessage.RunID)
 		result = NewErrorExecutionResult(fmt.Errorf("failed to decode work done message (%w)", err))
 	} else {
 		result = c.processWorkDone(runtimeMessage.RunID, doneMessage)
+		result.TraceContext = c.remoteTraceContext(runtimeMessage)
 	}
 	c.mutex.Lock()
 	c.sendExecutionResult(runtimeMessage.RunID, result)
@@ -383,11 +622,17 @@ func (c *client) handleWorkDoneMessage(runtimeMessage DecodedRuntimeMessage) {
 
 func (c *client) handleSignalMessage(runtimeMessage DecodedRuntimeMessage) {
 	var signalMessage SignalMessage
-	if err := cbor.Unmarshal(runtimeMessage.RawMessageData, &signalMessage); err != nil {
+	if err := c.messageDecMode.Unmarshal(runtimeMessage.RawMessageData, &signalMessage); err != nil {
 		c.logger.Errorf("ATP client for run ID '%s' failed to decode signal message: %v",
 			runtimeMessage.RunID, err)
 		return
 	}
+	c.metrics.AddCount(runtimeMessage.RunID, MetricSignalsReceived, 1)
+	c.publishEvent(ClientEvent{
+		Type:     ClientEventSignalReceived,
+		RunID:    runtimeMessage.RunID,
+		SignalID: signalMessage.SignalID,
+	})
 	c.mutex.Lock()
 	defer c.mutex.Unlock() // Hold lock until we send to the channel to prevent premature closing of the channel.
 	signalChannel, found := c.runningStepEmittedSignalChannels[runtimeMessage.RunID]
@@ -398,21 +643,42 @@ func (c *client) handleSignalMessage(runtimeMessage DecodedRuntimeMessage) {
 			runtimeMessage.RunID, signalMessage.SignalID)
 		return
 	}
-	c.logger.Debugf("Got signal from step with run ID '%s' with ID '%s'", runtimeMessage.RunID,
-		signalMessage.SignalID)
+	c.logger.Debugf("Got signal from step with run ID '%s' with ID '%s' (traceparent: '%s')", runtimeMessage.RunID,
+		signalMessage.SignalID, runtimeMessage.TraceParent)
 	signalChannel <- signalMessage.ToInput(runtimeMessage.RunID)
 }
 
+func (c *client) handleLogMessage(runtimeMessage DecodedRuntimeMessage) {
+	var logMessage LogMessage
+	if err := c.messageDecMode.Unmarshal(runtimeMessage.RawMessageData, &logMessage); err != nil {
+		c.logger.Errorf("ATP client for run ID '%s' failed to decode log message: %v",
+			runtimeMessage.RunID, err)
+		return
+	}
+	level := log.Level(logMessage.Level)
+	if err := level.Validate(); err != nil {
+		c.logger.Warningf("Step with run ID '%s' sent log message with %v, logging it as info.",
+			runtimeMessage.RunID, err)
+		level = log.LevelInfo
+	}
+	c.logger.WithLabel("run_id", runtimeMessage.RunID).Writef(level, "%s", logMessage.Message)
+}
+
 // Returns true if the error is fatal.
 func (c *client) handleErrorMessage(runtimeMessage DecodedRuntimeMessage) bool {
 	var errMessage ErrorMessage
-	if err := cbor.Unmarshal(runtimeMessage.RawMessageData, &errMessage); err != nil {
+	if err := c.messageDecMode.Unmarshal(runtimeMessage.RawMessageData, &errMessage); err != nil {
 		c.logger.Errorf("Step with run ID '%s' failed to decode error message: %v",
 			runtimeMessage.RunID, err)
 	}
-	errorMessageStr := errMessage.ToString(runtimeMessage.RunID)
-	resultMsg := fmt.Errorf("step with run ID %q sent error message: %s", runtimeMessage.RunID, errorMessageStr)
+	c.logDebugLogs(runtimeMessage.RunID, errMessage.DebugLogs)
+	remoteError := newRemoteError(runtimeMessage.RunID, errMessage)
+	resultMsg := fmt.Errorf("step with run ID %q sent error message: %w", runtimeMessage.RunID, remoteError)
 	c.logger.Errorf(resultMsg.Error())
+	c.publishEvent(ClientEvent{Type: ClientEventError, RunID: runtimeMessage.RunID, Err: remoteError})
+	if remoteError.StackTrace != "" {
+		c.logger.Debugf("Stack trace of run ID '%s':\n%s", runtimeMessage.RunID, remoteError.StackTrace)
+	}
 	if errMessage.ServerFatal {
 		c.sendErrorToAll(resultMsg)
 		return true // It's server fatal, so this is the last message from the server.
@@ -420,17 +686,31 @@ func (c *client) handleErrorMessage(runtimeMessage DecodedRuntimeMessage) bool {
 		if runtimeMessage.RunID == "" {
 			c.sendErrorToAll(fmt.Errorf("step fatal error missing run id (%w)", resultMsg))
 		} else {
+			result := NewErrorExecutionResult(resultMsg)
+			result.TraceContext = c.remoteTraceContext(runtimeMessage)
 			c.mutex.Lock()
-			c.sendExecutionResult(runtimeMessage.RunID, NewErrorExecutionResult(resultMsg))
+			c.sendExecutionResult(runtimeMessage.RunID, result)
 			c.mutex.Unlock()
 		}
 	}
 	return false
 }
 
-func (c *client) hasEntriesRemaining() bool {
+// stopReadLoopIfIdle stops the read loop if no run, run status request or signal reply waits for messages. The check
+// and the stop are atomic, so a run started in the meantime cannot be left without a read loop.
+func (c *client) stopReadLoopIfIdle() bool {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	if c.hasEntriesRemaining() || len(c.runStatusRequests) > 0 || len(c.signalReplyRequests) > 0 {
+		return false
+	}
+	c.readLoopRunning = false
+	return true
+}
+
+// hasEntriesRemaining returns true if a run waits for its result. The caller must have the mutex locked while calling
+// this function.
+func (c *client) hasEntriesRemaining() bool {
 	for _, resultEntry := range c.runningStepResultEntries {
 		// If any result is nil then we're not done.
 		// Context: There is a fraction of time when the entry is still in the map
@@ -443,16 +723,28 @@ func (c *client) hasEntriesRemaining() bool {
 }
 
 func (c *client) executeReadLoop(cborReader *cbor.Decoder) {
+	var readErr error
+	stopped := false
 	defer func() {
-		c.mutex.Lock()
-		defer c.mutex.Unlock()
-		c.readLoopRunning = false
+		if !stopped {
+			c.mutex.Lock()
+			c.readLoopRunning = false
+			if readErr == nil {
+				readErr = fmt.Errorf("the plugin reported a server fatal error")
+			}
+			c.failRequests(fmt.Errorf("the client stopped reading messages from the plugin (%w)", readErr))
+			// No results arrive for the abandoned runs anymore.
+			clear(c.abandonedRuns)
+			c.mutex.Unlock()
+		}
+		c.publishEvent(ClientEvent{Type: ClientEventReadLoopTerminated, Err: readErr})
 		c.wg.Done()
 	}()
 	// Loop and get all messages
 	// The message is generic, so we must find the type and decode the full message next.
 	var runtimeMessage DecodedRuntimeMessage
 	for {
+		bytesRead := cborReader.NumBytesRead()
 		if err := cborReader.Decode(&runtimeMessage); err != nil {
 			c.logger.Errorf(
 				"ATP client for steps '%s' failed to read or decode runtime message: %v",
@@ -460,14 +752,26 @@ func (c *client) executeReadLoop(cborReader *cbor.Decoder) {
 				err,
 			)
 			// This is fatal since the entire structure of the runtime message is invalid.
-			c.sendErrorToAll(fmt.Errorf("failed to read or decode runtime message (%w)", err))
+			readErr = fmt.Errorf("failed to read or decode runtime message (%w)", err)
+			c.sendErrorToAll(readErr)
 			return
 		}
+		if runtimeMessage.RunID != "" {
+			c.metrics.AddCount(runtimeMessage.RunID, MetricBytesIn, int64(cborReader.NumBytesRead()-bytesRead))
+		}
 		switch runtimeMessage.MessageID {
 		case MessageTypeWorkDone:
 			c.handleWorkDoneMessage(runtimeMessage)
 		case MessageTypeSignal:
 			c.handleSignalMessage(runtimeMessage)
+		case MessageTypeLog:
+			c.handleLogMessage(runtimeMessage)
+		case MessageTypeBlobChunk:
+			c.handleBlobChunkMessage(runtimeMessage)
+		case MessageTypeRunStatusResponse:
+			c.handleRunStatusResponseMessage(runtimeMessage)
+		case MessageTypeSignalReply:
+			c.handleSignalReplyMessage(runtimeMessage)
 		case MessageTypeError:
 			if c.handleErrorMessage(runtimeMessage) {
 				return // Fatal
@@ -480,7 +784,8 @@ func (c *client) executeReadLoop(cborReader *cbor.Decoder) {
 			)
 		}
 		// The non-error exit condition is having no more entries remaining.
-		if !c.hasEntriesRemaining() {
+		if c.stopReadLoopIfIdle() {
+			stopped = true
 			return
 		}
 	}
@@ -493,9 +798,9 @@ func (c *client) getResult(
 	cborReader *cbor.Decoder,
 ) ExecutionResult {
 	if c.atpVersion >= 2 {
-		return c.getResultV2(stepData)
+		return c.validateOutput(stepData, c.getResultV2(stepData))
 	} else {
-		return c.getResultV1(cborReader, stepData)
+		return c.validateOutput(stepData, c.getResultV1(cborReader, stepData))
 	}
 }
 
@@ -517,6 +822,7 @@ func (c *client) prepareResultChannels(
 	cborReader *cbor.Decoder,
 	stepData schema.Input,
 	emittedSignals chan<- schema.Input,
+	blobs chan<- *BlobReader,
 ) error {
 	c.logger.Debugf("Preparing result channels for step with run ID %q", stepData.RunID)
 	c.mutex.Lock()
@@ -534,7 +840,19 @@ func (c *client) prepareResultChannels(
 	if emittedSignals != nil {
 		c.runningStepEmittedSignalChannels[stepData.RunID] = emittedSignals
 	}
-	// Run the loop if it isn't running.
+	if blobs != nil {
+		c.runningStepBlobs[stepData.RunID] = &runBlobs{
+			channel: blobs,
+			readers: make(map[string]*BlobReader),
+		}
+	}
+	c.startReadLoop(cborReader)
+	return nil
+}
+
+// startReadLoop runs the read loop if it isn't running. The caller must have the mutex locked while calling this
+// function.
+func (c *client) startReadLoop(cborReader *cbor.Decoder) {
 	if !c.readLoopRunning {
 		// Only a single read loop should be running
 		c.wg.Add(1) // Add here, so that it's before the goroutine to prevent race conditions.
@@ -543,7 +861,6 @@ func (c *client) prepareResultChannels(
 			c.executeReadLoop(cborReader)
 		}()
 	}
-	return nil
 }
 
 // getResultV2 communicates with the RuntimeMessage loop to get the ExecutionResult.
@@ -577,14 +894,54 @@ func (c *client) processWorkDone(
 	doneMessage WorkDoneMessage,
 ) ExecutionResult {
 	c.logger.Debugf("Step with run ID '%s' completed with output ID '%s'.", runID, doneMessage.OutputID)
+	c.publishEvent(ClientEvent{Type: ClientEventWorkDone, RunID: runID, OutputID: doneMessage.OutputID})
+
+	c.logDebugLogs(runID, doneMessage.DebugLogs)
+
+	if doneMessage.ResourceUsage != nil {
+		c.logger.Debugf(
+			"Step with run ID '%s' used %s user and %s system CPU time, the plugin's peak RSS is %d bytes.",
+			runID,
+			doneMessage.ResourceUsage.UserCPUTime,
+			doneMessage.ResourceUsage.SystemCPUTime,
+			doneMessage.ResourceUsage.MaxRSS,
+		)
+	}
 
-	// Print debug logs from the step as debug.
-	debugLogs := strings.Split(doneMessage.DebugLogs, "\n")
-	for _, line := range debugLogs {
+	return ExecutionResult{doneMessage.OutputID, doneMessage.OutputData, nil, TraceContext{}, doneMessage.ResourceUsage}
+}
+
+// startSpan returns the trace context to send to the plugin as the parent of the run, and the function that ends the
+// client's span of the run. The trace context is empty if the run has none, or the plugin does not support it.
+func (c *client) startSpan(ctx context.Context, input schema.Input) (string, func(error)) {
+	if !slices.Contains(c.capabilities, FeatureTraceContext) {
+		return "", func(error) {}
+	}
+	parent, _ := GetTraceContext(ctx)
+	if c.tracer == nil {
+		return parent.String(), func(error) {}
+	}
+	span, endSpan := c.tracer.StartSpan(ctx, input.RunID, input.ID, parent)
+	return span.String(), endSpan
+}
+
+// remoteTraceContext returns the trace context of the plugin's span the runtime message carries, if any.
+func (c *client) remoteTraceContext(runtimeMessage DecodedRuntimeMessage) TraceContext {
+	if runtimeMessage.TraceParent == "" {
+		return TraceContext{}
+	}
+	traceContext, err := ParseTraceParent(runtimeMessage.TraceParent)
+	if err != nil {
+		c.logger.Warningf("Step with run ID '%s' sent an invalid trace context (%v)", runtimeMessage.RunID, err)
+	}
+	return traceContext
+}
+
+// logDebugLogs prints the debug logs sent by the step as debug.
+func (c *client) logDebugLogs(runID string, debugLogs string) {
+	for _, line := range strings.Split(debugLogs, "\n") {
 		if strings.TrimSpace(line) != "" {
 			c.logger.Debugf("Step '%s' debug: %s", runID, line)
 		}
 	}
-
-	return ExecutionResult{doneMessage.OutputID, doneMessage.OutputData, nil}
 }
@@ -0,0 +1,115 @@
+package atp
+
+import (
+	"context"
+	"fmt"
+	"go.arcalot.io/log/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDebugLogLimit is the default maximum size of the debug logs kept for a single run, in bytes.
+const DefaultDebugLogLimit = 1024 * 1024
+
+type loggerContextKey struct{}
+
+// GetLogger returns the logger for the step run the context belongs to. The ATP server streams the messages written
+// to it to the client as log messages while the step is running. With clients that don't support log messages, the
+// server buffers them and sends them in the debug logs of the work done or error message of the run instead. If the
+// context was not passed to a step handler by the ATP server, a logger that discards all messages is returned.
+func GetLogger(ctx context.Context) log.Logger {
+	logger, ok := ctx.Value(loggerContextKey{}).(log.Logger)
+	if !ok {
+		return log.NewLogger(log.LevelDebug, log.NewNOOPLogger())
+	}
+	return logger
+}
+
+func withLogger(ctx context.Context, logger log.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// debugLogBuffer is a log.Writer that records the log messages of a single run up to a size limit.
+type debugLogBuffer struct {
+	lock         sync.Mutex
+	limit        int
+	buffer       strings.Builder
+	droppedBytes int
+}
+
+func newDebugLogBuffer(limit int) *debugLogBuffer {
+	return &debugLogBuffer{
+		limit: limit,
+	}
+}
+
+func (b *debugLogBuffer) Write(message log.Message) error {
+	line := fmt.Sprintf(
+		"%s\t%s\t%s\n",
+		message.Timestamp.Format(time.RFC3339Nano),
+		message.Level,
+		message.Message,
+	)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	// Once a message was dropped, drop all following ones too, so the logs don't have gaps in the middle.
+	if b.droppedBytes > 0 || b.buffer.Len()+len(line) > b.limit {
+		b.droppedBytes += len(line)
+		return nil
+	}
+	b.buffer.WriteString(line)
+	return nil
+}
+
+func (b *debugLogBuffer) Rotate() {
+}
+
+func (b *debugLogBuffer) Close() error {
+	return nil
+}
+
+// String returns the recorded logs, with a note at the end if any messages were dropped.
+func (b *debugLogBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.droppedBytes == 0 {
+		return b.buffer.String()
+	}
+	return b.buffer.String() + fmt.Sprintf(
+		"%d bytes of debug logs were dropped after reaching the limit of %d bytes\n",
+		b.droppedBytes,
+		b.limit,
+	)
+}
+
+// liveLogWriter is a log.Writer that sends the log messages of a single run to the client as they are written.
+// Messages that fail to send are kept in the fallback buffer, so they still reach the client with the debug logs.
+type liveLogWriter struct {
+	session  *atpServerSession
+	runID    string
+	fallback *debugLogBuffer
+}
+
+func (w *liveLogWriter) Write(message log.Message) error {
+	err := w.session.sendRuntimeMessage(
+		MessageTypeLog,
+		w.runID,
+		LogMessage{
+			Level:     string(message.Level),
+			Timestamp: message.Timestamp.UnixNano(),
+			Message:   message.Message,
+		},
+	)
+	if err != nil {
+		return w.fallback.Write(message)
+	}
+	return nil
+}
+
+func (w *liveLogWriter) Rotate() {
+}
+
+func (w *liveLogWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,143 @@
+package atp
+
+import (
+	"errors"
+	"go.flow.arcalot.io/pluginsdk/schema"
+)
+
+// ErrorKind classifies the error of an error message. It is only sent with FeatureStructuredErrors.
+type ErrorKind string
+
+// The kinds of errors an error message can carry.
+const (
+	// ErrorKindUnknown is the kind of error messages sent without FeatureStructuredErrors.
+	ErrorKindUnknown ErrorKind = ""
+	// ErrorKindInvalidInput means the step or signal input did not match its schema.
+	ErrorKindInvalidInput ErrorKind = "invalid_input"
+	// ErrorKindInvalidOutput means the step returned an output that did not match its schema.
+	ErrorKindInvalidOutput ErrorKind = "invalid_output"
+	// ErrorKindBadArgument means the client asked for a step or signal the plugin does not have.
+	ErrorKindBadArgument ErrorKind = "bad_argument"
+	// ErrorKindStepCancelled means the step did not finish within the grace period after it was cancelled.
+	ErrorKindStepCancelled ErrorKind = "step_cancelled"
+	// ErrorKindPanic means the step panicked. The error message holds the stack trace of the panic.
+	ErrorKindPanic ErrorKind = "panic"
+	// ErrorKindProtocol means the server received a message it could not decode or handle.
+	ErrorKindProtocol ErrorKind = "protocol"
+	// ErrorKindRunAborted means the server was stopped and aborted the run, see ErrRunAborted.
+	ErrorKindRunAborted ErrorKind = "run_aborted"
+	// ErrorKindServerShuttingDown means the server was stopped before the run started, see ErrServerShuttingDown.
+	ErrorKindServerShuttingDown ErrorKind = "server_shutting_down"
+	// ErrorKindOther is the kind of all other errors, such as errors returned by the step.
+	ErrorKindOther ErrorKind = "other"
+)
+
+// errorKindOf classifies the error by the error types it wraps.
+func errorKindOf(err error) ErrorKind {
+	var invalidInputError schema.InvalidInputError
+	var invalidOutputError schema.InvalidOutputError
+	var badArgumentError schema.BadArgumentError
+	var stepCancelledError schema.StepCancelledError
+	switch {
+	case errors.Is(err, ErrRunAborted):
+		return ErrorKindRunAborted
+	case errors.Is(err, ErrServerShuttingDown):
+		return ErrorKindServerShuttingDown
+	case errors.As(err, &invalidInputError):
+		return ErrorKindInvalidInput
+	case errors.As(err, &invalidOutputError):
+		return ErrorKindInvalidOutput
+	case errors.As(err, &badArgumentError):
+		return ErrorKindBadArgument
+	case errors.As(err, &stepCancelledError):
+		return ErrorKindStepCancelled
+	default:
+		return ErrorKindOther
+	}
+}
+
+// addDetails fills the structured fields of the error message from the error the server reports.
+func (e *ErrorMessage) addDetails(serverError ServerError) {
+	e.Kind = serverError.kind
+	if e.Kind == ErrorKindUnknown {
+		e.Kind = errorKindOf(serverError.Err)
+	}
+	var constraintError *schema.ConstraintError
+	if errors.As(serverError.Err, &constraintError) {
+		e.ConstraintPath = constraintError.Path
+		e.ConstraintMessage = constraintError.Message
+	}
+	e.StackTrace = serverError.stackTrace
+	for cause := errors.Unwrap(serverError.Err); cause != nil; cause = errors.Unwrap(cause) {
+		e.Causes = append(e.Causes, cause.Error())
+	}
+}
+
+// RemoteError is an error the plugin reported with an error message. If the plugin supports
+// FeatureStructuredErrors, it unwraps to an error matching its kind, so the error can be inspected with errors.As and
+// errors.Is. Invalid inputs and outputs unwrap to schema.InvalidInputError and schema.InvalidOutputError, which in turn
+// unwrap to a *schema.ConstraintError if the plugin reported the constraint that was violated. Bad arguments unwrap to
+// schema.BadArgumentError, cancelled steps to schema.StepCancelledError without the grace period, and runs the server
+// aborted or did not start to ErrRunAborted and ErrServerShuttingDown.
+type RemoteError struct {
+	RunID       string
+	Message     string
+	StepFatal   bool
+	ServerFatal bool
+	Kind        ErrorKind
+	// StackTrace is the stack trace of the panic if the step panicked.
+	StackTrace string
+	// Causes holds the messages of the errors the reported error wraps, outermost first.
+	Causes []string
+	cause  error
+}
+
+// newRemoteError reconstructs the error the plugin reported in the error message.
+func newRemoteError(runID string, message ErrorMessage) *RemoteError {
+	var detail error
+	if len(message.ConstraintPath) > 0 || message.ConstraintMessage != "" {
+		detail = &schema.ConstraintError{
+			Message: message.ConstraintMessage,
+			Path:    message.ConstraintPath,
+		}
+	} else if len(message.Causes) > 0 {
+		detail = errors.New(message.Causes[len(message.Causes)-1])
+	} else {
+		detail = errors.New(message.Error)
+	}
+	var cause error
+	switch message.Kind {
+	case ErrorKindInvalidInput:
+		cause = schema.InvalidInputError{Cause: detail}
+	case ErrorKindInvalidOutput:
+		cause = schema.InvalidOutputError{Cause: detail}
+	case ErrorKindBadArgument:
+		cause = schema.BadArgumentError{Message: detail.Error()}
+	case ErrorKindStepCancelled:
+		cause = schema.StepCancelledError{RunID: runID}
+	case ErrorKindRunAborted:
+		cause = ErrRunAborted
+	case ErrorKindServerShuttingDown:
+		cause = ErrServerShuttingDown
+	}
+	return &RemoteError{
+		RunID:       runID,
+		Message:     message.Error,
+		StepFatal:   message.StepFatal,
+		ServerFatal: message.ServerFatal,
+		Kind:        message.Kind,
+		StackTrace:  message.StackTrace,
+		Causes:      message.Causes,
+		cause:       cause,
+	}
+}
+
+// Error returns the error message in the format of ErrorMessage.ToString.
+func (e *RemoteError) Error() string {
+	return ErrorMessage{Error: e.Message, StepFatal: e.StepFatal, ServerFatal: e.ServerFatal}.ToString(e.RunID)
+}
+
+// Unwrap returns the error matching the kind of the remote error, if any.
+func (e *RemoteError) Unwrap() error {
+	return e.cause
+}
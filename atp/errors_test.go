@@ -0,0 +1,81 @@
+package atp_test
+
+import (
+	"errors"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"strings"
+	"testing"
+)
+
+// executeWithError runs the step on the plugin with the given input, and returns the error of the run.
+func executeWithError(
+	t *testing.T,
+	pluginSchema *schema.CallableSchema,
+	features []string,
+	stepID string,
+	input any,
+) error {
+	cli := atp.NewInProcessClientWithOptions(
+		pluginSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t), Features: features},
+		atp.ServerOptions{},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(
+		schema.Input{
+			RunID:     t.Name(),
+			ID:        stepID,
+			InputData: input,
+		}, nil, nil)
+	assert.Error(t, result.Error)
+	// The server reports the error to the in-process client on close too.
+	assert.Error(t, cli.Close())
+	return result.Error
+}
+
+func TestStructuredErrors_InvalidInput(t *testing.T) {
+	err := executeWithError(t, helloWorldSchema, nil, "hello-world", map[string]any{})
+	var remoteError *atp.RemoteError
+	assert.Equals(t, errors.As(err, &remoteError), true)
+	assert.Equals(t, remoteError.Kind, atp.ErrorKindInvalidInput)
+	assert.Equals(t, remoteError.StepFatal, true)
+	assert.Equals(t, len(remoteError.Causes) > 0, true)
+	var invalidInputError schema.InvalidInputError
+	assert.Equals(t, errors.As(err, &invalidInputError), true)
+	var constraintError *schema.ConstraintError
+	assert.Equals(t, errors.As(err, &constraintError), true)
+	assert.Equals(t, constraintError.Path, []string{"name"})
+	assert.Equals(t, constraintError.Message != "", true)
+}
+
+func TestStructuredErrors_UnknownStep(t *testing.T) {
+	err := executeWithError(t, helloWorldSchema, nil, "goodbye-world", map[string]any{"name": "Arca Lot"})
+	var badArgumentError schema.BadArgumentError
+	assert.Equals(t, errors.As(err, &badArgumentError), true)
+	assert.Contains(t, badArgumentError.Error(), "goodbye-world")
+}
+
+func TestStructuredErrors_Panic(t *testing.T) {
+	err := executeWithError(t, panickingHelloWorldSchema, nil, "hello-world", map[string]any{"name": "Arca Lot"})
+	var remoteError *atp.RemoteError
+	assert.Equals(t, errors.As(err, &remoteError), true)
+	assert.Equals(t, remoteError.Kind, atp.ErrorKindPanic)
+	if !strings.Contains(remoteError.StackTrace, "panickingHelloWorldStepHandler") {
+		t.Fatalf("stack trace does not contain the panicking function:\n%s", remoteError.StackTrace)
+	}
+}
+
+func TestStructuredErrors_Disabled(t *testing.T) {
+	// Without the feature, the error is only known by its message.
+	err := executeWithError(t, helloWorldSchema, []string{}, "hello-world", map[string]any{})
+	var remoteError *atp.RemoteError
+	assert.Equals(t, errors.As(err, &remoteError), true)
+	assert.Equals(t, remoteError.Kind, atp.ErrorKindUnknown)
+	assert.Contains(t, remoteError.Error(), "Invalid step input")
+	var invalidInputError schema.InvalidInputError
+	assert.Equals(t, errors.As(err, &invalidInputError), false)
+}
@@ -0,0 +1,152 @@
+package atp
+
+import (
+	"sync"
+	"time"
+)
+
+// ClientEventType identifies a protocol lifecycle event of an ATP client.
+type ClientEventType string
+
+// The lifecycle events of an ATP client.
+const (
+	// ClientEventHelloReceived is sent when the client received the hello message of the plugin.
+	ClientEventHelloReceived ClientEventType = "hello_received"
+	// ClientEventRunStarted is sent right before the client sends the work start message of a run, so it precedes
+	// all other events of the run. If sending the message fails, a ClientEventError event of the run follows.
+	ClientEventRunStarted ClientEventType = "run_started"
+	// ClientEventSignalSent is sent when the client sent a signal to a run.
+	ClientEventSignalSent ClientEventType = "signal_sent"
+	// ClientEventSignalReceived is sent when the client received a signal a run emitted.
+	ClientEventSignalReceived ClientEventType = "signal_received"
+	// ClientEventError is sent when the client received an error message, or failed to send the work start message
+	// of a run. The run ID is empty for errors that are not specific to a run.
+	ClientEventError ClientEventType = "error"
+	// ClientEventWorkDone is sent when the client received the work done message of a run.
+	ClientEventWorkDone ClientEventType = "work_done"
+	// ClientEventReadLoopTerminated is sent when the client stopped reading messages from the plugin, either because
+	// no runs are left or because of an error.
+	ClientEventReadLoopTerminated ClientEventType = "read_loop_terminated"
+	// ClientEventClientDoneSent is sent when the client sent the client done message, ending the session.
+	ClientEventClientDoneSent ClientEventType = "client_done_sent"
+)
+
+// ClientEvent is a protocol lifecycle event of an ATP client.
+type ClientEvent struct {
+	// Type is the type of the event.
+	Type ClientEventType
+	// RunID is the ID of the run the event belongs to. It is empty for events of the session.
+	RunID string
+	// Time is the time the event happened at.
+	Time time.Time
+	// StepID is the ID of the step of ClientEventRunStarted events.
+	StepID string
+	// SignalID is the ID of the signal of ClientEventSignalSent and ClientEventSignalReceived events.
+	SignalID string
+	// OutputID is the ID of the output of ClientEventWorkDone events.
+	OutputID string
+	// Err is the error of ClientEventError events, and of ClientEventReadLoopTerminated events if the client stopped
+	// reading because of an error.
+	Err error
+}
+
+// droppedEventsWarningInterval is the minimum time between two warnings about dropped events, so a slow subscriber
+// does not flood the log.
+const droppedEventsWarningInterval = 10 * time.Second
+
+// EventSubscriber is implemented by the clients that publish their protocol lifecycle events. All clients created by
+// this package implement it:
+//
+//	events, unsubscribe := client.(atp.EventSubscriber).Subscribe(16)
+type EventSubscriber interface {
+	// Subscribe returns a channel of the client's protocol lifecycle events, and a function that ends the
+	// subscription and closes the channel. The channel is also closed when the client is closed. Events are never
+	// waited for: those that do not fit in a buffer of the given size are dropped, so the channel should be read
+	// promptly.
+	Subscribe(bufferSize int) (<-chan ClientEvent, func())
+}
+
+// clientEvents distributes the lifecycle events of a client to its subscribers.
+type clientEvents struct {
+	lock        sync.Mutex
+	subscribers map[chan ClientEvent]struct{}
+	closed      bool
+	dropped     int       // The events dropped since the last warning.
+	lastWarning time.Time // The time of the last warning about dropped events.
+}
+
+func newClientEvents() *clientEvents {
+	return &clientEvents{
+		subscribers: map[chan ClientEvent]struct{}{},
+	}
+}
+
+// subscribe adds a subscriber with the given buffer size, and returns its channel and the function that removes it.
+// The channel is closed when the subscriber is removed or the events are closed.
+func (e *clientEvents) subscribe(bufferSize int) (<-chan ClientEvent, func()) {
+	subscriber := make(chan ClientEvent, max(bufferSize, 0))
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.closed {
+		close(subscriber)
+		return subscriber, func() {}
+	}
+	e.subscribers[subscriber] = struct{}{}
+	return subscriber, func() {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		if _, found := e.subscribers[subscriber]; found {
+			delete(e.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// publish sends the event to all subscribers. It never blocks, so events that do not fit in the buffer of a
+// subscriber are dropped. It returns the number of events dropped since the last warning if a warning about them is
+// due, which is at most once per droppedEventsWarningInterval, and zero otherwise.
+func (e *clientEvents) publish(event ClientEvent) int {
+	event.Time = time.Now()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for subscriber := range e.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			e.dropped++
+		}
+	}
+	if e.dropped == 0 || event.Time.Sub(e.lastWarning) < droppedEventsWarningInterval {
+		return 0
+	}
+	dropped := e.dropped
+	e.dropped = 0
+	e.lastWarning = event.Time
+	return dropped
+}
+
+// close closes the channels of all subscribers. Later subscribers get a closed channel.
+func (e *clientEvents) close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	for subscriber := range e.subscribers {
+		close(subscriber)
+	}
+	e.subscribers = nil
+}
+
+func (c *client) Subscribe(bufferSize int) (<-chan ClientEvent, func()) {
+	return c.events.subscribe(bufferSize)
+}
+
+// publishEvent sends the event to the subscribers of the client's lifecycle events.
+func (c *client) publishEvent(event ClientEvent) {
+	if dropped := c.events.publish(event); dropped > 0 {
+		c.logger.Warningf("Dropped %d lifecycle events for subscribers with full buffers since the last warning.",
+			dropped)
+	}
+}
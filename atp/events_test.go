@@ -0,0 +1,231 @@
+package atp_test
+
+import (
+	"context"
+	"github.com/fxamacker/cbor/v2"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// collectEvents reads the events until the channel is closed, and checks that they have increasing timestamps.
+func collectEvents(t *testing.T, events <-chan atp.ClientEvent) []atp.ClientEvent {
+	var result []atp.ClientEvent
+	for event := range events {
+		if len(result) > 0 && event.Time.Before(result[len(result)-1].Time) {
+			t.Errorf("event %s is older than the event before it", event.Type)
+		}
+		result = append(result, event)
+	}
+	return result
+}
+
+// eventTypes returns the types of the events.
+func eventTypes(events []atp.ClientEvent) []atp.ClientEventType {
+	result := make([]atp.ClientEventType, len(events))
+	for i, event := range events {
+		result[i] = event.Type
+	}
+	return result
+}
+
+func TestClientEvents(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	cli := atp.NewInProcessClientWithOptions(
+		newCancellableSchema(release),
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{},
+	)
+	events, _ := cli.(atp.EventSubscriber).Subscribe(16)
+	started := time.Now()
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+	// The step waits for the cancel signal.
+	handle.Cancel()
+	assert.NoError(t, handle.Wait().Error)
+	assert.NoError(t, cli.Close())
+
+	// Closing the client closes the channel.
+	received := collectEvents(t, events)
+	assert.Equals(t, eventTypes(received), []atp.ClientEventType{
+		atp.ClientEventHelloReceived,
+		atp.ClientEventRunStarted,
+		atp.ClientEventSignalSent,
+		atp.ClientEventWorkDone,
+		atp.ClientEventReadLoopTerminated,
+		atp.ClientEventClientDoneSent,
+	})
+	assert.Equals(t, received[0].Time.Before(started), false)
+	assert.Equals(t, received[0].RunID, "")
+	assert.Equals(t, received[1].RunID, t.Name())
+	assert.Equals(t, received[1].StepID, "hello-world")
+	assert.Equals(t, received[2].RunID, t.Name())
+	assert.Equals(t, received[2].SignalID, atp.CancelSignalID)
+	assert.Equals(t, received[3].RunID, t.Name())
+	assert.Equals(t, received[3].OutputID, "success")
+	assert.NoError(t, received[4].Err)
+
+	// Subscribing to a closed client returns a closed channel.
+	events, _ = cli.(atp.EventSubscriber).Subscribe(16)
+	assert.Equals(t, len(collectEvents(t, events)), 0)
+}
+
+func TestClientEvents_SignalReceived(t *testing.T) {
+	cli := atp.NewInProcessClientWithOptions(
+		signalEmittingSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	// Subscribers only get the events after they subscribed.
+	events, _ := cli.(atp.EventSubscriber).Subscribe(16)
+	result := cli.Execute(schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	}, nil, make(chan schema.Input, 1))
+	assert.NoError(t, result.Error)
+	assert.NoError(t, cli.Close())
+
+	received := collectEvents(t, events)
+	assert.Equals(t, eventTypes(received), []atp.ClientEventType{
+		atp.ClientEventRunStarted,
+		atp.ClientEventSignalReceived,
+		atp.ClientEventWorkDone,
+		atp.ClientEventReadLoopTerminated,
+		atp.ClientEventClientDoneSent,
+	})
+	assert.Equals(t, received[1].RunID, t.Name())
+	assert.Equals(t, received[1].SignalID, "progress")
+}
+
+func TestClientEvents_Error(t *testing.T) {
+	cli := atp.NewInProcessClientWithOptions(
+		panickingHelloWorldSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	events, _ := cli.(atp.EventSubscriber).Subscribe(16)
+	result := cli.Execute(schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	}, nil, nil)
+	assert.Error(t, result.Error)
+	assert.Error(t, cli.Close())
+
+	// The channel is closed even if closing the client fails.
+	received := collectEvents(t, events)
+	assert.Equals(t, received[0].Type, atp.ClientEventRunStarted)
+	assert.Equals(t, received[1].Type, atp.ClientEventError)
+	assert.Equals(t, received[1].RunID, t.Name())
+	assert.Error(t, received[1].Err)
+}
+
+func TestClientEvents_Unsubscribe(t *testing.T) {
+	cli := atp.NewInProcessClientWithOptions(
+		helloWorldSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{},
+	)
+	unsubscribed, unsubscribe := cli.(atp.EventSubscriber).Subscribe(16)
+	unsubscribe()
+	// Unsubscribing again does nothing.
+	unsubscribe()
+	// Events that do not fit in the buffer are dropped instead of blocking the client.
+	full, _ := cli.(atp.EventSubscriber).Subscribe(1)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.NoError(t, cli.Close())
+
+	assert.Equals(t, len(collectEvents(t, unsubscribed)), 0)
+	assert.Equals(t, eventTypes(collectEvents(t, full)), []atp.ClientEventType{atp.ClientEventHelloReceived})
+}
+
+func TestClientEvents_DroppedWarning(t *testing.T) {
+	logBuffer := &lockedBufferWriter{BufferWriter: log.NewBufferWriter()}
+	cli := atp.NewInProcessClientWithOptions(
+		helloWorldSchema,
+		atp.ClientOptions{Logger: log.NewLogger(log.LevelDebug, logBuffer)},
+		atp.ServerOptions{},
+	)
+	// Every event after the first one is dropped, but only the first drop is warned about right away.
+	full, _ := cli.(atp.EventSubscriber).Subscribe(1)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.NoError(t, cli.Close())
+	assert.Equals(t, len(collectEvents(t, full)), 1)
+	assert.Equals(t, strings.Count(logBuffer.String(), "lifecycle events for subscribers with full buffers"), 1)
+}
+
+func TestClientEvents_RunStartFailed(t *testing.T) {
+	serializedSchema, err := helloWorldSchema.SelfSerialize()
+	assert.NoError(t, err)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	go func() {
+		// The plugin stops reading and writing after the handshake.
+		var startMessage atp.StartMessage
+		_ = cbor.NewDecoder(stdinReader).Decode(&startMessage)
+		_ = cbor.NewEncoder(stdoutWriter).Encode(atp.HelloMessage{
+			Version:      atp.ProtocolVersion,
+			Schema:       serializedSchema,
+			Capabilities: nil,
+		})
+		_ = stdinReader.Close()
+		_ = stdoutWriter.Close()
+	}()
+	cli := atp.NewClientWithLogger(channel{
+		Reader:  stdoutReader,
+		Writer:  stdinWriter,
+		Context: nil,
+		cancel:  func() {},
+	}, log.NewTestLogger(t))
+	events, _ := cli.(atp.EventSubscriber).Subscribe(16)
+	_, err = cli.ReadSchema()
+	assert.NoError(t, err)
+	_, err = cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.Error(t, err)
+	assert.Error(t, cli.Close())
+
+	// The run started event is followed by an error event of the run, since the work start message was not sent.
+	var runEvents []atp.ClientEvent
+	for _, event := range collectEvents(t, events) {
+		if event.RunID == t.Name() {
+			runEvents = append(runEvents, event)
+		}
+	}
+	assert.Equals(t, eventTypes(runEvents), []atp.ClientEventType{atp.ClientEventRunStarted, atp.ClientEventError})
+	assert.Contains(t, runEvents[1].Err.Error(), "failed to write work start message")
+}
@@ -0,0 +1,87 @@
+package atp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"io"
+	"sync"
+)
+
+// NewInProcessClient creates a client for a plugin running in the same process. The ATP server runs in a goroutine,
+// connected to the client with in-memory pipes. Close ends the session, waits for the server to stop, and returns the
+// errors the server reported.
+func NewInProcessClient(callableSchema *schema.CallableSchema) Client {
+	return NewInProcessClientWithOptions(callableSchema, ClientOptions{}, ServerOptions{})
+}
+
+// NewInProcessClientWithOptions creates a client for a plugin running in the same process with the given client and
+// server settings.
+func NewInProcessClientWithOptions(
+	callableSchema *schema.CallableSchema,
+	clientOptions ClientOptions,
+	serverOptions ServerOptions,
+) Client {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	serverDone := make(chan []*ServerError, 1)
+	go func() {
+		serverErrors := RunATPServerWithOptions(ctx, stdinReader, stdoutWriter, callableSchema, serverOptions)
+		_ = stdoutWriter.Close()
+		serverDone <- serverErrors
+	}()
+	channel := &inProcessChannel{stdoutReader, stdinWriter}
+	return &inProcessClient{
+		client:     NewClientWithOptions(channel, clientOptions).(*client),
+		channel:    channel,
+		cancel:     cancel,
+		serverDone: serverDone,
+	}
+}
+
+type inProcessChannel struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+// Close closes both directions, so neither the client nor the server can be left blocked on the other.
+func (c *inProcessChannel) Close() error {
+	return errors.Join(c.PipeWriter.Close(), c.PipeReader.Close())
+}
+
+type inProcessClient struct {
+	*client
+	channel    *inProcessChannel
+	cancel     context.CancelFunc
+	serverDone chan []*ServerError
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+func (c *inProcessClient) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.close()
+	})
+	return c.closeErr
+}
+
+func (c *inProcessClient) close() error {
+	clientErr := c.client.Close()
+	// The server only ends the session by itself after the client done message, which the client does not send if
+	// the session was never started.
+	started := c.client.atpVersion >= 0
+	_ = c.channel.Close()
+	c.cancel()
+	serverErrors := <-c.serverDone
+	if !started {
+		// The server reports the missing start message, which is expected here.
+		return clientErr
+	}
+	errs := []error{clientErr}
+	for _, serverError := range serverErrors {
+		errs = append(errs, fmt.Errorf("in-process plugin error for run '%s' (%w)", serverError.RunID, serverError.Err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,45 @@
+package atp_test
+
+import (
+	"go.arcalot.io/assert"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"testing"
+)
+
+func TestInProcessClient(t *testing.T) {
+	cli := atp.NewInProcessClient(helloWorldSchema)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(
+		schema.Input{
+			RunID:     t.Name(),
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.Equals(t, result.OutputData.(map[any]any)["message"].(string), "Hello, Arca Lot!")
+	assert.NoError(t, cli.Close())
+	assert.NoError(t, cli.Close())
+}
+
+func TestInProcessClient_ServerErrors(t *testing.T) {
+	cli := atp.NewInProcessClient(panickingHelloWorldSchema)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(
+		schema.Input{
+			RunID:     t.Name(),
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		}, nil, nil)
+	assert.Error(t, result.Error)
+	err = cli.Close()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "panic while running step")
+}
+
+func TestInProcessClient_CloseUnstarted(t *testing.T) {
+	cli := atp.NewInProcessClient(helloWorldSchema)
+	assert.NoError(t, cli.Close())
+}
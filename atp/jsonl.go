@@ -0,0 +1,246 @@
+package atp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// Format is the encoding of the messages of an ATP session.
+type Format string
+
+// The supported message formats.
+const (
+	// FormatCBOR encodes the messages as a sequence of CBOR data items. It is the default format.
+	FormatCBOR Format = "cbor"
+	// FormatJSONLines encodes every message as a JSON object on its own line, with the field names of the CBOR
+	// encoding, for debugging. Byte strings, which only blob chunk messages carry, are base64 encoded, and map keys
+	// that are not strings are sent as strings. Both sides must use the same format.
+	FormatJSONLines Format = "jsonl"
+)
+
+// ParseFormat parses the name of a message format. An empty name is the CBOR format.
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case "", FormatCBOR:
+		return FormatCBOR, nil
+	case FormatJSONLines:
+		return FormatJSONLines, nil
+	default:
+		return "", fmt.Errorf("unsupported ATP message format '%s', expected '%s' or '%s'",
+			name, FormatCBOR, FormatJSONLines)
+	}
+}
+
+// jsonLinesReader converts the JSON lines read from the underlying reader to CBOR data items.
+type jsonLinesReader struct {
+	reader      *bufio.Reader
+	maxLineSize int64
+	pending     []byte // The CBOR encoding of the last line that was not read yet.
+}
+
+func newJSONLinesReader(reader io.Reader, maxLineSize int64) *jsonLinesReader {
+	return &jsonLinesReader{
+		reader:      bufio.NewReader(reader),
+		maxLineSize: maxLineSize,
+	}
+}
+
+func (r *jsonLinesReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		line, err := r.readLine()
+		if len(bytes.TrimSpace(line)) > 0 {
+			if r.pending, err = jsonLineToCBOR(line); err != nil {
+				return 0, err
+			}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// readLine reads the next line, which may be incomplete at the end of the input. Lines longer than the maximum line
+// size are rejected without reading them completely.
+func (r *jsonLinesReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		fragment, err := r.reader.ReadSlice('\n')
+		line = append(line, fragment...)
+		if int64(len(line)) > r.maxLineSize {
+			return nil, fmt.Errorf("%w: the JSON line exceeds the maximum size of %d bytes", ErrMessageTooLarge,
+				r.maxLineSize)
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+// jsonLineToCBOR converts a JSON line to the CBOR encoding of the same message.
+func jsonLineToCBOR(line []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	var message any
+	if err := decoder.Decode(&message); err != nil {
+		return nil, fmt.Errorf("invalid JSON line %q (%w)", bytes.TrimSpace(line), err)
+	}
+	message, err := fromJSONValue(message)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON line %q (%w)", bytes.TrimSpace(line), err)
+	}
+	if err := decodeBlobChunkData(message); err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(message)
+}
+
+// fromJSONValue converts the numbers of a decoded JSON value to integers where possible, as CBOR distinguishes them
+// from floats.
+func fromJSONValue(value any) (any, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u, nil
+		}
+		return v.Float64()
+	case map[string]any:
+		for key, item := range v {
+			converted, err := fromJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+		return v, nil
+	case []any:
+		for i, item := range v {
+			converted, err := fromJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
+
+// decodeBlobChunkData decodes the base64 encoded data of a blob chunk message to a byte string.
+func decodeBlobChunkData(message any) error {
+	runtimeMessage, ok := message.(map[string]any)
+	if !ok || runtimeMessage["id"] != int64(MessageTypeBlobChunk) {
+		return nil
+	}
+	chunk, ok := runtimeMessage["data"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	encoded, ok := chunk["data"].(string)
+	if !ok {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid base64 data in blob chunk message (%w)", err)
+	}
+	chunk["data"] = data
+	return nil
+}
+
+// jsonLinesWriter converts the CBOR data items written to it to JSON lines written to the underlying writer.
+type jsonLinesWriter struct {
+	writer io.Writer
+	lock   sync.Mutex
+	buffer []byte // CBOR data that is not a complete data item yet.
+}
+
+func (w *jsonLinesWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buffer = append(w.buffer, p...)
+	for len(w.buffer) > 0 {
+		var message any
+		rest, err := cbor.UnmarshalFirst(w.buffer, &message)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// Wait for the rest of the data item.
+			return len(p), nil
+		} else if err != nil {
+			w.buffer = nil
+			return 0, fmt.Errorf("failed to convert message to JSON (%w)", err)
+		}
+		w.buffer = rest
+		line, err := json.Marshal(toJSONValue(message))
+		if err != nil {
+			return 0, fmt.Errorf("failed to convert message to JSON (%w)", err)
+		}
+		if _, err := w.writer.Write(append(line, '\n')); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// toJSONValue converts the maps of a decoded CBOR value to maps with string keys, which JSON requires.
+func toJSONValue(value any) any {
+	switch v := value.(type) {
+	case map[any]any:
+		result := make(map[string]any, len(v))
+		for key, item := range v {
+			stringKey, ok := key.(string)
+			if !ok {
+				stringKey = fmt.Sprint(key)
+			}
+			result[stringKey] = toJSONValue(item)
+		}
+		return result
+	case []any:
+		result := make([]any, len(v))
+		for i, item := range v {
+			result[i] = toJSONValue(item)
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+// jsonLinesChannel is a client channel that exchanges JSON lines with the plugin.
+type jsonLinesChannel struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+func newJSONLinesChannel(channel ClientChannel, maxLineSize int64) ClientChannel {
+	return jsonLinesChannel{
+		Reader: newJSONLinesReader(channel, maxLineSize),
+		Writer: &jsonLinesWriter{writer: channel},
+		Closer: channel,
+	}
+}
+
+// jsonLinesReadCloser reads the JSON lines of the client as CBOR.
+type jsonLinesReadCloser struct {
+	*jsonLinesReader
+	io.Closer
+}
+
+// jsonLinesWriteCloser writes CBOR to the client as JSON lines.
+type jsonLinesWriteCloser struct {
+	*jsonLinesWriter
+	io.Closer
+}
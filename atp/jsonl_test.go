@@ -0,0 +1,163 @@
+package atp_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestParseFormat(t *testing.T) {
+	format, err := atp.ParseFormat("")
+	assert.NoError(t, err)
+	assert.Equals(t, format, atp.FormatCBOR)
+	format, err = atp.ParseFormat("jsonl")
+	assert.NoError(t, err)
+	assert.Equals(t, format, atp.FormatJSONLines)
+	_, err = atp.ParseFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestJSONLines_Server(t *testing.T) {
+	// The server can be driven by hand with JSON lines.
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	serverDone := make(chan []*atp.ServerError, 1)
+	go func() {
+		serverDone <- atp.RunATPServerWithOptions(
+			context.Background(),
+			stdinReader,
+			stdoutWriter,
+			helloWorldSchema,
+			atp.ServerOptions{Format: atp.FormatJSONLines},
+		)
+		_ = stdoutWriter.Close()
+	}()
+	output := bufio.NewScanner(stdoutReader)
+	output.Buffer(nil, 1024*1024)
+	readLine := func() map[string]any {
+		assert.Equals(t, output.Scan(), true)
+		var message map[string]any
+		assert.NoError(t, json.Unmarshal(output.Bytes(), &message))
+		return message
+	}
+	writeLine := func(line string) {
+		_, err := io.WriteString(stdinWriter, line+"\n")
+		assert.NoError(t, err)
+	}
+
+	writeLine(`{"versions": [4]}`)
+	hello := readLine()
+	assert.Equals(t, hello["version"], 4.0)
+	assert.NotNil(t, hello["schema"])
+	// Blank lines are skipped.
+	writeLine("")
+	writeLine(`{"id": 1, "run_id": "run-1", "data": {"id": "hello-world", "config": {"name": "Arca Lot"}}}`)
+	workDone := readLine()
+	assert.Equals(t, workDone["id"], 2.0)
+	assert.Equals(t, workDone["run_id"], "run-1")
+	data := workDone["data"].(map[string]any)
+	assert.Equals(t, data["output_id"], "success")
+	assert.Equals(t, data["output_data"].(map[string]any)["message"], "Hello, Arca Lot!")
+	writeLine(`{"id": 4, "run_id": "", "data": {}}`)
+	assert.Equals(t, len(<-serverDone), 0)
+}
+
+func TestJSONLines_InvalidLine(t *testing.T) {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, stdoutReader)
+	}()
+	go func() {
+		_, _ = io.WriteString(stdinWriter, "{\"versions\": [4]}\nnot json\n")
+	}()
+	errs := atp.RunATPServerWithOptions(
+		context.Background(),
+		stdinReader,
+		stdoutWriter,
+		helloWorldSchema,
+		atp.ServerOptions{Format: atp.FormatJSONLines},
+	)
+	assert.NoError(t, stdoutWriter.Close())
+	assert.Equals(t, len(errs), 1)
+	assert.Equals(t, errs[0].ServerFatal, true)
+	assert.Contains(t, errs[0].Err.Error(), `invalid JSON line "not json"`)
+}
+
+func TestJSONLines_Blobs(t *testing.T) {
+	cli := atp.NewInProcessClientWithOptions(
+		blobSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t), Format: atp.FormatJSONLines},
+		atp.ServerOptions{Format: atp.FormatJSONLines},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+	var blobData []string
+	for blob := range handle.Blobs() {
+		data, err := io.ReadAll(blob)
+		assert.NoError(t, err)
+		blobData = append(blobData, string(data[:len("Arca Lot")]))
+	}
+	result := handle.Wait()
+	assert.NoError(t, result.Error)
+	assert.Equals(t, result.OutputData.(map[any]any)["message"].(string), "Hello, Arca Lot!")
+	assert.Equals(t, blobData, []string{"Arca Lot", "Arca Lot"})
+	assert.NoError(t, cli.Close())
+}
+
+func TestStartPlugin_JSONLines(t *testing.T) {
+	t.Setenv(runPluginEnv, "1")
+	cli, process, err := atp.StartPlugin(context.Background(), os.Args[0], nil, atp.PluginOptions{
+		ClientOptions: atp.ClientOptions{Logger: log.NewTestLogger(t), Format: atp.FormatJSONLines},
+	})
+	assert.NoError(t, err)
+	_, err = cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(
+		schema.Input{
+			RunID:     t.Name(),
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.Equals(t, result.OutputData.(map[any]any)["message"].(string), "Hello, Arca Lot!")
+	assert.NoError(t, cli.Close())
+	assert.NoError(t, process.Wait())
+	assert.Equals(t, process.ExitCode(), 0)
+}
+
+func TestJSONLines_Client_InvalidFormat(t *testing.T) {
+	cli := atp.NewClientWithOptions(
+		newFakeServer(t, atp.WorkDoneMessage{}),
+		atp.ClientOptions{Logger: log.NewTestLogger(t), Format: "xml"},
+	)
+	_, err := cli.ReadSchema()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported ATP message format 'xml'")
+	result := cli.Execute(schema.Input{RunID: t.Name(), ID: "hello-world", InputData: map[string]any{}}, nil, nil)
+	assert.Error(t, result.Error)
+	assert.Contains(t, result.Error.Error(), "unsupported ATP message format 'xml'")
+	assert.NoError(t, cli.Close())
+}
+
+func TestStartPlugin_InvalidFormat(t *testing.T) {
+	// The plugin must not be started, since the client could not talk to it.
+	_, _, err := atp.StartPlugin(context.Background(), os.Args[0], nil, atp.PluginOptions{
+		ClientOptions: atp.ClientOptions{Format: "xml"},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported ATP message format 'xml'")
+}
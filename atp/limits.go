@@ -0,0 +1,102 @@
+package atp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"io"
+)
+
+// Default decoder limits.
+const (
+	// DefaultMaxNestedLevels is the default maximum depth of nested arrays, maps and tags in a message.
+	DefaultMaxNestedLevels = 32
+	// DefaultMaxArrayElements is the default maximum number of elements of an array in a message.
+	DefaultMaxArrayElements = 131072
+	// DefaultMaxMapPairs is the default maximum number of key-value pairs of a map in a message.
+	DefaultMaxMapPairs = 131072
+	// DefaultMaxMessageSize is the default maximum size of a message, in bytes.
+	DefaultMaxMessageSize = 64 * 1024 * 1024
+)
+
+// ErrMessageTooLarge is returned when the peer sends a message larger than the maximum message size.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// DecoderLimits limits the size and complexity of the CBOR messages ATP servers and clients accept from their peer,
+// so a buggy or hostile peer cannot exhaust the memory. A message that exceeds a limit cannot be skipped, so the
+// session fails. Fields left at their zero value use the default setting.
+type DecoderLimits struct {
+	// MaxNestedLevels is the maximum depth of nested arrays, maps and tags in a message. Must be between 4 and 65535.
+	// Defaults to DefaultMaxNestedLevels.
+	MaxNestedLevels int
+	// MaxArrayElements is the maximum number of elements of an array in a message. Must be at least 16. Defaults to
+	// DefaultMaxArrayElements.
+	MaxArrayElements int
+	// MaxMapPairs is the maximum number of key-value pairs of a map in a message. Must be at least 16. Defaults to
+	// DefaultMaxMapPairs.
+	MaxMapPairs int
+	// MaxMessageSize is the maximum size of a message in bytes, which also limits the size of byte and text strings.
+	// Defaults to DefaultMaxMessageSize.
+	MaxMessageSize int64
+}
+
+func (l DecoderLimits) withDefaults() DecoderLimits {
+	if l.MaxNestedLevels <= 0 {
+		l.MaxNestedLevels = DefaultMaxNestedLevels
+	}
+	if l.MaxArrayElements <= 0 {
+		l.MaxArrayElements = DefaultMaxArrayElements
+	}
+	if l.MaxMapPairs <= 0 {
+		l.MaxMapPairs = DefaultMaxMapPairs
+	}
+	if l.MaxMessageSize <= 0 {
+		l.MaxMessageSize = DefaultMaxMessageSize
+	}
+	return l
+}
+
+// decOptions returns the CBOR decoding options that enforce the limits, except for the message size. The defaults must
+// be applied to the limits.
+func (l DecoderLimits) decOptions() cbor.DecOptions {
+	return cbor.DecOptions{
+		MaxNestedLevels:  l.MaxNestedLevels,
+		MaxArrayElements: l.MaxArrayElements,
+		MaxMapPairs:      l.MaxMapPairs,
+	}
+}
+
+// newLimitedDecoder creates a decoder of the decoding mode that fails once a message exceeds the maximum message
+// size. The defaults must be applied to the limits.
+func (l DecoderLimits) newLimitedDecoder(decMode cbor.DecMode, reader io.Reader) *cbor.Decoder {
+	limiter := &messageSizeLimiter{
+		reader: reader,
+		limit:  l.MaxMessageSize,
+	}
+	decoder := decMode.NewDecoder(limiter)
+	limiter.decoded = decoder.NumBytesRead
+	return decoder
+}
+
+// messageSizeLimiter fails reads once the message being decoded exceeds the size limit. The decoder only reads when
+// the message it decodes is incomplete, so all bytes read but not decoded yet belong to that message.
+type messageSizeLimiter struct {
+	reader  io.Reader
+	limit   int64
+	read    int64
+	decoded func() int // Returns the number of bytes of the messages decoded so far.
+}
+
+func (l *messageSizeLimiter) Read(p []byte) (int, error) {
+	pending := l.read - int64(l.decoded())
+	if pending > l.limit {
+		return 0, fmt.Errorf("%w: the message exceeds the maximum size of %d bytes", ErrMessageTooLarge, l.limit)
+	}
+	// Read no more than is needed to tell that the message exceeds the limit.
+	if remaining := l.limit - pending + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.reader.Read(p)
+	l.read += int64(n)
+	return n, err
+}
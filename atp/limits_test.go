@@ -0,0 +1,179 @@
+package atp_test
+
+import (
+	"context"
+	"errors"
+	"github.com/fxamacker/cbor/v2"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"io"
+	"strings"
+	"testing"
+)
+
+// nested returns a list nested the given number of levels deep.
+func nested(levels int) any {
+	var value any = "Arca Lot"
+	for i := 0; i < levels; i++ {
+		value = []any{value}
+	}
+	return value
+}
+
+// mapWithPairs returns a map with the given number of key-value pairs.
+func mapWithPairs(pairs int) map[int]int {
+	value := make(map[int]int, pairs)
+	for i := 0; i < pairs; i++ {
+		value[i] = i
+	}
+	return value
+}
+
+func TestDecoderLimits_Server(t *testing.T) {
+	testCases := map[string]struct {
+		limits   atp.DecoderLimits
+		config   any
+		expected string
+	}{
+		"nested": {
+			atp.DecoderLimits{MaxNestedLevels: 8},
+			map[string]any{"name": nested(16)},
+			"exceeded max nested level 8",
+		},
+		"array": {
+			atp.DecoderLimits{MaxArrayElements: 16},
+			map[string]any{"name": make([]int, 100)},
+			"exceeded max number of elements 16",
+		},
+		"map": {
+			atp.DecoderLimits{MaxMapPairs: 16},
+			map[string]any{"name": "Arca Lot", "padding": mapWithPairs(100)},
+			"exceeded max number of key-value pairs 16",
+		},
+		"size": {
+			atp.DecoderLimits{MaxMessageSize: 1024},
+			map[string]any{"name": strings.Repeat("a", 4096)},
+			"exceeds the maximum size of 1024 bytes",
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			stdinReader, stdinWriter := io.Pipe()
+			stdoutReader, stdoutWriter := io.Pipe()
+			go func() {
+				_, _ = io.Copy(io.Discard, stdoutReader)
+			}()
+			go func() {
+				encoder := cbor.NewEncoder(stdinWriter)
+				if encoder.Encode(atp.StartMessage{Versions: []int64{atp.ProtocolVersion}}) != nil {
+					return
+				}
+				// The server stops reading once the message exceeds the limits.
+				_ = encoder.Encode(atp.RuntimeMessage{
+					MessageID:   atp.MessageTypeWorkStart,
+					RunID:       t.Name(),
+					MessageData: atp.WorkStartMessage{StepID: "hello-world", Config: testCase.config},
+				})
+			}()
+			errs := atp.RunATPServerWithOptions(
+				context.Background(),
+				stdinReader,
+				stdoutWriter,
+				helloWorldSchema,
+				atp.ServerOptions{DecoderLimits: testCase.limits},
+			)
+			assert.NoError(t, stdoutWriter.Close())
+			assert.Equals(t, len(errs), 1)
+			assert.Equals(t, errs[0].ServerFatal, true)
+			assert.Contains(t, errs[0].Err.Error(), testCase.expected)
+			if name == "size" {
+				assert.Equals(t, errors.Is(errs[0].Err, atp.ErrMessageTooLarge), true)
+			}
+		})
+	}
+}
+
+func TestDecoderLimits_Server_Invalid(t *testing.T) {
+	errs := atp.RunATPServerWithOptions(
+		context.Background(),
+		io.NopCloser(strings.NewReader("")),
+		nopWriteCloser{io.Discard},
+		helloWorldSchema,
+		atp.ServerOptions{DecoderLimits: atp.DecoderLimits{MaxNestedLevels: 1}},
+	)
+	assert.Equals(t, len(errs), 1)
+	assert.Contains(t, errs[0].Err.Error(), "invalid decoder limits")
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestDecoderLimits_Client(t *testing.T) {
+	testCases := map[string]struct {
+		limits     atp.DecoderLimits
+		outputData any
+		expected   string
+	}{
+		"array": {
+			atp.DecoderLimits{MaxArrayElements: 16},
+			map[string]any{"message": make([]int, 100)},
+			"exceeded max number of elements 16",
+		},
+		"size": {
+			atp.DecoderLimits{MaxMessageSize: 16 * 1024},
+			map[string]any{"message": strings.Repeat("a", 64*1024)},
+			"exceeds the maximum size of 16384 bytes",
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cli := atp.NewClientWithOptions(
+				newFakeServer(t, atp.WorkDoneMessage{
+					StepID:     "hello-world",
+					OutputID:   "success",
+					OutputData: testCase.outputData,
+				}),
+				atp.ClientOptions{Logger: log.NewTestLogger(t), DecoderLimits: testCase.limits},
+			)
+			_, err := cli.ReadSchema()
+			assert.NoError(t, err)
+			result := cli.Execute(schema.Input{
+				RunID:     t.Name(),
+				ID:        "hello-world",
+				InputData: map[string]any{"name": "Arca Lot"},
+			}, nil, nil)
+			assert.Error(t, result.Error)
+			assert.Contains(t, result.Error.Error(), testCase.expected)
+			// The session cannot continue, so the client is not closed.
+		})
+	}
+}
+
+func TestDecoderLimits_Client_Invalid(t *testing.T) {
+	cli := atp.NewClientWithOptions(
+		newFakeServer(t, atp.WorkDoneMessage{}),
+		atp.ClientOptions{Logger: log.NewTestLogger(t), DecoderLimits: atp.DecoderLimits{MaxNestedLevels: 1}},
+	)
+	_, err := cli.ReadSchema()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid decoder limits")
+	input := schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	}
+	result := cli.Execute(input, nil, nil)
+	assert.Error(t, result.Error)
+	assert.Contains(t, result.Error.Error(), "invalid decoder limits")
+	_, err = cli.(atp.RunStarter).Start(context.Background(), input)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid decoder limits")
+	assert.NoError(t, cli.Close())
+}
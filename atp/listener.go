@@ -0,0 +1,107 @@
+package atp
+
+import (
+	"context"
+	"fmt"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Listen creates a listener for ServeATP from an address in the unix:///path/to/socket or tcp://host:port format.
+// A unix socket file left behind by a previous process that no longer listens on it is removed first.
+func Listen(address string) (net.Listener, error) {
+	network, listenAddress, found := strings.Cut(address, "://")
+	if !found || listenAddress == "" {
+		return nil, fmt.Errorf(
+			"invalid ATP listen address '%s', expected unix:///path/to/socket or tcp://host:port", address,
+		)
+	}
+	switch network {
+	case "unix", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported network '%s' in ATP listen address '%s', expected unix or tcp",
+			network, address)
+	}
+	if network == "unix" {
+		if err := removeStaleSocket(listenAddress); err != nil {
+			return nil, fmt.Errorf("failed to listen on '%s' (%w)", address, err)
+		}
+	}
+	listener, err := net.Listen(network, listenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on '%s' (%w)", address, err)
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the unix socket file at the path if nothing accepts connections on it anymore. Other
+// files, and sockets that are still in use, are left alone so that listening fails on them.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		_ = conn.Close()
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket '%s' (%w)", path, err)
+	}
+	return nil
+}
+
+// ServeATP accepts connections on the listener and runs an ATP session with RunATPServerWithOptions on each of
+// them, until the context is cancelled or accepting a connection fails. The listener is closed, and the sessions
+// are shut down, drained, and waited for, before ServeATP returns. Errors of individual sessions are written to
+// stderr, and passed to the OnError function in the options.
+func ServeATP(
+	ctx context.Context,
+	listener net.Listener,
+	pluginSchema *schema.CallableSchema,
+	options ServerOptions,
+) error {
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Accept blocks, so closing the listener is the only way to stop it.
+	context.AfterFunc(ctx, func() {
+		_ = listener.Close()
+	})
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to accept ATP connection (%w)", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveATPConnection(ctx, conn, pluginSchema, options)
+		}()
+	}
+}
+
+func serveATPConnection(
+	ctx context.Context,
+	conn net.Conn,
+	pluginSchema *schema.CallableSchema,
+	options ServerOptions,
+) {
+	// The session stops reading once the server is stopped and its runs are drained, so the connection can only be
+	// closed then.
+	defer func() {
+		_ = conn.Close()
+	}()
+	for _, err := range RunATPServerWithOptions(ctx, conn, conn, pluginSchema, options) {
+		_, _ = fmt.Fprintf(os.Stderr, "ATP session failed: %s\n", err)
+	}
+}
@@ -0,0 +1,85 @@
+package atp_test
+
+import (
+	"context"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestListen_Invalid(t *testing.T) {
+	for _, address := range []string{"", "/tmp/plugin.sock", "udp://127.0.0.1:0", "tcp://"} {
+		_, err := atp.Listen(address)
+		assert.Error(t, err)
+	}
+}
+
+func TestServeATP_TCP(t *testing.T) {
+	listener, err := atp.Listen("tcp://127.0.0.1:0")
+	assert.NoError(t, err)
+	testServeATP(t, listener)
+}
+
+func TestServeATP_Unix(t *testing.T) {
+	listener, err := atp.Listen("unix://" + filepath.Join(t.TempDir(), "plugin.sock"))
+	assert.NoError(t, err)
+	testServeATP(t, listener)
+}
+
+func TestListen_StaleUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "plugin.sock")
+	// A process that exits without closing its listener leaves the socket file behind.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	assert.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	assert.NoError(t, stale.Close())
+
+	listener, err := atp.Listen("unix://" + socketPath)
+	assert.NoError(t, err)
+	// A socket that is still listened on is not taken over.
+	_, err = atp.Listen("unix://" + socketPath)
+	assert.Error(t, err)
+	testServeATP(t, listener)
+}
+
+func testServeATP(t *testing.T, listener net.Listener) {
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErrors := make(chan error, 1)
+	go func() {
+		serveErrors <- atp.ServeATP(ctx, listener, helloWorldSchema, atp.ServerOptions{})
+	}()
+
+	// Every connection gets its own session, so the same run ID can be used again.
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+		assert.NoError(t, err)
+		cli := atp.NewClientWithLogger(conn, log.NewTestLogger(t))
+		_, err = cli.ReadSchema()
+		assert.NoError(t, err)
+		result := cli.Execute(
+			schema.Input{
+				RunID:     t.Name(),
+				ID:        "hello-world",
+				InputData: map[string]any{"name": "Arca Lot"},
+			}, nil, nil)
+		assert.NoError(t, result.Error)
+		assert.Equals(t, result.OutputData.(map[any]any)["message"].(string), "Hello, Arca Lot!")
+		assert.NoError(t, cli.Close())
+		assert.NoError(t, conn.Close())
+	}
+
+	// A connection that is still open must not keep the server from stopping.
+	conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+	assert.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+	cancel()
+	assert.NoError(t, <-serveErrors)
+	_, err = net.Dial(listener.Addr().Network(), listener.Addr().String())
+	assert.Error(t, err)
+}
@@ -0,0 +1,156 @@
+package atp
+
+import (
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metric names a per-run measurement the ATP server and client record.
+type Metric string
+
+// Duration metrics.
+const (
+	// MetricRunDuration is the time from the work start message to the work done or error message of a run.
+	MetricRunDuration Metric = "run_duration"
+	// MetricUnserializeDuration is the time the server spent unserializing the step input.
+	MetricUnserializeDuration Metric = "unserialize_duration"
+	// MetricHandlerDuration is the time the server spent in the step handler.
+	MetricHandlerDuration Metric = "handler_duration"
+	// MetricSerializeDuration is the time the server spent serializing the step output.
+	MetricSerializeDuration Metric = "serialize_duration"
+	// MetricEncoderWait is the time spent waiting for other messages to be sent before a message of the run could be
+	// sent.
+	MetricEncoderWait Metric = "encoder_wait"
+)
+
+// Counter metrics.
+const (
+	// MetricSignalsReceived counts the signals of the run received from the other side.
+	MetricSignalsReceived Metric = "signals_received"
+	// MetricSignalsSent counts the signals of the run sent to the other side.
+	MetricSignalsSent Metric = "signals_sent"
+	// MetricBytesIn counts the bytes of the messages of the run received from the other side.
+	MetricBytesIn Metric = "bytes_in"
+	// MetricBytesOut counts the bytes of the messages of the run sent to the other side.
+	MetricBytesOut Metric = "bytes_out"
+)
+
+// MetricsSink receives the metrics the ATP server and client record for each run. It must be safe for concurrent
+// use. The server and the client record metrics with the same names, so they should not share a sink.
+type MetricsSink interface {
+	// ObserveDuration records a duration for the run. A duration metric may be observed several times per run.
+	ObserveDuration(runID string, metric Metric, duration time.Duration)
+	// AddCount adds to a counter of the run.
+	AddCount(runID string, metric Metric, delta int64)
+}
+
+// noopMetrics is the sink used if no sink is configured.
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveDuration(string, Metric, time.Duration) {}
+
+func (noopMetrics) AddCount(string, Metric, int64) {}
+
+// RunMetrics holds the metrics recorded for a single run.
+type RunMetrics struct {
+	// Durations holds the sum of the observed durations of each duration metric.
+	Durations map[Metric]time.Duration
+	// Observations holds the number of times each duration metric was observed.
+	Observations map[Metric]int64
+	// Counts holds the value of each counter metric.
+	Counts map[Metric]int64
+}
+
+func newRunMetrics() *RunMetrics {
+	return &RunMetrics{
+		Durations:    map[Metric]time.Duration{},
+		Observations: map[Metric]int64{},
+		Counts:       map[Metric]int64{},
+	}
+}
+
+func (m *RunMetrics) clone() RunMetrics {
+	return RunMetrics{
+		Durations:    maps.Clone(m.Durations),
+		Observations: maps.Clone(m.Observations),
+		Counts:       maps.Clone(m.Counts),
+	}
+}
+
+// InMemoryMetrics is a MetricsSink that keeps the metrics of all runs in memory.
+type InMemoryMetrics struct {
+	lock sync.Mutex
+	runs map[string]*RunMetrics
+}
+
+// NewInMemoryMetrics creates an empty in-memory metrics sink.
+func NewInMemoryMetrics() *InMemoryMetrics {
+	return &InMemoryMetrics{
+		runs: map[string]*RunMetrics{},
+	}
+}
+
+func (m *InMemoryMetrics) ObserveDuration(runID string, metric Metric, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	run := m.getRun(runID)
+	run.Durations[metric] += duration
+	run.Observations[metric]++
+}
+
+func (m *InMemoryMetrics) AddCount(runID string, metric Metric, delta int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.getRun(runID).Counts[metric] += delta
+}
+
+// getRun returns the metrics of the run, creating them if needed. The caller must hold the lock.
+func (m *InMemoryMetrics) getRun(runID string) *RunMetrics {
+	run, found := m.runs[runID]
+	if !found {
+		run = newRunMetrics()
+		m.runs[runID] = run
+	}
+	return run
+}
+
+// RunIDs returns the sorted IDs of the runs that have metrics.
+func (m *InMemoryMetrics) RunIDs() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return slices.Sorted(maps.Keys(m.runs))
+}
+
+// Run returns a copy of the metrics of the run. The maps are empty if nothing was recorded for the run.
+func (m *InMemoryMetrics) Run(runID string) RunMetrics {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	run, found := m.runs[runID]
+	if !found {
+		return newRunMetrics().clone()
+	}
+	return run.clone()
+}
+
+// Reset drops the metrics of all runs.
+func (m *InMemoryMetrics) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.runs = map[string]*RunMetrics{}
+}
+
+// countingWriter counts the bytes written through it, so the size of encoded messages can be measured.
+type countingWriter struct {
+	io.Writer
+	written atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.written.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,100 @@
+package atp
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// prometheusPrefix is prepended to the metric names in the Prometheus text format.
+const prometheusPrefix = "atp_"
+
+// durationMetrics lists the duration metrics in the order they are exported.
+var durationMetrics = []Metric{
+	MetricRunDuration,
+	MetricUnserializeDuration,
+	MetricHandlerDuration,
+	MetricSerializeDuration,
+	MetricEncoderWait,
+}
+
+// counterMetrics lists the counter metrics in the order they are exported.
+var counterMetrics = []Metric{
+	MetricSignalsReceived,
+	MetricSignalsSent,
+	MetricBytesIn,
+	MetricBytesOut,
+}
+
+var metricHelp = map[Metric]string{
+	MetricRunDuration:         "Time from the work start message to the work done or error message of a run.",
+	MetricUnserializeDuration: "Time spent unserializing the step input.",
+	MetricHandlerDuration:     "Time spent in the step handler.",
+	MetricSerializeDuration:   "Time spent serializing the step output.",
+	MetricEncoderWait:         "Time spent waiting for other messages to be sent.",
+	MetricSignalsReceived:     "Signals received from the other side.",
+	MetricSignalsSent:         "Signals sent to the other side.",
+	MetricBytesIn:             "Bytes of the messages received from the other side.",
+	MetricBytesOut:            "Bytes of the messages sent to the other side.",
+}
+
+// WritePrometheus writes the metrics of all runs in the Prometheus text exposition format. Duration metrics are
+// written as summaries in seconds, and counter metrics as counters, each with a run_id label. Metrics without values
+// are left out.
+func (m *InMemoryMetrics) WritePrometheus(w io.Writer) error {
+	runIDs := m.RunIDs()
+	runs := make([]RunMetrics, len(runIDs))
+	for i, runID := range runIDs {
+		runs[i] = m.Run(runID)
+	}
+	output := &strings.Builder{}
+	for _, metric := range durationMetrics {
+		name := prometheusPrefix + string(metric) + "_seconds"
+		header := false
+		for i, run := range runs {
+			count, found := run.Observations[metric]
+			if !found {
+				continue
+			}
+			if !header {
+				writePrometheusHeader(output, name, metric, "summary")
+				header = true
+			}
+			label := prometheusRunLabel(runIDs[i])
+			_, _ = fmt.Fprintf(output, "%s_sum%s %s\n", name, label,
+				strconv.FormatFloat(run.Durations[metric].Seconds(), 'g', -1, 64))
+			_, _ = fmt.Fprintf(output, "%s_count%s %d\n", name, label, count)
+		}
+	}
+	for _, metric := range counterMetrics {
+		name := prometheusPrefix + string(metric) + "_total"
+		header := false
+		for i, run := range runs {
+			count, found := run.Counts[metric]
+			if !found {
+				continue
+			}
+			if !header {
+				writePrometheusHeader(output, name, metric, "counter")
+				header = true
+			}
+			_, _ = fmt.Fprintf(output, "%s%s %d\n", name, prometheusRunLabel(runIDs[i]), count)
+		}
+	}
+	if _, err := io.WriteString(w, output.String()); err != nil {
+		return fmt.Errorf("failed to write metrics (%w)", err)
+	}
+	return nil
+}
+
+func writePrometheusHeader(output *strings.Builder, name string, metric Metric, metricType string) {
+	_, _ = fmt.Fprintf(output, "# HELP %s %s\n", name, metricHelp[metric])
+	_, _ = fmt.Fprintf(output, "# TYPE %s %s\n", name, metricType)
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusRunLabel(runID string) string {
+	return `{run_id="` + prometheusLabelEscaper.Replace(runID) + `"}`
+}
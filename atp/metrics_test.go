@@ -0,0 +1,122 @@
+package atp_test
+
+import (
+	"context"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMetricsClient creates an in-process client for the plugin that records the metrics of both sides.
+func newMetricsClient(
+	t *testing.T,
+	pluginSchema *schema.CallableSchema,
+) (atp.Client, *atp.InMemoryMetrics, *atp.InMemoryMetrics) {
+	serverMetrics := atp.NewInMemoryMetrics()
+	clientMetrics := atp.NewInMemoryMetrics()
+	cli := atp.NewInProcessClientWithOptions(
+		pluginSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t), Metrics: clientMetrics},
+		atp.ServerOptions{Metrics: serverMetrics},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	return cli, serverMetrics, clientMetrics
+}
+
+func TestMetrics(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	cli, serverMetrics, clientMetrics := newMetricsClient(t, newCancellableSchema(release))
+	handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+	// The step waits for the cancel signal.
+	handle.Cancel()
+	assert.NoError(t, handle.Wait().Error)
+	// Closing waits for the server, so it has handled all messages afterwards.
+	assert.NoError(t, cli.Close())
+
+	assert.Equals(t, serverMetrics.RunIDs(), []string{t.Name()})
+	serverRun := serverMetrics.Run(t.Name())
+	assert.Equals(t, serverRun.Observations[atp.MetricRunDuration], 1)
+	for _, metric := range []atp.Metric{
+		atp.MetricRunDuration,
+		atp.MetricUnserializeDuration,
+		atp.MetricHandlerDuration,
+		atp.MetricSerializeDuration,
+	} {
+		if serverRun.Durations[metric] <= 0 {
+			t.Errorf("server did not record %s", metric)
+		}
+	}
+	assert.Equals(t, serverRun.Observations[atp.MetricEncoderWait] > 0, true)
+	assert.Equals(t, serverRun.Counts[atp.MetricSignalsReceived], 1)
+	assert.Equals(t, serverRun.Counts[atp.MetricBytesIn] > 0, true)
+	assert.Equals(t, serverRun.Counts[atp.MetricBytesOut] > 0, true)
+
+	clientRun := clientMetrics.Run(t.Name())
+	assert.Equals(t, clientRun.Observations[atp.MetricRunDuration], 1)
+	assert.Equals(t, clientRun.Counts[atp.MetricSignalsSent], 1)
+	// Both sides see the same messages of the run.
+	assert.Equals(t, clientRun.Counts[atp.MetricBytesOut], serverRun.Counts[atp.MetricBytesIn])
+	assert.Equals(t, clientRun.Counts[atp.MetricBytesIn], serverRun.Counts[atp.MetricBytesOut])
+}
+
+func TestMetrics_EmittedSignals(t *testing.T) {
+	cli, serverMetrics, clientMetrics := newMetricsClient(t, signalEmittingSchema)
+	handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+	for range handle.Signals() {
+		// The signals channel is closed once the run is finished.
+	}
+	assert.NoError(t, handle.Wait().Error)
+	assert.NoError(t, cli.Close())
+	assert.Equals(t, serverMetrics.Run(t.Name()).Counts[atp.MetricSignalsSent], 1)
+	assert.Equals(t, clientMetrics.Run(t.Name()).Counts[atp.MetricSignalsReceived], 1)
+}
+
+func TestInMemoryMetrics_WritePrometheus(t *testing.T) {
+	metrics := atp.NewInMemoryMetrics()
+	metrics.ObserveDuration("run-2", atp.MetricRunDuration, 1500*time.Millisecond)
+	metrics.ObserveDuration("run-1", atp.MetricRunDuration, 250*time.Millisecond)
+	metrics.ObserveDuration("run-1", atp.MetricEncoderWait, time.Millisecond)
+	metrics.ObserveDuration("run-1", atp.MetricEncoderWait, time.Millisecond)
+	metrics.AddCount("run-1", atp.MetricBytesOut, 100)
+	metrics.AddCount("run-1", atp.MetricBytesOut, 20)
+	metrics.AddCount(`run "3"`, atp.MetricSignalsSent, 1)
+
+	output := &strings.Builder{}
+	assert.NoError(t, metrics.WritePrometheus(output))
+	assert.Equals(t, output.String(), `# HELP atp_run_duration_seconds Time from the work start message to the work done or error message of a run.
+# TYPE atp_run_duration_seconds summary
+atp_run_duration_seconds_sum{run_id="run-1"} 0.25
+atp_run_duration_seconds_count{run_id="run-1"} 1
+atp_run_duration_seconds_sum{run_id="run-2"} 1.5
+atp_run_duration_seconds_count{run_id="run-2"} 1
+# HELP atp_encoder_wait_seconds Time spent waiting for other messages to be sent.
+# TYPE atp_encoder_wait_seconds summary
+atp_encoder_wait_seconds_sum{run_id="run-1"} 0.002
+atp_encoder_wait_seconds_count{run_id="run-1"} 2
+# HELP atp_signals_sent_total Signals sent to the other side.
+# TYPE atp_signals_sent_total counter
+atp_signals_sent_total{run_id="run \"3\""} 1
+# HELP atp_bytes_out_total Bytes of the messages sent to the other side.
+# TYPE atp_bytes_out_total counter
+atp_bytes_out_total{run_id="run-1"} 120
+`)
+
+	metrics.Reset()
+	assert.Equals(t, len(metrics.RunIDs()), 0)
+}
@@ -0,0 +1,225 @@
+package atp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"go.arcalot.io/log/v2"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultStopGracePeriod is the default time a plugin process has to exit after the client was closed, before it is
+// killed.
+const DefaultStopGracePeriod = 10 * time.Second
+
+// PluginOptions holds the settings for starting a plugin process. Fields left at their zero value use the default
+// setting.
+type PluginOptions struct {
+	// ClientOptions holds the settings of the client talking to the plugin. Its logger also receives the stderr
+	// output of the plugin, line by line.
+	ClientOptions ClientOptions
+	// StopGracePeriod is the time the plugin has to exit after the client was closed, before it is killed. Defaults
+	// to DefaultStopGracePeriod.
+	StopGracePeriod time.Duration
+	// Env is the environment of the plugin process. The plugin inherits the environment of the current process if
+	// it is nil.
+	Env []string
+	// Dir is the working directory of the plugin process. Defaults to the current working directory.
+	Dir string
+}
+
+// StartPlugin starts the plugin executable with the given arguments followed by --atp, and returns a client talking
+// to it over its stdin and stdout. If the client uses FormatJSONLines, --atp-format=jsonl is passed too. Closing the
+// client closes the stdin of the plugin, and kills the plugin if it does not exit within the stop grace period, even
+// if runs are still in flight. The plugin is also killed when the context is cancelled. The client must be closed
+// even if reading the schema fails, so the process does not leak.
+func StartPlugin(
+	ctx context.Context,
+	path string,
+	args []string,
+	options PluginOptions,
+) (Client, *PluginProcess, error) {
+	if options.StopGracePeriod <= 0 {
+		options.StopGracePeriod = DefaultStopGracePeriod
+	}
+	logger := options.ClientOptions.Logger
+	if logger == nil {
+		logger = log.NewLogger(log.LevelDebug, log.NewNOOPLogger())
+		options.ClientOptions.Logger = logger
+	}
+	// The client would only report an invalid format once the plugin is running, so it is checked before starting it.
+	format, err := ParseFormat(string(options.ClientOptions.Format))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid format for plugin %s (%w)", path, err)
+	}
+	args = append(slices.Clone(args), "--atp")
+	if format == FormatJSONLines {
+		args = append(args, "--atp-format="+string(FormatJSONLines))
+	}
+	cmd := exec.CommandContext(ctx, path, args...) //nolint:gosec
+	cmd.Env = options.Env
+	cmd.Dir = options.Dir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create stdin pipe for plugin %s (%w)", path, err)
+	}
+	// The stdout pipe is not created with cmd.StdoutPipe, since waiting for the plugin would close it while the client
+	// may still be reading the last messages of the plugin. The client closes it instead.
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create stdout pipe for plugin %s (%w)", path, err)
+	}
+	cmd.Stdout = stdoutWriter
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		_ = stdout.Close()
+		_ = stdoutWriter.Close()
+		return nil, nil, fmt.Errorf("failed to create stderr pipe for plugin %s (%w)", path, err)
+	}
+	err = cmd.Start()
+	// The plugin has its own copy of the write end, so the client reads EOF once the plugin exits.
+	_ = stdoutWriter.Close()
+	if err != nil {
+		_ = stdout.Close()
+		return nil, nil, fmt.Errorf("failed to start plugin %s (%w)", path, err)
+	}
+	logger.Debugf("Started plugin %s with PID %d.", path, cmd.Process.Pid)
+
+	process := &PluginProcess{
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+	go process.wait(stderr, logger.WithLabel("plugin_pid", fmt.Sprintf("%d", cmd.Process.Pid)))
+	channel := &pluginChannel{stdout, stdin}
+	return &pluginClient{
+		client:          NewClientWithOptions(channel, options.ClientOptions).(*client),
+		channel:         channel,
+		process:         process,
+		stopGracePeriod: options.StopGracePeriod,
+	}, process, nil
+}
+
+// PluginProcess is a plugin executable started by StartPlugin.
+type PluginProcess struct {
+	cmd     *exec.Cmd
+	done    chan struct{}
+	waitErr error
+}
+
+// Pid returns the process ID of the plugin.
+func (p *PluginProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+// Done returns a channel that is closed once the plugin exited.
+func (p *PluginProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait waits for the plugin to exit. It returns an *exec.ExitError if the plugin exited with a non-zero status, or
+// was killed.
+func (p *PluginProcess) Wait() error {
+	<-p.done
+	return p.waitErr
+}
+
+// ExitCode returns the exit code of the plugin, or -1 if it has not exited yet or was killed by a signal.
+func (p *PluginProcess) ExitCode() int {
+	select {
+	case <-p.done:
+		return p.cmd.ProcessState.ExitCode()
+	default:
+		return -1
+	}
+}
+
+// Kill kills the plugin without waiting for it to exit.
+func (p *PluginProcess) Kill() error {
+	if err := p.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("failed to kill plugin with PID %d (%w)", p.Pid(), err)
+	}
+	return nil
+}
+
+// wait logs the stderr output of the plugin until it exits, and then collects its exit status.
+func (p *PluginProcess) wait(stderr io.Reader, logger log.Logger) {
+	defer close(p.done)
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		logger.Infof("%s", scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		// The rest of the output is discarded, so the plugin does not block on writing to stderr.
+		logger.Warningf("Failed to read the stderr output of the plugin, discarding the rest of it (%v).", err)
+		_, _ = io.Copy(io.Discard, stderr)
+	}
+	// The stderr pipe must be fully read before waiting, since waiting closes it.
+	p.waitErr = p.cmd.Wait()
+	logger.Debugf("Plugin exited with status %s.", p.cmd.ProcessState)
+}
+
+type pluginChannel struct {
+	io.ReadCloser
+	stdin io.WriteCloser
+}
+
+func (c *pluginChannel) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// Close closes the stdin of the plugin, which ends the session if the plugin is still waiting for messages.
+func (c *pluginChannel) Close() error {
+	return c.stdin.Close()
+}
+
+// closeStdout closes the stdout of the plugin once the client stopped reading it.
+func (c *pluginChannel) closeStdout() error {
+	return c.ReadCloser.Close()
+}
+
+type pluginClient struct {
+	*client
+	channel         *pluginChannel
+	process         *PluginProcess
+	stopGracePeriod time.Duration
+	closeOnce       sync.Once
+	closeErr        error
+}
+
+func (c *pluginClient) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.close()
+	})
+	return c.closeErr
+}
+
+func (c *pluginClient) close() error {
+	// Closing the client waits for the runs in flight, which never finish if the plugin hangs. The grace period
+	// therefore starts right away, and killing the plugin ends the wait.
+	clientErrors := make(chan error, 1)
+	go func() {
+		clientErr := c.client.Close()
+		_ = c.channel.Close()
+		clientErrors <- clientErr
+	}()
+	gracePeriod := time.NewTimer(c.stopGracePeriod)
+	defer gracePeriod.Stop()
+	select {
+	case <-c.process.Done():
+	case <-gracePeriod.C:
+		c.logger.Warningf("Plugin with PID %d did not exit within %s, killing it.", c.process.Pid(), c.stopGracePeriod)
+		if err := c.process.Kill(); err != nil {
+			return err
+		}
+		<-c.process.Done()
+	}
+	clientErr := <-clientErrors
+	_ = c.channel.closeStdout()
+	return clientErr
+}
@@ -0,0 +1,196 @@
+package atp_test
+
+import (
+	"context"
+	"github.com/fxamacker/cbor/v2"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/plugin"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runPluginEnv makes the test binary run as a plugin instead of running the tests. If it is set to
+// pluginModeHang, the plugin ignores its stdin and never exits by itself. If it is set to pluginModeHangingRun, the
+// runs of the "stubborn" name never finish. If it is set to pluginModeExitAfterRun, the plugin exits right after
+// sending the result of the first run. If it is set to pluginModeLongStderrLine, the plugin writes a line longer
+// than the stderr scanner accepts before starting.
+const runPluginEnv = "ATP_TEST_RUN_PLUGIN"
+
+const pluginModeHang = "hang"
+const pluginModeHangingRun = "hanging-run"
+const pluginModeExitAfterRun = "exit-after-run"
+const pluginModeLongStderrLine = "long-stderr-line"
+
+// longOutputSize is larger than the pipe buffers, so the plugin is still writing when the client starts reading.
+const longOutputSize = 1024 * 1024
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(runPluginEnv) {
+	case "":
+		os.Exit(m.Run())
+	case pluginModeHang:
+		time.Sleep(time.Hour)
+	case pluginModeHangingRun:
+		plugin.Run(newCancellableSchema(nil))
+	case pluginModeExitAfterRun:
+		runAndExit()
+	case pluginModeLongStderrLine:
+		// Without a reader, the plugin would block on the rest of its stderr output.
+		_, _ = os.Stderr.WriteString(strings.Repeat("a", 100*1024) + "\n" + strings.Repeat("b", longOutputSize))
+		plugin.Run(helloWorldSchema)
+	default:
+		_, _ = os.Stderr.WriteString("Plugin starting\n")
+		plugin.Run(helloWorldSchema)
+	}
+	os.Exit(0)
+}
+
+// runAndExit answers the start message and the first work start message like an ATP server, and exits as soon as the
+// work done message is written, without waiting for the client to read it.
+func runAndExit() {
+	decoder := cbor.NewDecoder(os.Stdin)
+	encoder := cbor.NewEncoder(os.Stdout)
+	var startMessage any
+	if err := decoder.Decode(&startMessage); err != nil {
+		panic(err)
+	}
+	serializedSchema, err := helloWorldSchema.SelfSerialize()
+	if err != nil {
+		panic(err)
+	}
+	if err := encoder.Encode(atp.HelloMessage{Version: atp.ProtocolVersion, Schema: serializedSchema}); err != nil {
+		panic(err)
+	}
+	var workStart atp.DecodedRuntimeMessage
+	if err := decoder.Decode(&workStart); err != nil {
+		panic(err)
+	}
+	if err := encoder.Encode(atp.RuntimeMessage{
+		MessageID: atp.MessageTypeWorkDone,
+		RunID:     workStart.RunID,
+		MessageData: atp.WorkDoneMessage{
+			StepID:     "hello-world",
+			OutputID:   "success",
+			OutputData: map[string]any{"message": strings.Repeat("a", longOutputSize)},
+		},
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func TestStartPlugin(t *testing.T) {
+	t.Setenv(runPluginEnv, "1")
+	logBuffer := &lockedBufferWriter{BufferWriter: log.NewBufferWriter()}
+	cli, process, err := atp.StartPlugin(context.Background(), os.Args[0], nil, atp.PluginOptions{
+		ClientOptions: atp.ClientOptions{Logger: log.NewLogger(log.LevelDebug, logBuffer)},
+	})
+	assert.NoError(t, err)
+	_, err = cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(
+		schema.Input{
+			RunID:     t.Name(),
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.Equals(t, result.OutputData.(map[any]any)["message"].(string), "Hello, Arca Lot!")
+	assert.NoError(t, cli.Close())
+	assert.NoError(t, process.Wait())
+	assert.Equals(t, process.ExitCode(), 0)
+	assert.Contains(t, logBuffer.String(), "Plugin starting")
+}
+
+func TestStartPlugin_ExitAfterRun(t *testing.T) {
+	// The client must still read the result the plugin wrote before it exited.
+	t.Setenv(runPluginEnv, pluginModeExitAfterRun)
+	cli, process, err := atp.StartPlugin(context.Background(), os.Args[0], nil, atp.PluginOptions{
+		ClientOptions: atp.ClientOptions{Logger: log.NewTestLogger(t)},
+	})
+	assert.NoError(t, err)
+	_, err = cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(
+		schema.Input{
+			RunID:     t.Name(),
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.Equals(t, len(result.OutputData.(map[any]any)["message"].(string)), longOutputSize)
+	assert.NoError(t, process.Wait())
+	// The plugin is gone, so the client done message cannot be sent anymore.
+	_ = cli.Close()
+}
+
+func TestStartPlugin_LongStderrLine(t *testing.T) {
+	t.Setenv(runPluginEnv, pluginModeLongStderrLine)
+	logBuffer := &lockedBufferWriter{BufferWriter: log.NewBufferWriter()}
+	cli, process, err := atp.StartPlugin(context.Background(), os.Args[0], nil, atp.PluginOptions{
+		ClientOptions: atp.ClientOptions{Logger: log.NewLogger(log.LevelDebug, logBuffer)},
+	})
+	assert.NoError(t, err)
+	_, err = cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(
+		schema.Input{
+			RunID:     t.Name(),
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.NoError(t, cli.Close())
+	assert.NoError(t, process.Wait())
+	assert.Contains(t, logBuffer.String(), "Failed to read the stderr output of the plugin")
+}
+
+func TestStartPlugin_Kill(t *testing.T) {
+	t.Setenv(runPluginEnv, pluginModeHang)
+	cli, process, err := atp.StartPlugin(context.Background(), os.Args[0], nil, atp.PluginOptions{
+		StopGracePeriod: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Close())
+	assert.Error(t, process.Wait())
+	assert.Equals(t, process.ExitCode(), -1)
+}
+
+func TestStartPlugin_KillWithRunInFlight(t *testing.T) {
+	t.Setenv(runPluginEnv, pluginModeHangingRun)
+	cli, process, err := atp.StartPlugin(context.Background(), os.Args[0], nil, atp.PluginOptions{
+		ClientOptions:   atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		StopGracePeriod: 100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	_, err = cli.ReadSchema()
+	assert.NoError(t, err)
+	handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "stubborn"},
+	})
+	assert.NoError(t, err)
+	// Closing the client waits for the run, so the plugin must be killed for Close to return.
+	_ = cli.Close()
+	assert.Error(t, process.Wait())
+	assert.Error(t, handle.Wait().Error)
+}
+
+func TestStartPlugin_ContextCancelled(t *testing.T) {
+	t.Setenv(runPluginEnv, pluginModeHang)
+	ctx, cancel := context.WithCancel(context.Background())
+	_, process, err := atp.StartPlugin(ctx, os.Args[0], nil, atp.PluginOptions{})
+	assert.NoError(t, err)
+	cancel()
+	assert.Error(t, process.Wait())
+}
+
+func TestStartPlugin_Invalid(t *testing.T) {
+	_, _, err := atp.StartPlugin(context.Background(), "/nonexistent/plugin", nil, atp.PluginOptions{})
+	assert.Error(t, err)
+}
@@ -6,16 +6,65 @@ import (
 	"go.flow.arcalot.io/pluginsdk/schema"
 )
 
-const ProtocolVersion int64 = 3
+const ProtocolVersion int64 = 4
 
+// Optional protocol features the client and the server negotiate with the start and hello messages.
+const (
+	// FeatureLogStreaming makes the server send the logs of running steps as log messages. Requires ATP v4.
+	FeatureLogStreaming = "log_streaming"
+	// FeatureBlobStreaming lets running steps stream binary data to the client in blob chunk messages. Requires
+	// ATP v4.
+	FeatureBlobStreaming = "blob_streaming"
+	// FeatureStructuredErrors makes the server send the kind, the violated constraint, the stack trace and the cause
+	// chain of errors in error messages. Requires ATP v4.
+	FeatureStructuredErrors = "structured_errors"
+	// FeatureTraceContext lets the client send the trace context of a run in the work start message, and makes the
+	// server send the trace context of the span of the run with the work done, signal and error messages of the run.
+	// Requires ATP v4.
+	FeatureTraceContext = "trace_context"
+	// FeatureResourceUsage makes the server send the resources the plugin process used during a run in the work done
+	// message. Requires ATP v4.
+	FeatureResourceUsage = "resource_usage"
+	// FeatureRunStatus lets the client query the status of the runs with run status request messages, which the
+	// server answers with run status response messages. Requires ATP v4.
+	FeatureRunStatus = "run_status"
+	// FeatureSignalReplies lets the client ask for the reply of the signal handler in signal messages, which the
+	// server sends back in signal reply messages. Requires ATP v4.
+	FeatureSignalReplies = "signal_replies"
+)
+
+// featureVersions maps the optional features to the minimum protocol version they require.
+var featureVersions = map[string]int64{
+	FeatureLogStreaming:     4,
+	FeatureBlobStreaming:    4,
+	FeatureStructuredErrors: 4,
+	FeatureTraceContext:     4,
+	FeatureResourceUsage:    4,
+	FeatureRunStatus:        4,
+	FeatureSignalReplies:    4,
+}
+
+// StartMessage is the first message of a session, sent by the client. It lists the protocol versions and the
+// optional features the client supports. Clients before ATP v4 send an empty (nil) start message instead.
+type StartMessage struct {
+	Versions []int64  `cbor:"versions"`
+	Features []string `cbor:"features,omitempty"`
+}
+
+// HelloMessage is the server's answer to the start message. It holds the protocol version chosen for the session,
+// the plugin schema, and the optional features enabled for the session.
 type HelloMessage struct {
-	Version int64 `cbor:"version"`
-	Schema  any   `cbor:"schema"`
+	Version      int64    `cbor:"version"`
+	Schema       any      `cbor:"schema"`
+	Capabilities []string `cbor:"capabilities,omitempty"`
 }
 
 type WorkStartMessage struct {
 	StepID string `cbor:"id"`
 	Config any    `cbor:"config"`
+	// TraceParent is the trace context of the client's span the run belongs to, in the W3C traceparent format. Only
+	// sent with FeatureTraceContext.
+	TraceParent string `cbor:"traceparent,omitempty"`
 }
 
 // All messages that can be contained in a RuntimeMessage struct.
@@ -25,18 +74,31 @@ const (
 	MessageTypeSignal     uint32 = 3
 	MessageTypeClientDone uint32 = 4
 	MessageTypeError      uint32 = 5
+	MessageTypeLog        uint32 = 6 // Since ATP v4.
+	MessageTypeBlobChunk  uint32 = 7 // Since ATP v4, with FeatureBlobStreaming.
+	MessageTypeBlobAck    uint32 = 8 // Since ATP v4, with FeatureBlobStreaming.
+	// Since ATP v4, with FeatureRunStatus.
+	MessageTypeRunStatusRequest  uint32 = 9
+	MessageTypeRunStatusResponse uint32 = 10
+	// Since ATP v4, with FeatureSignalReplies.
+	MessageTypeSignalReply uint32 = 11
 )
 
 type RuntimeMessage struct {
 	MessageID   uint32 `cbor:"id"`
 	RunID       string `cbor:"run_id"`
 	MessageData any    `cbor:"data"`
+	// TraceParent is the trace context of the plugin's span of the run, in the W3C traceparent format. Only sent by
+	// the server with FeatureTraceContext, on the work done, signal and error messages of runs started with a trace
+	// context.
+	TraceParent string `cbor:"traceparent,omitempty"`
 }
 
 type DecodedRuntimeMessage struct {
 	MessageID      uint32          `cbor:"id"`
 	RunID          string          `cbor:"run_id"`
 	RawMessageData cbor.RawMessage `cbor:"data"`
+	TraceParent    string          `cbor:"traceparent,omitempty"`
 }
 
 type WorkDoneMessage struct {
@@ -44,25 +106,98 @@ type WorkDoneMessage struct {
 	OutputID   string `cbor:"output_id"`
 	OutputData any    `cbor:"output_data"`
 	DebugLogs  string `cbor:"debug_logs"`
+	// ResourceUsage holds the resources the plugin process used during the run. Only sent with FeatureResourceUsage.
+	ResourceUsage *ResourceUsage `cbor:"resource_usage,omitempty"`
 }
 
 type SignalMessage struct {
 	SignalID string `cbor:"signal_id"`
 	Data     any    `cbor:"data"`
+	// RequestID asks the server to answer the signal with a SignalReplyMessage with the same request ID, if not zero.
+	// Only sent by the client with FeatureSignalReplies.
+	RequestID uint64 `cbor:"request_id,omitempty"`
 }
 
 func (s SignalMessage) ToInput(runID string) schema.Input {
 	return schema.Input{RunID: runID, ID: s.SignalID, InputData: s.Data}
 }
 
+// SignalReplyMessage answers a signal message with a request ID. It holds either the serialized reply of the signal
+// handler, which is nil if the handler does not reply, or the error the signal failed with.
+type SignalReplyMessage struct {
+	RequestID uint64 `cbor:"request_id"`
+	SignalID  string `cbor:"signal_id"`
+	Data      any    `cbor:"data"`
+	Error     string `cbor:"error,omitempty"`
+}
+
+// LogMessage carries a single log record of a running step. The timestamp is in nanoseconds since the Unix epoch.
+type LogMessage struct {
+	Level     string `cbor:"level"`
+	Timestamp int64  `cbor:"timestamp"`
+	Message   string `cbor:"message"`
+}
+
+// BlobChunkMessage carries the next piece of the named binary stream of a running step. The last message of a stream
+// has EOF set, and may have no data.
+type BlobChunkMessage struct {
+	Stream string `cbor:"stream"`
+	Data   []byte `cbor:"data"`
+	EOF    bool   `cbor:"eof"`
+}
+
+// BlobAckMessage is sent by the client once it has consumed the given number of bytes of a stream. The server only
+// sends as many unacknowledged bytes of a stream as the blob window size allows.
+type BlobAckMessage struct {
+	Stream string `cbor:"stream"`
+	Bytes  int64  `cbor:"bytes"`
+}
+
+// RunStatusRequestMessage asks the server for the status of the run with the ID of the runtime message, or of all runs
+// if the run ID is empty. The server answers with a RunStatusResponseMessage with the same request ID.
+type RunStatusRequestMessage struct {
+	RequestID uint64 `cbor:"request_id"`
+}
+
+// RunStatusResponseMessage holds the status of the runs a RunStatusRequestMessage asked for. Finished and unknown runs
+// are left out.
+type RunStatusResponseMessage struct {
+	RequestID uint64      `cbor:"request_id"`
+	Runs      []RunStatus `cbor:"runs"`
+}
+
+// RunStatus is the status of a run that is not finished yet. The start time is in nanoseconds since the Unix epoch.
+type RunStatus struct {
+	RunID     string   `cbor:"run_id"`
+	StepID    string   `cbor:"step_id"`
+	State     RunState `cbor:"state"`
+	StartTime int64    `cbor:"start_time"`
+	// Status is the serialized status object the step reported last, if the step declares one. See
+	// schema.CallableSchema.WithRunStatus.
+	Status any `cbor:"status,omitempty"`
+}
+
 type clientDoneMessage struct {
 	// Empty for now.
 }
 
+// ErrorMessage reports an error of a run, or of the whole session. The fields after DebugLogs are only sent with
+// FeatureStructuredErrors.
 type ErrorMessage struct {
 	Error       string `cbor:"error"`
 	StepFatal   bool   `cbor:"step_fatal"`
 	ServerFatal bool   `cbor:"server_fatal"`
+	DebugLogs   string `cbor:"debug_logs,omitempty"`
+	// Kind classifies the error.
+	Kind ErrorKind `cbor:"kind,omitempty"`
+	// ConstraintPath is the path to the field that violated a constraint of the schema, see schema.ConstraintError.
+	ConstraintPath []string `cbor:"constraint_path,omitempty"`
+	// ConstraintMessage explains the violated constraint, without the path.
+	ConstraintMessage string `cbor:"constraint_message,omitempty"`
+	// StackTrace is the stack trace of a panic.
+	StackTrace string `cbor:"stack_trace,omitempty"`
+	// Causes holds the messages of the errors the error wraps, outermost first.
+	Causes []string `cbor:"causes,omitempty"`
 }
 
 func (e ErrorMessage) ToString(runID string) string {
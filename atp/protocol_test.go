@@ -1,15 +1,20 @@
 package atp_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/fxamacker/cbor/v2"
 	"go.arcalot.io/assert"
 	"go.arcalot.io/log/v2"
 	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/plugin"
 	"go.flow.arcalot.io/pluginsdk/schema"
 	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -967,3 +972,1259 @@ func newATPServer(
 		cbor.NewEncoder(channel),
 	}
 }
+
+type progressSignal struct {
+	Percent int64 `json:"percent"`
+}
+
+var progressSignalSchema = schema.NewSignalSchema(
+	"progress",
+	schema.NewScopeSchema(
+		schema.NewStructMappedObjectSchema[progressSignal](
+			"Progress",
+			map[string]*schema.PropertySchema{
+				"percent": schema.NewPropertySchema(
+					schema.NewIntSchema(schema.PointerTo[int64](0), schema.PointerTo[int64](100), nil),
+					nil,
+					true,
+					nil,
+					nil,
+					nil,
+					nil,
+					nil,
+				),
+			},
+		),
+	),
+	nil,
+)
+
+func signalEmittingStepHandler(ctx context.Context, _ any, input helloWorldInput) (string, any) {
+	emitter := atp.GetSignalEmitter(ctx)
+	if emitter == nil {
+		panic("no signal emitter in step context")
+	}
+	if err := emitter.EmitSignal("progress", progressSignal{Percent: 50}); err != nil {
+		panic(err)
+	}
+	// Invalid data and undeclared signals must be rejected without sending anything.
+	if err := emitter.EmitSignal("progress", progressSignal{Percent: 200}); err == nil {
+		panic("invalid signal data was not rejected")
+	}
+	if err := emitter.EmitSignal("unknown", progressSignal{Percent: 50}); err == nil {
+		panic("undeclared signal was not rejected")
+	}
+	return helloWorldStepHandler(ctx, nil, input)
+}
+
+var helloWorldOutputSchemas = map[string]*schema.StepOutputSchema{
+	"success": schema.NewStepOutputSchema(
+		schema.NewScopeSchema(
+			schema.NewStructMappedObjectSchema[helloWorldOutput](
+				"Output",
+				map[string]*schema.PropertySchema{
+					"message": schema.NewPropertySchema(
+						schema.NewStringSchema(nil, nil, nil),
+						nil,
+						true,
+						nil,
+						nil,
+						nil,
+						nil,
+						nil,
+					),
+				},
+			),
+		),
+		nil,
+		false,
+	),
+}
+
+var signalEmittingSchema = schema.NewCallableSchema(
+	schema.NewCallableStepWithSignals[any, helloWorldInput](
+		/* id */ "hello-world",
+		/* input */ helloWorldInputSchema,
+		/* outputs */ helloWorldOutputSchemas,
+		/* signal handlers */ nil,
+		/* signal emitters */ map[string]*schema.SignalSchema{
+			"progress": progressSignalSchema,
+		},
+		/* Display */ nil,
+		/* Initializer */ nil,
+		/* step handler */ signalEmittingStepHandler,
+	),
+)
+
+func TestProtocol_Server_EmitSignal(t *testing.T) {
+	// The step emits a signal through the emitter in its context, which the client must receive
+	// before the work done message.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	go func() {
+		defer wg.Done()
+		errors := atp.RunATPServer(
+			ctx,
+			stdinReader,
+			stdoutWriter,
+			signalEmittingSchema,
+		)
+		assert.Equals(t, len(errors), 0)
+	}()
+
+	go func() {
+		defer wg.Done()
+		cli := atp.NewClientWithLogger(channel{
+			Reader:  stdoutReader,
+			Writer:  stdinWriter,
+			Context: nil,
+			cancel:  cancel,
+		}, log.NewTestLogger(t))
+
+		_, err := cli.ReadSchema()
+		assert.NoError(t, err)
+		fromStepChan := make(chan schema.Input)
+		var receivedSignals []schema.Input
+		receiveDone := make(chan struct{})
+		go func() {
+			defer close(receiveDone)
+			for signal := range fromStepChan {
+				receivedSignals = append(receivedSignals, signal)
+			}
+		}()
+
+		result := cli.Execute(
+			schema.Input{
+				RunID:     t.Name(),
+				ID:        "hello-world",
+				InputData: map[string]any{"name": "Arca Lot"},
+			}, nil, fromStepChan)
+		<-receiveDone
+		assert.NoError(t, cli.Close())
+		assert.NoError(t, result.Error)
+		assert.Equals(t, result.OutputID, "success")
+		assert.Equals(t, len(receivedSignals), 1)
+		assert.Equals(t, receivedSignals[0].RunID, t.Name())
+		assert.Equals(t, receivedSignals[0].ID, "progress")
+		assert.Equals(t, receivedSignals[0].InputData.(map[any]any)["percent"], any(uint64(50)))
+	}()
+
+	wg.Wait()
+}
+
+// lockedBufferWriter makes a log.BufferWriter safe for use by the concurrent goroutines of the client.
+type lockedBufferWriter struct {
+	log.BufferWriter
+	lock sync.Mutex
+}
+
+func (w *lockedBufferWriter) Write(message log.Message) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.BufferWriter.Write(message)
+}
+
+func (w *lockedBufferWriter) String() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.BufferWriter.String()
+}
+
+func loggingStepHandler(ctx context.Context, _ any, input helloWorldInput) (string, any) {
+	logger := atp.GetLogger(ctx)
+	for i := 0; i < 3; i++ {
+		logger.Infof("Greeting %s, attempt %d", input.Name, i)
+	}
+	if input.Name == "panic" {
+		panic("step asked to panic")
+	}
+	return helloWorldStepHandler(ctx, nil, input)
+}
+
+var loggingSchema = schema.NewCallableSchema(
+	schema.NewCallableStepWithSignals[any, helloWorldInput](
+		/* id */ "hello-world",
+		/* input */ helloWorldInputSchema,
+		/* outputs */ helloWorldOutputSchemas,
+		/* signal handlers */ nil,
+		/* signal emitters */ nil,
+		/* Display */ nil,
+		/* Initializer */ nil,
+		/* step handler */ loggingStepHandler,
+	),
+)
+
+func TestProtocol_Server_DebugLogs(t *testing.T) {
+	// The logs the step writes to the logger in its context must arrive in the client's logs, both for
+	// successful and failed runs. The limit is set so that only the first two messages fit.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	go func() {
+		defer wg.Done()
+		errors := atp.RunATPServerWithOptions(
+			ctx,
+			stdinReader,
+			stdoutWriter,
+			loggingSchema,
+			atp.ServerOptions{DebugLogLimit: 150},
+		)
+		assert.Equals(t, len(errors), 1)
+	}()
+
+	go func() {
+		defer wg.Done()
+		logBuffer := &lockedBufferWriter{BufferWriter: log.NewBufferWriter()}
+		cli := atp.NewClientWithOptions(channel{
+			Reader:  stdoutReader,
+			Writer:  stdinWriter,
+			Context: nil,
+			cancel:  cancel,
+		}, atp.ClientOptions{
+			Logger:   log.NewLogger(log.LevelDebug, logBuffer),
+			Features: []string{},
+		})
+
+		_, err := cli.ReadSchema()
+		assert.NoError(t, err)
+
+		result := cli.Execute(
+			schema.Input{
+				RunID:     "success-run",
+				ID:        "hello-world",
+				InputData: map[string]any{"name": "Arca Lot"},
+			}, nil, nil)
+		assert.NoError(t, result.Error)
+		result = cli.Execute(
+			schema.Input{
+				RunID:     "panic-run",
+				ID:        "hello-world",
+				InputData: map[string]any{"name": "panic"},
+			}, nil, nil)
+		assert.Error(t, result.Error)
+		assert.NoError(t, cli.Close())
+
+		clientLogs := logBuffer.String()
+		assert.Contains(t, clientLogs, "Step 'success-run' debug: ")
+		assert.Contains(t, clientLogs, "Greeting Arca Lot, attempt 1")
+		assert.Contains(t, clientLogs, "Step 'panic-run' debug: ")
+		assert.Contains(t, clientLogs, "Greeting panic, attempt 1")
+		assert.Equals(t, strings.Contains(clientLogs, "attempt 2"), false)
+		assert.Contains(t, clientLogs, "bytes of debug logs were dropped after reaching the limit of 150 bytes")
+	}()
+
+	wg.Wait()
+}
+
+func TestProtocol_Server_StepLogs(t *testing.T) {
+	// Clients since ATP v4 that ask for log streaming must get the logs the step writes to the logger in its context
+	// while the step is running, both for successful and failed runs.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	go func() {
+		defer wg.Done()
+		errors := atp.RunATPServer(
+			ctx,
+			stdinReader,
+			stdoutWriter,
+			loggingSchema,
+		)
+		assert.Equals(t, len(errors), 1)
+	}()
+
+	go func() {
+		defer wg.Done()
+		logBuffer := &lockedBufferWriter{BufferWriter: log.NewBufferWriter()}
+		cli := atp.NewClientWithLogStreaming(channel{
+			Reader:  stdoutReader,
+			Writer:  stdinWriter,
+			Context: nil,
+			cancel:  cancel,
+		}, log.NewLogger(log.LevelDebug, logBuffer))
+
+		_, err := cli.ReadSchema()
+		assert.NoError(t, err)
+
+		result := cli.Execute(
+			schema.Input{
+				RunID:     "success-run",
+				ID:        "hello-world",
+				InputData: map[string]any{"name": "Arca Lot"},
+			}, nil, nil)
+		assert.NoError(t, result.Error)
+		result = cli.Execute(
+			schema.Input{
+				RunID:     "panic-run",
+				ID:        "hello-world",
+				InputData: map[string]any{"name": "panic"},
+			}, nil, nil)
+		assert.Error(t, result.Error)
+		assert.NoError(t, cli.Close())
+
+		clientLogs := logBuffer.String()
+		assert.Contains(t, clientLogs, "info\trun_id=success-run\tGreeting Arca Lot, attempt 2")
+		assert.Contains(t, clientLogs, "info\trun_id=panic-run\tGreeting panic, attempt 2")
+		// Streamed logs must not be sent again with the debug logs.
+		assert.Equals(t, strings.Contains(clientLogs, "debug: "), false)
+	}()
+
+	wg.Wait()
+}
+
+func newCancellableSchema(release <-chan struct{}) *schema.CallableSchema {
+	return plugin.WithCancellation(schema.NewCallableSchema(
+		schema.NewCallableStepWithSignals[any, helloWorldInput](
+			/* id */ "hello-world",
+			/* input */ helloWorldInputSchema,
+			/* outputs */ helloWorldOutputSchemas,
+			/* signal handlers */ nil,
+			/* signal emitters */ nil,
+			/* Display */ nil,
+			/* Initializer */ nil,
+			/* step handler */ func(ctx context.Context, _ any, input helloWorldInput) (string, any) {
+				if input.Name == "stubborn" {
+					// Ignores the cancellation.
+					<-release
+				} else {
+					<-ctx.Done()
+				}
+				return helloWorldStepHandler(ctx, nil, input)
+			},
+		),
+	))
+}
+
+func TestProtocol_Server_Cancellation(t *testing.T) {
+	// The cancel signal must cancel the context of the step. A step that ignores it must fail once the grace
+	// period is over.
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	go func() {
+		defer wg.Done()
+		errors := atp.RunATPServer(
+			ctx,
+			stdinReader,
+			stdoutWriter,
+			newCancellableSchema(release),
+		)
+		assert.Equals(t, len(errors), 1)
+	}()
+
+	go func() {
+		defer wg.Done()
+		cli := atp.NewClientWithLogger(channel{
+			Reader:  stdoutReader,
+			Writer:  stdinWriter,
+			Context: nil,
+			cancel:  cancel,
+		}, log.NewTestLogger(t))
+
+		pluginSchema, err := cli.ReadSchema()
+		assert.NoError(t, err)
+		_, hasCancelHandler := pluginSchema.Steps()["hello-world"].SignalHandlers()[plugin.CancellationSignalSchema.ID()]
+		assert.Equals(t, hasCancelHandler, true)
+
+		for name, gracePeriod := range map[string]int64{"Arca Lot": 0, "stubborn": int64(time.Millisecond)} {
+			runID := t.Name() + "_" + name
+			toStepChan := make(chan schema.Input)
+			go func() {
+				// Give the work start message time to arrive first.
+				time.Sleep(10 * time.Millisecond)
+				toStepChan <- schema.Input{
+					RunID:     runID,
+					ID:        plugin.CancellationSignalSchema.ID(),
+					InputData: map[string]any{"grace_period": gracePeriod},
+				}
+				close(toStepChan)
+			}()
+			result := cli.Execute(
+				schema.Input{
+					RunID:     runID,
+					ID:        "hello-world",
+					InputData: map[string]any{"name": name},
+				}, toStepChan, nil)
+			if gracePeriod == 0 {
+				assert.NoError(t, result.Error)
+				assert.Equals(t, result.OutputID, "success")
+			} else {
+				assert.Error(t, result.Error)
+				assert.Contains(t, result.Error.Error(), "grace period")
+			}
+		}
+		assert.NoError(t, cli.Close())
+	}()
+
+	wg.Wait()
+}
+
+func TestProtocol_Server_MaxConcurrentRuns(t *testing.T) {
+	// With a limit of one concurrent run, a second run started while the first one is running must be rejected,
+	// unless queueing is enabled.
+	for _, queueRuns := range []bool{false, true} {
+		t.Run(fmt.Sprintf("queue=%t", queueRuns), func(t *testing.T) {
+			testMaxConcurrentRuns(t, queueRuns)
+		})
+	}
+}
+
+func testMaxConcurrentRuns(t *testing.T, queueRuns bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	running := 0
+	maxRunning := 0
+	lock := sync.Mutex{}
+	blockingSchema := schema.NewCallableSchema(
+		schema.NewCallableStep[helloWorldInput](
+			"hello-world",
+			helloWorldInputSchema,
+			helloWorldOutputSchemas,
+			nil,
+			func(ctx context.Context, input helloWorldInput) (string, any) {
+				lock.Lock()
+				running++
+				maxRunning = max(maxRunning, running)
+				lock.Unlock()
+				started <- struct{}{}
+				<-release
+				lock.Lock()
+				running--
+				lock.Unlock()
+				return helloWorldStepHandler(ctx, nil, input)
+			},
+		),
+	)
+	var reportedErrors []atp.ServerError
+
+	go func() {
+		defer wg.Done()
+		errors := atp.RunATPServerWithOptions(
+			ctx,
+			stdinReader,
+			stdoutWriter,
+			blockingSchema,
+			atp.ServerOptions{
+				MaxConcurrentRuns: 1,
+				QueueRuns:         queueRuns,
+				OnError: func(err atp.ServerError) {
+					reportedErrors = append(reportedErrors, err)
+				},
+			},
+		)
+		assert.Equals(t, len(errors), len(reportedErrors))
+	}()
+
+	go func() {
+		defer wg.Done()
+		cli := atp.NewClientWithLogger(channel{
+			Reader:  stdoutReader,
+			Writer:  stdinWriter,
+			Context: nil,
+			cancel:  cancel,
+		}, log.NewTestLogger(t))
+		_, err := cli.ReadSchema()
+		assert.NoError(t, err)
+
+		results := make(chan atp.ExecutionResult, 2)
+		for _, name := range []string{"a", "b"} {
+			go func() {
+				results <- cli.Execute(
+					schema.Input{
+						RunID:     t.Name() + "_" + name,
+						ID:        "hello-world",
+						InputData: map[string]any{"name": name},
+					}, nil, nil)
+			}()
+			if name == "a" {
+				<-started
+			}
+		}
+		successfulRuns := 2
+		if !queueRuns {
+			rejected := <-results
+			assert.Error(t, rejected.Error)
+			assert.Contains(t, rejected.Error.Error(), "maximum number of concurrent runs")
+			successfulRuns = 1
+		}
+		close(release)
+		for i := 0; i < successfulRuns; i++ {
+			assert.NoError(t, (<-results).Error)
+		}
+		assert.NoError(t, cli.Close())
+	}()
+
+	wg.Wait()
+	assert.Equals(t, maxRunning, 1)
+	if queueRuns {
+		assert.Equals(t, len(reportedErrors), 0)
+	} else {
+		assert.Equals(t, len(reportedErrors), 1)
+	}
+}
+
+func TestProtocol_Server_MaxQueuedRuns(t *testing.T) {
+	// Queued runs must start in the order they were received, and runs exceeding the queue must be rejected.
+	release := make(chan struct{})
+	started := make(chan string, 3)
+	blockingSchema := schema.NewCallableSchema(
+		schema.NewCallableStep[helloWorldInput](
+			"hello-world",
+			helloWorldInputSchema,
+			helloWorldOutputSchemas,
+			nil,
+			func(ctx context.Context, input helloWorldInput) (string, any) {
+				started <- input.Name
+				<-release
+				return helloWorldStepHandler(ctx, nil, input)
+			},
+		),
+	)
+	cli := atp.NewInProcessClientWithOptions(
+		blockingSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{MaxConcurrentRuns: 1, QueueRuns: true, MaxQueuedRuns: 2},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	var handles []atp.RunHandle
+	for _, name := range []string{"a", "b", "c", "d"} {
+		handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+			RunID:     t.Name() + "_" + name,
+			ID:        "hello-world",
+			InputData: map[string]any{"name": name},
+		})
+		assert.NoError(t, err)
+		handles = append(handles, handle)
+		if name == "a" {
+			assert.Equals(t, <-started, "a")
+		}
+	}
+	// The run that does not fit in the queue fails right away.
+	rejected := handles[3].Wait()
+	assert.Error(t, rejected.Error)
+	assert.Contains(t, rejected.Error.Error(), "run queue is full")
+
+	close(release)
+	assert.Equals(t, <-started, "b")
+	assert.Equals(t, <-started, "c")
+	for _, handle := range handles[:3] {
+		assert.NoError(t, handle.Wait().Error)
+	}
+	// The plugin reports the rejected run when closing.
+	err = cli.Close()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "run queue is full")
+}
+
+func TestProtocol_Server_CancelQueuedRun(t *testing.T) {
+	// A cancellation for a queued run must fail it right away. It used to be kept only for a limited time until the
+	// step started, so a run that stayed queued for longer than that ran as if it had never been cancelled.
+	release := make(chan struct{})
+	started := make(chan string, 2)
+	blockingSchema := plugin.WithCancellation(schema.NewCallableSchema(
+		schema.NewCallableStep[helloWorldInput](
+			"hello-world",
+			helloWorldInputSchema,
+			helloWorldOutputSchemas,
+			nil,
+			func(ctx context.Context, input helloWorldInput) (string, any) {
+				started <- input.Name
+				<-release
+				return helloWorldStepHandler(ctx, nil, input)
+			},
+		),
+	))
+	cli := atp.NewInProcessClientWithOptions(
+		blockingSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{MaxConcurrentRuns: 1, QueueRuns: true},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	var handles []atp.RunHandle
+	for _, name := range []string{"a", "b"} {
+		handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+			RunID:     t.Name() + "_" + name,
+			ID:        "hello-world",
+			InputData: map[string]any{"name": name},
+		})
+		assert.NoError(t, err)
+		handles = append(handles, handle)
+	}
+	assert.Equals(t, <-started, "a")
+	assert.NoError(t, handles[1].SendSignal(plugin.CancellationSignalSchema.ID(), map[string]any{}))
+
+	// The queued run fails while the run ahead of it is still running.
+	result := handles[1].Wait()
+	assert.Error(t, result.Error)
+	var cancelledError schema.StepCancelledError
+	assert.Equals(t, errors.As(result.Error, &cancelledError), true)
+
+	close(release)
+	assert.NoError(t, handles[0].Wait().Error)
+	// The plugin reports the cancelled run when closing.
+	err = cli.Close()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cancelled before its step was started")
+	select {
+	case name := <-started:
+		t.Fatalf("the step of the cancelled run %q was started", name)
+	default:
+	}
+}
+
+func TestProtocol_Server_DuplicateRunID(t *testing.T) {
+	// A work start message for a run ID that is in use must be rejected without affecting the run using it.
+	release := make(chan struct{})
+	started := make(chan string, 2)
+	blockingSchema := schema.NewCallableSchema(
+		schema.NewCallableStep[helloWorldInput](
+			"hello-world",
+			helloWorldInputSchema,
+			helloWorldOutputSchemas,
+			nil,
+			func(ctx context.Context, input helloWorldInput) (string, any) {
+				started <- input.Name
+				<-release
+				return helloWorldStepHandler(ctx, nil, input)
+			},
+		),
+	)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	serverErrors := make(chan []*atp.ServerError, 1)
+	go func() {
+		serverErrors <- atp.RunATPServer(context.Background(), stdinReader, stdoutWriter, blockingSchema)
+	}()
+	toServer := cbor.NewEncoder(stdinWriter)
+	fromServer := cbor.NewDecoder(stdoutReader)
+
+	assert.NoError(t, toServer.Encode(nil))
+	var hello atp.HelloMessage
+	assert.NoError(t, fromServer.Decode(&hello))
+	for _, name := range []string{"first", "second"} {
+		assert.NoError(t, toServer.Encode(atp.RuntimeMessage{
+			MessageID: atp.MessageTypeWorkStart,
+			RunID:     t.Name(),
+			MessageData: atp.WorkStartMessage{
+				StepID: "hello-world",
+				Config: map[string]any{"name": name},
+			},
+		}))
+		if name == "first" {
+			assert.Equals(t, <-started, "first")
+		}
+	}
+	var runtimeMessage atp.DecodedRuntimeMessage
+	assert.NoError(t, fromServer.Decode(&runtimeMessage))
+	assert.Equals(t, runtimeMessage.MessageID, atp.MessageTypeError)
+	var errorMessage atp.ErrorMessage
+	assert.NoError(t, cbor.Unmarshal(runtimeMessage.RawMessageData, &errorMessage))
+	assert.Contains(t, errorMessage.Error, "already in use")
+	assert.Equals(t, errorMessage.StepFatal, false)
+
+	close(release)
+	assert.NoError(t, fromServer.Decode(&runtimeMessage))
+	assert.Equals(t, runtimeMessage.MessageID, atp.MessageTypeWorkDone)
+	var workDone atp.WorkDoneMessage
+	assert.NoError(t, cbor.Unmarshal(runtimeMessage.RawMessageData, &workDone))
+	assert.Equals(t, workDone.OutputData.(map[any]any)["message"].(string), "Hello, first!")
+	assert.NoError(t, toServer.Encode(atp.RuntimeMessage{
+		MessageID:   atp.MessageTypeClientDone,
+		RunID:       "",
+		MessageData: nil,
+	}))
+	assert.Equals(t, len(<-serverErrors), 1)
+	assert.Equals(t, len(started), 0)
+}
+
+// pausingWriter blocks the writes started while it is armed after writing, until the gate is closed.
+type pausingWriter struct {
+	io.WriteCloser
+	armed atomic.Bool
+	gate  chan struct{}
+}
+
+func (w *pausingWriter) Write(p []byte) (int, error) {
+	paused := w.armed.Load()
+	n, err := w.WriteCloser.Write(p)
+	if paused {
+		<-w.gate
+	}
+	return n, err
+}
+
+func TestProtocol_Server_MaxConcurrentRuns_NextRunAfterWorkDone(t *testing.T) {
+	// A run started as soon as the result of the previous one arrived must not count that one against the limit,
+	// even if the server did not finish sending the result yet.
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	stdout := &pausingWriter{WriteCloser: stdoutWriter, gate: make(chan struct{})}
+	serverErrors := make(chan []*atp.ServerError, 1)
+	go func() {
+		serverErrors <- atp.RunATPServerWithOptions(
+			context.Background(),
+			stdinReader,
+			stdout,
+			helloWorldSchema,
+			atp.ServerOptions{MaxConcurrentRuns: 1},
+		)
+	}()
+	toServer := cbor.NewEncoder(stdinWriter)
+	fromServer := cbor.NewDecoder(stdoutReader)
+
+	assert.NoError(t, toServer.Encode(nil))
+	var hello atp.HelloMessage
+	assert.NoError(t, fromServer.Decode(&hello))
+	stdout.armed.Store(true)
+	for _, name := range []string{"a", "b"} {
+		assert.NoError(t, toServer.Encode(atp.RuntimeMessage{
+			MessageID: atp.MessageTypeWorkStart,
+			RunID:     t.Name() + "_" + name,
+			MessageData: atp.WorkStartMessage{
+				StepID: "hello-world",
+				Config: map[string]any{"name": name},
+			},
+		}))
+		var runtimeMessage atp.DecodedRuntimeMessage
+		assert.NoError(t, fromServer.Decode(&runtimeMessage))
+		assert.Equals(t, runtimeMessage.RunID, t.Name()+"_"+name)
+		assert.Equals(t, runtimeMessage.MessageID, atp.MessageTypeWorkDone)
+		if name == "a" {
+			// The server is still sending the result of the first run. Give it time to handle the second run, then
+			// let it go on.
+			time.Sleep(50 * time.Millisecond)
+			stdout.armed.Store(false)
+			close(stdout.gate)
+		}
+	}
+	assert.NoError(t, toServer.Encode(atp.RuntimeMessage{
+		MessageID:   atp.MessageTypeClientDone,
+		RunID:       "",
+		MessageData: nil,
+	}))
+	assert.Equals(t, len(<-serverErrors), 0)
+}
+
+func TestProtocol_Client_Start(t *testing.T) {
+	// Starts a run asynchronously and receives the signals the step emits through the run handle.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	go func() {
+		defer wg.Done()
+		errors := atp.RunATPServer(
+			ctx,
+			stdinReader,
+			stdoutWriter,
+			signalEmittingSchema,
+		)
+		assert.Equals(t, len(errors), 0)
+	}()
+
+	go func() {
+		defer wg.Done()
+		cli := atp.NewClientWithLogger(channel{
+			Reader:  stdoutReader,
+			Writer:  stdinWriter,
+			Context: nil,
+			cancel:  cancel,
+		}, log.NewTestLogger(t))
+
+		_, err := cli.ReadSchema()
+		assert.NoError(t, err)
+
+		handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+			RunID:     t.Name(),
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		})
+		assert.NoError(t, err)
+		var receivedSignals []schema.Input
+		for signal := range handle.Signals() {
+			receivedSignals = append(receivedSignals, signal)
+		}
+		result := handle.Wait()
+		assert.NoError(t, result.Error)
+		assert.Equals(t, result.OutputID, "success")
+		assert.Equals(t, result.OutputData.(map[any]any)["message"].(string), "Hello, Arca Lot!")
+		assert.Equals(t, len(receivedSignals), 1)
+		assert.Equals(t, receivedSignals[0].ID, "progress")
+		assert.Error(t, handle.SendSignal("hello-world-signal", map[string]any{"name": "Arca Lot"}))
+
+		_, err = cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+			RunID:     "",
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		})
+		assert.Error(t, err)
+		assert.NoError(t, cli.Close())
+	}()
+
+	wg.Wait()
+}
+
+func TestProtocol_Client_Start_Cancel(t *testing.T) {
+	// Cancelling the context of a run must send the cancel signal to the step. A step that handles it finishes
+	// normally, while a step that ignores it fails once the cancel timeout is over.
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	go func() {
+		defer wg.Done()
+		errors := atp.RunATPServer(
+			ctx,
+			stdinReader,
+			stdoutWriter,
+			newCancellableSchema(release),
+		)
+		assert.Equals(t, len(errors), 0)
+	}()
+
+	go func() {
+		defer wg.Done()
+		cli := atp.NewClientWithOptions(channel{
+			Reader:  stdoutReader,
+			Writer:  stdinWriter,
+			Context: nil,
+			cancel:  cancel,
+		}, atp.ClientOptions{
+			Logger:        log.NewTestLogger(t),
+			CancelTimeout: 50 * time.Millisecond,
+		})
+
+		_, err := cli.ReadSchema()
+		assert.NoError(t, err)
+
+		runCtx, cancelRun := context.WithCancel(context.Background())
+		handle, err := cli.(atp.RunStarter).Start(runCtx, schema.Input{
+			RunID:     t.Name() + "_cooperative",
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		})
+		assert.NoError(t, err)
+		cancelRun()
+		result := handle.Wait()
+		assert.NoError(t, result.Error)
+		assert.Equals(t, result.OutputID, "success")
+
+		handle, err = cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+			RunID:     t.Name() + "_stubborn",
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "stubborn"},
+		})
+		assert.NoError(t, err)
+		handle.Cancel()
+		result = handle.Wait()
+		assert.Error(t, result.Error)
+		assert.Equals(t, errors.Is(result.Error, context.Canceled), true)
+		// Let the step finish, so the plugin sends the result the client has to ignore.
+		close(release)
+		assert.NoError(t, cli.Close())
+	}()
+
+	wg.Wait()
+}
+
+func TestProtocol_Server_VersionNegotiation(t *testing.T) {
+	// The server must choose the highest common version, and enable only the known features the version supports.
+	testCases := map[string]struct {
+		startMessage         any
+		expectedVersion      int64
+		expectedCapabilities []string
+	}{
+		"legacy": {
+			nil,
+			3,
+			nil,
+		},
+		"v3": {
+			atp.StartMessage{Versions: []int64{1, 3}, Features: []string{atp.FeatureLogStreaming}},
+			3,
+			nil,
+		},
+		"v4": {
+			atp.StartMessage{Versions: []int64{3, 4, 5}, Features: []string{atp.FeatureLogStreaming, "unknown"}},
+			4,
+			[]string{atp.FeatureLogStreaming},
+		},
+		"v4-no-features": {
+			atp.StartMessage{Versions: []int64{4}},
+			4,
+			nil,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			stdinReader, stdinWriter := io.Pipe()
+			stdoutReader, stdoutWriter := io.Pipe()
+			serverErrors := make(chan []*atp.ServerError, 1)
+			go func() {
+				serverErrors <- atp.RunATPServer(context.Background(), stdinReader, stdoutWriter, helloWorldSchema)
+			}()
+			toServer := cbor.NewEncoder(stdinWriter)
+			fromServer := cbor.NewDecoder(stdoutReader)
+
+			assert.NoError(t, toServer.Encode(testCase.startMessage))
+			var hello atp.HelloMessage
+			assert.NoError(t, fromServer.Decode(&hello))
+			assert.Equals(t, hello.Version, testCase.expectedVersion)
+			assert.Equals(t, hello.Capabilities, testCase.expectedCapabilities)
+			assert.NoError(t, toServer.Encode(atp.RuntimeMessage{
+				MessageID:   atp.MessageTypeClientDone,
+				RunID:       "",
+				MessageData: nil,
+			}))
+			assert.Equals(t, len(<-serverErrors), 0)
+		})
+	}
+}
+
+func TestProtocol_Server_LegacyClientLogs(t *testing.T) {
+	// Clients before ATP v4 do not know the log message, so the logs of the step must only arrive with the debug logs
+	// of the work done message.
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	serverErrors := make(chan []*atp.ServerError, 1)
+	go func() {
+		serverErrors <- atp.RunATPServer(context.Background(), stdinReader, stdoutWriter, loggingSchema)
+	}()
+	toServer := cbor.NewEncoder(stdinWriter)
+	fromServer := cbor.NewDecoder(stdoutReader)
+
+	assert.NoError(t, toServer.Encode(nil))
+	var hello atp.HelloMessage
+	assert.NoError(t, fromServer.Decode(&hello))
+	assert.Equals(t, hello.Version, 3)
+	assert.NoError(t, toServer.Encode(atp.RuntimeMessage{
+		MessageID: atp.MessageTypeWorkStart,
+		RunID:     t.Name(),
+		MessageData: atp.WorkStartMessage{
+			StepID: "hello-world",
+			Config: map[string]any{"name": "Arca Lot"},
+		},
+	}))
+	var runtimeMessage atp.DecodedRuntimeMessage
+	assert.NoError(t, fromServer.Decode(&runtimeMessage))
+	assert.Equals(t, runtimeMessage.MessageID, atp.MessageTypeWorkDone)
+	var workDone atp.WorkDoneMessage
+	assert.NoError(t, cbor.Unmarshal(runtimeMessage.RawMessageData, &workDone))
+	assert.Contains(t, workDone.DebugLogs, "Greeting Arca Lot, attempt 2")
+	assert.NoError(t, toServer.Encode(atp.RuntimeMessage{
+		MessageID:   atp.MessageTypeClientDone,
+		RunID:       "",
+		MessageData: nil,
+	}))
+	assert.Equals(t, len(<-serverErrors), 0)
+}
+
+func TestProtocol_Server_VersionNegotiation_NoCommonVersion(t *testing.T) {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	serverErrors := make(chan []*atp.ServerError, 1)
+	go func() {
+		serverErrors <- atp.RunATPServer(context.Background(), stdinReader, stdoutWriter, helloWorldSchema)
+	}()
+	toServer := cbor.NewEncoder(stdinWriter)
+	fromServer := cbor.NewDecoder(stdoutReader)
+
+	assert.NoError(t, toServer.Encode(atp.StartMessage{Versions: []int64{99}}))
+	var hello atp.HelloMessage
+	assert.NoError(t, fromServer.Decode(&hello))
+	assert.Equals(t, hello.Version, atp.ProtocolVersion)
+	// The server reports the fatal error after the hello message.
+	var errorMessage atp.RuntimeMessage
+	assert.NoError(t, fromServer.Decode(&errorMessage))
+	assert.Equals(t, errorMessage.MessageID, atp.MessageTypeError)
+	errors := <-serverErrors
+	assert.Equals(t, len(errors), 1)
+	assert.Equals(t, errors[0].ServerFatal, true)
+	assert.Contains(t, errors[0].Err.Error(), "no common ATP version")
+}
+
+// blobSize is larger than a blob chunk, so the blob is sent in multiple chunks.
+const blobSize = 200 * 1024
+
+func blobStepHandler(ctx context.Context, _ any, input helloWorldInput) (string, any) {
+	artifact, err := atp.OpenBlobStream(ctx, "artifact")
+	if err != nil {
+		return "success", helloWorldOutput{Message: err.Error()}
+	}
+	if _, err := artifact.Write(bytes.Repeat([]byte(input.Name), blobSize/len(input.Name))); err != nil {
+		panic(err)
+	}
+	if err := artifact.Close(); err != nil {
+		panic(err)
+	}
+	if _, err := artifact.Write([]byte(input.Name)); err == nil {
+		panic("write to closed blob stream was not rejected")
+	}
+	// This stream is left open, so it must be closed when the step returns.
+	unclosed, err := atp.OpenBlobStream(ctx, "unclosed")
+	if err != nil {
+		panic(err)
+	}
+	if _, err := unclosed.Write([]byte(input.Name)); err != nil {
+		panic(err)
+	}
+	return helloWorldStepHandler(ctx, nil, input)
+}
+
+var blobSchema = schema.NewCallableSchema(
+	schema.NewCallableStepWithSignals[any, helloWorldInput](
+		/* id */ "hello-world",
+		/* input */ helloWorldInputSchema,
+		/* outputs */ helloWorldOutputSchemas,
+		/* signal handlers */ nil,
+		/* signal emitters */ nil,
+		/* Display */ nil,
+		/* Initializer */ nil,
+		/* step handler */ blobStepHandler,
+	),
+)
+
+func TestProtocol_Blobs(t *testing.T) {
+	// The step must not get further ahead of the reader than the blob window size.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	go func() {
+		defer wg.Done()
+		errors := atp.RunATPServerWithOptions(
+			ctx,
+			stdinReader,
+			stdoutWriter,
+			blobSchema,
+			atp.ServerOptions{BlobWindowSize: 4096},
+		)
+		assert.Equals(t, len(errors), 0)
+	}()
+
+	go func() {
+		defer wg.Done()
+		cli := atp.NewClientWithLogger(channel{
+			Reader:  stdoutReader,
+			Writer:  stdinWriter,
+			Context: nil,
+			cancel:  cancel,
+		}, log.NewTestLogger(t))
+
+		_, err := cli.ReadSchema()
+		assert.NoError(t, err)
+
+		handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+			RunID:     t.Name(),
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		})
+		assert.NoError(t, err)
+		results := make(chan atp.ExecutionResult, 1)
+		go func() {
+			results <- handle.Wait()
+		}()
+
+		artifact := <-handle.Blobs()
+		assert.Equals(t, artifact.Name(), "artifact")
+		select {
+		case <-results:
+			t.Errorf("step finished before its blob stream was read")
+		case <-time.After(50 * time.Millisecond):
+		}
+		artifactData, err := io.ReadAll(artifact)
+		assert.NoError(t, err)
+		assert.Equals(t, len(artifactData), blobSize)
+		assert.Equals(t, string(artifactData[:len("Arca Lot")]), "Arca Lot")
+
+		unclosed := <-handle.Blobs()
+		assert.Equals(t, unclosed.Name(), "unclosed")
+		unclosedData, err := io.ReadAll(unclosed)
+		assert.NoError(t, err)
+		assert.Equals(t, string(unclosedData), "Arca Lot")
+		assert.NoError(t, unclosed.Close())
+
+		result := <-results
+		assert.NoError(t, result.Error)
+		assert.Equals(t, result.OutputData.(map[any]any)["message"].(string), "Hello, Arca Lot!")
+		_, open := <-handle.Blobs()
+		assert.Equals(t, open, false)
+		assert.NoError(t, cli.Close())
+	}()
+
+	wg.Wait()
+}
+
+func TestProtocol_Blobs_Cancelled(t *testing.T) {
+	// A write waiting for the client to read the stream must fail once the step is cancelled.
+	cancellableBlobSchema := plugin.WithCancellation(schema.NewCallableSchema(
+		schema.NewCallableStep[helloWorldInput](
+			"hello-world",
+			helloWorldInputSchema,
+			helloWorldOutputSchemas,
+			nil,
+			func(ctx context.Context, input helloWorldInput) (string, any) {
+				artifact, err := atp.OpenBlobStream(ctx, "artifact")
+				if err != nil {
+					panic(err)
+				}
+				_, err = artifact.Write(make([]byte, blobSize))
+				return "success", helloWorldOutput{Message: fmt.Sprintf("write failed: %v", err)}
+			},
+		),
+	))
+	cli := atp.NewInProcessClientWithOptions(
+		cancellableBlobSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{BlobWindowSize: 4096},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+	// The stream is never read, so the step waits for the client.
+	artifact := <-handle.Blobs()
+	assert.Equals(t, artifact.Name(), "artifact")
+	handle.Cancel()
+	result := handle.Wait()
+	assert.NoError(t, result.Error)
+	assert.Contains(t, result.OutputData.(map[any]any)["message"].(string), context.Canceled.Error())
+	assert.NoError(t, cli.Close())
+}
+
+func TestProtocol_Blobs_Unread(t *testing.T) {
+	// The run must fail instead of blocking the client if the blob streams it opens are not read.
+	manyBlobsSchema := schema.NewCallableSchema(
+		schema.NewCallableStep[helloWorldInput](
+			"hello-world",
+			helloWorldInputSchema,
+			helloWorldOutputSchemas,
+			nil,
+			func(ctx context.Context, input helloWorldInput) (string, any) {
+				for i := 0; i < 20; i++ {
+					stream, err := atp.OpenBlobStream(ctx, fmt.Sprintf("stream-%d", i))
+					if err != nil {
+						panic(err)
+					}
+					if _, err := stream.Write([]byte(input.Name)); err != nil {
+						panic(err)
+					}
+				}
+				return helloWorldStepHandler(ctx, nil, input)
+			},
+		),
+	)
+	cli := atp.NewInProcessClientWithOptions(
+		manyBlobsSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+	result := handle.Wait()
+	assert.Error(t, result.Error)
+	assert.Contains(t, result.Error.Error(), "were not read")
+	// The client keeps working for other runs.
+	result = cli.Execute(schema.Input{
+		RunID:     t.Name() + "_execute",
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.NoError(t, cli.Close())
+}
+
+func TestProtocol_Blobs_Unsupported(t *testing.T) {
+	_, err := atp.OpenBlobStream(context.Background(), "artifact")
+	assert.Error(t, err)
+
+	// Blob streams cannot be opened if the client did not enable the feature.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	go func() {
+		defer wg.Done()
+		errors := atp.RunATPServer(ctx, stdinReader, stdoutWriter, blobSchema)
+		assert.Equals(t, len(errors), 0)
+	}()
+
+	go func() {
+		defer wg.Done()
+		cli := atp.NewClientWithOptions(channel{
+			Reader:  stdoutReader,
+			Writer:  stdinWriter,
+			Context: nil,
+			cancel:  cancel,
+		}, atp.ClientOptions{
+			Logger:   log.NewTestLogger(t),
+			Features: []string{atp.FeatureLogStreaming},
+		})
+
+		_, err := cli.ReadSchema()
+		assert.NoError(t, err)
+
+		handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+			RunID:     t.Name(),
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		})
+		assert.NoError(t, err)
+		result := handle.Wait()
+		assert.NoError(t, result.Error)
+		assert.Contains(t, result.OutputData.(map[any]any)["message"].(string), "does not support blob streaming")
+		assert.NoError(t, cli.Close())
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,126 @@
+package atp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"io"
+	"sync"
+	"time"
+)
+
+// Senders of recorded frames.
+const (
+	SenderClient = "client"
+	SenderServer = "server"
+)
+
+// RecordedFrame is a single CBOR message of a recorded ATP session.
+type RecordedFrame struct {
+	// Timestamp is the time the frame was complete, in nanoseconds since the Unix epoch.
+	Timestamp int64 `cbor:"timestamp"`
+	// Sender is either SenderClient or SenderServer.
+	Sender string `cbor:"sender"`
+	// Data holds the encoded CBOR message. Data that is not valid CBOR is recorded as it is.
+	Data []byte `cbor:"data"`
+}
+
+// NewRecordingChannel wraps a client channel so that every CBOR message sent and received through it is written to
+// the recording as a RecordedFrame. Errors writing the recording do not affect the session, and are returned when
+// the channel is closed.
+func NewRecordingChannel(channel ClientChannel, recording io.Writer) ClientChannel {
+	return &recordingChannel{
+		channel:  channel,
+		recorder: cbor.NewEncoder(recording),
+	}
+}
+
+// ReadRecording reads the frames a recording channel wrote.
+func ReadRecording(recording io.Reader) ([]RecordedFrame, error) {
+	decoder := cbor.NewDecoder(recording)
+	var frames []RecordedFrame
+	for {
+		var frame RecordedFrame
+		if err := decoder.Decode(&frame); err != nil {
+			if errors.Is(err, io.EOF) {
+				return frames, nil
+			}
+			return frames, fmt.Errorf("failed to read frame %d of the recording (%w)", len(frames), err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+type recordingChannel struct {
+	channel     ClientChannel
+	lock        sync.Mutex
+	recorder    *cbor.Encoder
+	recordErr   error
+	sentData    []byte // Data sent by the client that is not a complete frame yet.
+	receiveData []byte // Data received from the server that is not a complete frame yet.
+}
+
+func (r *recordingChannel) Read(p []byte) (int, error) {
+	n, err := r.channel.Read(p)
+	if n > 0 {
+		r.record(SenderServer, &r.receiveData, p[:n])
+	}
+	return n, err
+}
+
+func (r *recordingChannel) Write(p []byte) (int, error) {
+	n, err := r.channel.Write(p)
+	if n > 0 {
+		r.record(SenderClient, &r.sentData, p[:n])
+	}
+	return n, err
+}
+
+func (r *recordingChannel) Close() error {
+	err := r.channel.Close()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.recordErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to record ATP session (%w)", r.recordErr))
+	}
+	return err
+}
+
+// record adds the data to the pending data of the sender, and writes all frames that are complete.
+func (r *recordingChannel) record(sender string, pending *[]byte, data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	*pending = append(*pending, data...)
+	for _, frame := range splitFrames(pending) {
+		if r.recordErr != nil {
+			return
+		}
+		r.recordErr = r.recorder.Encode(RecordedFrame{
+			Timestamp: time.Now().UnixNano(),
+			Sender:    sender,
+			Data:      frame,
+		})
+	}
+}
+
+// splitFrames removes the complete CBOR messages from the start of the data and returns them. Data that is not valid
+// CBOR is returned as a single frame, as it cannot be split.
+func splitFrames(data *[]byte) [][]byte {
+	var frames [][]byte
+	for len(*data) > 0 {
+		var raw cbor.RawMessage
+		rest, err := cbor.UnmarshalFirst(*data, &raw)
+		switch {
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			// Wait for the rest of the message.
+			return frames
+		case err != nil:
+			frames = append(frames, *data)
+			*data = nil
+		default:
+			frames = append(frames, raw)
+			*data = rest
+		}
+	}
+	return frames
+}
@@ -0,0 +1,247 @@
+package atp_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordSession records a session of a client running the hello world step.
+func recordSession(t *testing.T) []atp.RecordedFrame {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	go func() {
+		defer wg.Done()
+		errors := atp.RunATPServer(ctx, stdinReader, stdoutWriter, helloWorldSchema)
+		assert.Equals(t, len(errors), 0)
+	}()
+
+	recording := &bytes.Buffer{}
+	recordingChannel := atp.NewRecordingChannel(channel{
+		Reader:  stdoutReader,
+		Writer:  stdinWriter,
+		Context: nil,
+		cancel:  cancel,
+	}, recording)
+	runHelloWorld(t, atp.NewClientWithLogger(recordingChannel, log.NewTestLogger(t)), "Arca Lot")
+	wg.Wait()
+	assert.NoError(t, recordingChannel.Close())
+
+	frames, err := atp.ReadRecording(recording)
+	assert.NoError(t, err)
+	return frames
+}
+
+func runHelloWorld(t *testing.T, cli atp.Client, name string) {
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(
+		schema.Input{
+			RunID:     "recorded-run",
+			ID:        "hello-world",
+			InputData: map[string]any{"name": name},
+		}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.NoError(t, cli.Close())
+}
+
+func TestRecordingChannel(t *testing.T) {
+	frames := recordSession(t)
+	// Start, hello, work start, work done, and client done.
+	assert.Equals(t, len(frames), 5)
+	expectedSenders := []string{
+		atp.SenderClient,
+		atp.SenderServer,
+		atp.SenderClient,
+		atp.SenderServer,
+		atp.SenderClient,
+	}
+	for i, frame := range frames {
+		assert.Equals(t, frame.Sender, expectedSenders[i])
+		assert.Equals(t, frame.Timestamp > 0, true)
+	}
+	var workDone atp.DecodedRuntimeMessage
+	assert.NoError(t, cbor.Unmarshal(frames[3].Data, &workDone))
+	assert.Equals(t, workDone.MessageID, atp.MessageTypeWorkDone)
+	assert.Equals(t, workDone.RunID, "recorded-run")
+}
+
+func TestReplayer_Server(t *testing.T) {
+	frames := recordSession(t)
+
+	replayer := atp.NewServerReplayer(frames, atp.ReplayOptions{})
+	runHelloWorld(t, atp.NewClientWithLogger(replayer, log.NewTestLogger(t)), "Arca Lot")
+	assert.NoError(t, replayer.Err())
+
+	// A client sending different input must be reported.
+	replayer = atp.NewServerReplayer(frames, atp.ReplayOptions{Timeout: 10 * time.Millisecond})
+	runHelloWorld(t, atp.NewClientWithLogger(replayer, log.NewTestLogger(t)), "Other Name")
+	divergences := replayer.Divergences()
+	assert.Equals(t, len(divergences), 1)
+	assert.Equals(t, divergences[0].Frame, 2)
+	assert.Error(t, replayer.Err())
+}
+
+func TestReplayer_Client(t *testing.T) {
+	frames := recordSession(t)
+
+	replayer := atp.NewClientReplayer(frames, atp.ReplayOptions{})
+	errors := atp.RunATPServer(context.Background(), replayer, replayer, helloWorldSchema)
+	assert.Equals(t, len(errors), 0)
+	assert.NoError(t, replayer.Err())
+
+	// A plugin answering differently must be reported.
+	replayer = atp.NewClientReplayer(frames, atp.ReplayOptions{Timeout: 10 * time.Millisecond})
+	errors = atp.RunATPServer(context.Background(), replayer, replayer, panickingHelloWorldSchema)
+	assert.Equals(t, len(errors), 1)
+	assert.Contains(t, replayer.Err().Error(), "frame 3: expected")
+}
+
+// decodeFrame encodes the message and decodes it again, like the replayer does with the frames it compares.
+func decodeFrame(t *testing.T, message any) any {
+	data, err := cbor.Marshal(message)
+	assert.NoError(t, err)
+	var frame any
+	assert.NoError(t, cbor.Unmarshal(data, &frame))
+	return frame
+}
+
+func TestEqualIgnoringNondeterminism(t *testing.T) {
+	workDone := func(debugLogs string, message string) any {
+		return decodeFrame(t, atp.RuntimeMessage{
+			MessageID: atp.MessageTypeWorkDone,
+			RunID:     "recorded-run",
+			MessageData: atp.WorkDoneMessage{
+				StepID:     "hello-world",
+				OutputID:   "success",
+				OutputData: map[string]any{"message": message},
+				DebugLogs:  debugLogs,
+			},
+		})
+	}
+	recorded := workDone("2026-01-02T03:04:05.123456789Z\tinfo\tGreeting Arca Lot\n", "Hello, Arca Lot!")
+	actual := workDone("2026-02-03T04:05:06.987Z\tinfo\tGreeting Arca Lot\n", "Hello, Arca Lot!")
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(recorded, actual), true)
+
+	// The rest of the frame must still match.
+	different := workDone("2026-02-03T04:05:06.987Z\tinfo\tGreeting Arca\n", "Hello, Arca Lot!")
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(recorded, different), false)
+	different = workDone("2026-02-03T04:05:06.987Z\tinfo\tGreeting Arca Lot\n", "Hi, Arca Lot!")
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(recorded, different), false)
+
+	logMessage := func(timestamp int64) any {
+		return decodeFrame(t, atp.RuntimeMessage{
+			MessageID:   atp.MessageTypeLog,
+			RunID:       "recorded-run",
+			MessageData: atp.LogMessage{Level: "info", Timestamp: timestamp, Message: "Greeting Arca Lot"},
+		})
+	}
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(logMessage(1), logMessage(2)), true)
+}
+
+func TestEqualIgnoringNondeterminism_ResourceUsage(t *testing.T) {
+	workDone := func(resourceUsage *atp.ResourceUsage) any {
+		return decodeFrame(t, atp.RuntimeMessage{
+			MessageID: atp.MessageTypeWorkDone,
+			RunID:     "recorded-run",
+			MessageData: atp.WorkDoneMessage{
+				StepID:        "hello-world",
+				OutputID:      "success",
+				OutputData:    map[string]any{"message": "Hello, Arca Lot!"},
+				ResourceUsage: resourceUsage,
+			},
+		})
+	}
+	recorded := workDone(&atp.ResourceUsage{UserCPUTime: 1, MaxRSS: 2})
+	actual := workDone(&atp.ResourceUsage{UserCPUTime: 3, MaxRSS: 4})
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(recorded, actual), true)
+	// A frame that lacks the resource usage must still differ.
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(recorded, workDone(nil)), false)
+}
+
+func TestEqualIgnoringNondeterminism_StackTrace(t *testing.T) {
+	errorMessage := func(stackTrace string) any {
+		return decodeFrame(t, atp.RuntimeMessage{
+			MessageID: atp.MessageTypeError,
+			RunID:     "recorded-run",
+			MessageData: atp.ErrorMessage{
+				Error:      "panic while running step",
+				StepFatal:  true,
+				StackTrace: stackTrace,
+			},
+		})
+	}
+	recorded := errorMessage("goroutine 7 [running]:")
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(recorded, errorMessage("goroutine 12 [running]:")), true)
+	// A frame that lacks the stack trace must still differ.
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(recorded, errorMessage("")), false)
+}
+
+func TestEqualIgnoringNondeterminism_TraceContext(t *testing.T) {
+	// Every run of the session starts a new span.
+	traceParent := func() string {
+		return fmt.Sprintf("00-%s-%016x-01", strings.Repeat("1", 32), rand.Uint64())
+	}
+	workStart := func(traceParent string) any {
+		return decodeFrame(t, atp.RuntimeMessage{
+			MessageID: atp.MessageTypeWorkStart,
+			RunID:     "recorded-run",
+			MessageData: atp.WorkStartMessage{
+				StepID:      "hello-world",
+				Config:      map[string]any{"name": "Arca Lot"},
+				TraceParent: traceParent,
+			},
+		})
+	}
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(workStart(traceParent()), workStart(traceParent())), true)
+	// A frame that lacks the trace context must still differ.
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(workStart(traceParent()), workStart("")), false)
+
+	workDone := func(traceParent string) any {
+		return decodeFrame(t, atp.RuntimeMessage{
+			MessageID: atp.MessageTypeWorkDone,
+			RunID:     "recorded-run",
+			MessageData: atp.WorkDoneMessage{
+				StepID:     "hello-world",
+				OutputID:   "success",
+				OutputData: map[string]any{"message": "Hello, Arca Lot!"},
+			},
+			TraceParent: traceParent,
+		})
+	}
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(workDone(traceParent()), workDone(traceParent())), true)
+}
+
+func TestEqualIgnoringNondeterminism_RunStartTime(t *testing.T) {
+	runStatusResponse := func(stepID string, startTime int64) any {
+		return decodeFrame(t, atp.RuntimeMessage{
+			MessageID: atp.MessageTypeRunStatusResponse,
+			RunID:     "",
+			MessageData: atp.RunStatusResponseMessage{
+				RequestID: 1,
+				Runs: []atp.RunStatus{
+					{RunID: "recorded-run", StepID: stepID, State: atp.RunStateRunning, StartTime: startTime},
+				},
+			},
+		})
+	}
+	recorded := runStatusResponse("hello-world", 1)
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(recorded, runStatusResponse("hello-world", 2)), true)
+	// The rest of the run status must still match.
+	assert.Equals(t, atp.EqualIgnoringNondeterminism(recorded, runStatusResponse("wait", 2)), false)
+}
@@ -0,0 +1,318 @@
+package atp
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultReplayTimeout is the default time a replayer waits for a recorded frame from the side under test before it
+// reports the frame as missing.
+const DefaultReplayTimeout = 5 * time.Second
+
+// ReplayOptions holds the settings of a Replayer. Fields left at their zero value use the default setting.
+type ReplayOptions struct {
+	// Timeout is the time the replayer waits for a recorded frame from the side under test before it reports the
+	// frame as missing, and plays the next frames. Defaults to DefaultReplayTimeout.
+	Timeout time.Duration
+	// Equal compares a decoded recorded frame to the decoded frame the side under test sent, for example to ignore
+	// timestamps. Defaults to EqualIgnoringNondeterminism.
+	Equal func(recorded any, actual any) bool
+}
+
+// Divergence is a difference between a replayed session and its recording.
+type Divergence struct {
+	// Frame is the index of the recorded frame in the recording.
+	Frame int
+	// Recorded is the recorded frame. It is nil if the side under test sent a frame that was not recorded.
+	Recorded []byte
+	// Actual is the frame sent by the side under test. It is nil if the recorded frame was not sent.
+	Actual []byte
+}
+
+func (d Divergence) String() string {
+	switch {
+	case d.Recorded == nil:
+		return fmt.Sprintf("frame %d: unexpected frame %s", d.Frame, diagnoseFrame(d.Actual))
+	case d.Actual == nil:
+		return fmt.Sprintf("frame %d: recorded frame %s was not sent", d.Frame, diagnoseFrame(d.Recorded))
+	default:
+		return fmt.Sprintf("frame %d: expected %s, got %s", d.Frame, diagnoseFrame(d.Recorded), diagnoseFrame(d.Actual))
+	}
+}
+
+func diagnoseFrame(data []byte) string {
+	diagnosis, err := cbor.Diagnose(data)
+	if err != nil {
+		return fmt.Sprintf("%x", data)
+	}
+	return diagnosis
+}
+
+// nondeterministicPlaceholder replaces the values in frames that differ between runs of the same session.
+const nondeterministicPlaceholder = "<nondeterministic>"
+
+// EqualIgnoringNondeterminism compares two decoded frames with reflect.DeepEqual, except for the values that differ
+// between runs of the same session: the timestamps, including the ones of the debug logs and the start times of run
+// statuses, the resource usage, the stack traces of panics, and the trace contexts.
+func EqualIgnoringNondeterminism(recorded any, actual any) bool {
+	return reflect.DeepEqual(normalizeFrame(recorded), normalizeFrame(actual))
+}
+
+// normalizeFrame replaces the nondeterministic values of the decoded frame with a placeholder if it is a runtime
+// message. Values that are missing stay missing, so a frame that lacks them still differs.
+func normalizeFrame(frame any) any {
+	message, ok := frame.(map[any]any)
+	if !ok {
+		return frame
+	}
+	messageID, ok := message["id"].(uint64)
+	if !ok {
+		return frame
+	}
+	replaceIfPresent(message, "traceparent")
+	data, ok := message["data"].(map[any]any)
+	if !ok {
+		return frame
+	}
+	switch uint32(messageID) {
+	case MessageTypeWorkStart:
+		replaceIfPresent(data, "traceparent")
+	case MessageTypeWorkDone:
+		normalizeDebugLogs(data)
+		replaceIfPresent(data, "resource_usage")
+	case MessageTypeError:
+		normalizeDebugLogs(data)
+		replaceIfPresent(data, "stack_trace")
+	case MessageTypeLog:
+		replaceIfPresent(data, "timestamp")
+	case MessageTypeRunStatusResponse:
+		runs, _ := data["runs"].([]any)
+		for _, run := range runs {
+			if runData, ok := run.(map[any]any); ok {
+				replaceIfPresent(runData, "start_time")
+			}
+		}
+	}
+	return frame
+}
+
+func replaceIfPresent(data map[any]any, key string) {
+	if _, found := data[key]; found {
+		data[key] = nondeterministicPlaceholder
+	}
+}
+
+// normalizeDebugLogs replaces the timestamps at the start of the debug log lines, which debugLogBuffer writes.
+func normalizeDebugLogs(data map[any]any) {
+	debugLogs, ok := data["debug_logs"].(string)
+	if !ok {
+		return
+	}
+	lines := strings.Split(debugLogs, "\n")
+	for i, line := range lines {
+		timestamp, rest, found := strings.Cut(line, "\t")
+		if !found {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+			lines[i] = nondeterministicPlaceholder + "\t" + rest
+		}
+	}
+	data["debug_logs"] = strings.Join(lines, "\n")
+}
+
+// Replayer plays back one side of a recorded ATP session to the other side, and reports the divergences between what
+// the side under test sends and the recording. A frame of the played back side is only sent once the side under test
+// sent the frames recorded before it, or the timeout for these frames passed.
+//
+// A replayer of the server side is used as the ClientChannel of a client. A replayer of the client side is used as
+// both the stdin and the stdout of RunATPServer.
+type Replayer struct {
+	lock        sync.Mutex
+	cond        *sync.Cond
+	frames      []RecordedFrame
+	subject     string // The sender under test.
+	options     ReplayOptions
+	nextPlayed  int    // Index of the next frame to consider playing back.
+	nextSubject int    // Index of the next frame expected from the side under test.
+	readBuffer  []byte // The rest of the frame being played back.
+	written     []byte // Data written by the side under test that is not a complete frame yet.
+	divergences []Divergence
+	closed      bool
+}
+
+// NewServerReplayer creates a replayer that plays back the server side of the recording to a client under test.
+func NewServerReplayer(frames []RecordedFrame, options ReplayOptions) *Replayer {
+	return newReplayer(frames, SenderClient, options)
+}
+
+// NewClientReplayer creates a replayer that plays back the client side of the recording to a server under test.
+func NewClientReplayer(frames []RecordedFrame, options ReplayOptions) *Replayer {
+	return newReplayer(frames, SenderServer, options)
+}
+
+func newReplayer(frames []RecordedFrame, subject string, options ReplayOptions) *Replayer {
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultReplayTimeout
+	}
+	if options.Equal == nil {
+		options.Equal = EqualIgnoringNondeterminism
+	}
+	r := &Replayer{
+		frames:  frames,
+		subject: subject,
+		options: options,
+	}
+	r.cond = sync.NewCond(&r.lock)
+	r.nextSubject = r.nextFrameOf(subject, 0)
+	return r
+}
+
+// Read reads the next recorded frame of the played back side. It returns io.EOF after the last frame.
+func (r *Replayer) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for len(r.readBuffer) == 0 {
+		if r.closed {
+			return 0, io.EOF
+		}
+		next := r.nextFrameOf(r.playedSender(), r.nextPlayed)
+		if next == len(r.frames) {
+			return 0, io.EOF
+		}
+		if !r.waitForSubject(next) {
+			if r.closed {
+				return 0, io.EOF
+			}
+			// The side under test did not send the frame in time, so report it and carry on without it.
+			r.divergences = append(r.divergences, Divergence{
+				Frame:    r.nextSubject,
+				Recorded: r.frames[r.nextSubject].Data,
+			})
+			r.nextSubject = r.nextFrameOf(r.subject, r.nextSubject+1)
+			continue
+		}
+		r.readBuffer = r.frames[next].Data
+		r.nextPlayed = next + 1
+	}
+	// Only return a single frame per read, like a pipe does for every write.
+	n := copy(p, r.readBuffer)
+	r.readBuffer = r.readBuffer[n:]
+	return n, nil
+}
+
+// Write compares the frames sent by the side under test with the recording.
+func (r *Replayer) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.written = append(r.written, p...)
+	for _, frame := range splitFrames(&r.written) {
+		if r.nextSubject == len(r.frames) {
+			r.divergences = append(r.divergences, Divergence{
+				Frame:  len(r.frames),
+				Actual: frame,
+			})
+			continue
+		}
+		if recorded := r.frames[r.nextSubject].Data; !r.equal(recorded, frame) {
+			r.divergences = append(r.divergences, Divergence{
+				Frame:    r.nextSubject,
+				Recorded: recorded,
+				Actual:   frame,
+			})
+		}
+		r.nextSubject = r.nextFrameOf(r.subject, r.nextSubject+1)
+	}
+	r.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close makes further reads return io.EOF.
+func (r *Replayer) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+	return nil
+}
+
+// Divergences returns the divergences found so far. Once the session is over, the recorded frames the side under
+// test did not send are included.
+func (r *Replayer) Divergences() []Divergence {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	divergences := slices.Clone(r.divergences)
+	for i := r.nextSubject; i < len(r.frames); i = r.nextFrameOf(r.subject, i+1) {
+		divergences = append(divergences, Divergence{
+			Frame:    i,
+			Recorded: r.frames[i].Data,
+		})
+	}
+	return divergences
+}
+
+// Err returns an error listing the divergences, or nil if the session matched the recording.
+func (r *Replayer) Err() error {
+	divergences := r.Divergences()
+	if len(divergences) == 0 {
+		return nil
+	}
+	descriptions := make([]string, len(divergences))
+	for i, divergence := range divergences {
+		descriptions[i] = divergence.String()
+	}
+	return fmt.Errorf("replayed session diverged from the recording:\n%s", strings.Join(descriptions, "\n"))
+}
+
+func (r *Replayer) playedSender() string {
+	if r.subject == SenderClient {
+		return SenderServer
+	}
+	return SenderClient
+}
+
+// nextFrameOf returns the index of the first frame of the sender at or after the start index, or the number of
+// frames if there are none.
+func (r *Replayer) nextFrameOf(sender string, start int) int {
+	for i := start; i < len(r.frames); i++ {
+		if r.frames[i].Sender == sender {
+			return i
+		}
+	}
+	return len(r.frames)
+}
+
+// waitForSubject waits until the side under test sent all frames recorded before the given index. It returns false
+// if the timeout passed first. The caller must hold the lock.
+func (r *Replayer) waitForSubject(index int) bool {
+	if r.nextSubject > index {
+		return true
+	}
+	timedOut := false
+	timer := time.AfterFunc(r.options.Timeout, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		timedOut = true
+		r.cond.Broadcast()
+	})
+	defer timer.Stop()
+	for r.nextSubject < index && !timedOut && !r.closed {
+		r.cond.Wait()
+	}
+	return r.nextSubject > index
+}
+
+func (r *Replayer) equal(recorded []byte, actual []byte) bool {
+	var recordedValue, actualValue any
+	if cbor.Unmarshal(recorded, &recordedValue) != nil || cbor.Unmarshal(actual, &actualValue) != nil {
+		return bytes.Equal(recorded, actual)
+	}
+	return r.options.Equal(recordedValue, actualValue)
+}
@@ -0,0 +1,47 @@
+package atp
+
+import (
+	"runtime"
+	"time"
+)
+
+// ResourceUsage reports the resources the plugin process used while a step ran. The plugin process is shared by all
+// runs of a session, so the usage of runs that overlap includes the usage of each other.
+type ResourceUsage struct {
+	// UserCPUTime is the CPU time the process spent in user mode during the run.
+	UserCPUTime time.Duration `cbor:"user_cpu_time"`
+	// SystemCPUTime is the CPU time the process spent in kernel mode during the run.
+	SystemCPUTime time.Duration `cbor:"system_cpu_time"`
+	// MaxRSS is the peak resident set size of the process when the run finished, in bytes. It is zero on platforms
+	// that do not report it.
+	MaxRSS int64 `cbor:"max_rss"`
+	// Goroutines is the change of the number of goroutines during the run. It is positive if the step left goroutines
+	// running.
+	Goroutines int64 `cbor:"goroutines"`
+}
+
+// resourceSnapshot holds the resource usage of the process at a point in time.
+type resourceSnapshot struct {
+	userCPUTime   time.Duration
+	systemCPUTime time.Duration
+	maxRSS        int64
+	goroutines    int
+}
+
+func takeResourceSnapshot() resourceSnapshot {
+	snapshot := resourceSnapshot{
+		goroutines: runtime.NumGoroutine(),
+	}
+	snapshot.userCPUTime, snapshot.systemCPUTime, snapshot.maxRSS = processResourceUsage()
+	return snapshot
+}
+
+// usageSince returns the resources used between the start snapshot and this one.
+func (s resourceSnapshot) usageSince(start resourceSnapshot) *ResourceUsage {
+	return &ResourceUsage{
+		UserCPUTime:   s.userCPUTime - start.userCPUTime,
+		SystemCPUTime: s.systemCPUTime - start.systemCPUTime,
+		MaxRSS:        s.maxRSS,
+		Goroutines:    int64(s.goroutines - start.goroutines),
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package atp
+
+import "time"
+
+// processResourceUsage is not supported on this platform, so it reports no usage.
+func processResourceUsage() (time.Duration, time.Duration, int64) {
+	return 0, 0, 0
+}
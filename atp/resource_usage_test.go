@@ -0,0 +1,44 @@
+package atp_test
+
+import (
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"runtime"
+	"testing"
+)
+
+// executeHelloWorld runs the hello world step on an in-process client with the given features.
+func executeHelloWorld(t *testing.T, features []string) atp.ExecutionResult {
+	cli := atp.NewInProcessClientWithOptions(
+		helloWorldSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t), Features: features},
+		atp.ServerOptions{},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.NoError(t, cli.Close())
+	return result
+}
+
+func TestResourceUsage(t *testing.T) {
+	result := executeHelloWorld(t, nil)
+	assert.NotNil(t, result.ResourceUsage)
+	assert.Equals(t, result.ResourceUsage.UserCPUTime >= 0, true)
+	assert.Equals(t, result.ResourceUsage.SystemCPUTime >= 0, true)
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		assert.Equals(t, result.ResourceUsage.MaxRSS > 0, true)
+	}
+}
+
+func TestResourceUsage_Disabled(t *testing.T) {
+	result := executeHelloWorld(t, []string{})
+	assert.Nil(t, result.ResourceUsage)
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package atp
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// processResourceUsage returns the CPU time the process used so far, and its peak resident set size in bytes.
+func processResourceUsage() (time.Duration, time.Duration, int64) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0, 0
+	}
+	maxRSS := int64(usage.Maxrss)
+	if runtime.GOOS != "darwin" && runtime.GOOS != "ios" {
+		// Other platforms report it in kilobytes.
+		maxRSS *= 1024
+	}
+	return time.Duration(usage.Utime.Nano()), time.Duration(usage.Stime.Nano()), maxRSS
+}
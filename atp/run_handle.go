@@ -0,0 +1,202 @@
+package atp
+
+import (
+	"context"
+	"fmt"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"sync"
+	"time"
+)
+
+// CancelSignalID is the ID of the signal the client sends to a step when the context of its run is cancelled.
+const CancelSignalID = "cancel"
+
+// DefaultCancelTimeout is the default time a cancelled run has to finish before the client fails it.
+const DefaultCancelTimeout = 30 * time.Second
+
+// runSignalBufferSize is the number of emitted signals, and of opened blob streams, a RunHandle buffers before the
+// client blocks.
+const runSignalBufferSize = 16
+
+// RunHandle controls a single step run started with RunStarter.Start.
+type RunHandle interface {
+	// Wait blocks until the run is finished and returns its result.
+	Wait() ExecutionResult
+	// SendSignal sends a signal with the given ID and data to the running step.
+	SendSignal(signalID string, data any) error
+	// SendSignalWithReply sends a signal with the given ID and data to the running step, and waits for the reply of
+	// the signal handler, which is nil if the handler does not reply. It fails if the signal handler fails, or if no
+	// reply arrives before the context is done or the signal reply timeout set in the ClientOptions passes. Requires
+	// the plugin to support FeatureSignalReplies.
+	SendSignalWithReply(ctx context.Context, signalID string, data any) (any, error)
+	// Signals returns the channel of signals emitted by the step. The channel is closed when the run is finished.
+	// If the step emits signals, the channel must be read, otherwise the client blocks once its buffer is full.
+	Signals() <-chan schema.Input
+	// Blobs returns the channel of the blob streams the step opens. The channel is closed when the run is finished.
+	// If the step opens blob streams, the channel must be read, otherwise the run fails once its buffer is full.
+	Blobs() <-chan *BlobReader
+	// Cancel cancels the run the same way as cancelling the context passed to RunStarter.Start does.
+	Cancel()
+}
+
+type runHandle struct {
+	client      *client
+	input       schema.Input
+	ctx         context.Context
+	cancel      context.CancelFunc
+	signals     chan schema.Input
+	blobs       chan *BlobReader
+	resultReady chan struct{}
+	started     time.Time
+	endSpan     func(error) // Ends the client's span of the run.
+	result      ExecutionResult
+	doneLock    sync.Mutex
+	done        bool
+}
+
+func (c *client) Start(ctx context.Context, input schema.Input) (RunHandle, error) {
+	c.logger.Debugf("Starting plugin step %s/%s...", input.RunID, input.ID)
+	if c.optionsErr != nil {
+		return nil, c.optionsErr
+	}
+	if len(input.RunID) == 0 {
+		return nil, fmt.Errorf("run ID is blank for step %s", input.ID)
+	}
+	if err := c.validateInput(input); err != nil {
+		c.logger.Errorf("Invalid input for step '%s': %v", input.ID, err)
+		return nil, err
+	}
+	if c.atpVersion < 2 {
+		return nil, fmt.Errorf("starting runs asynchronously requires ATP v2 or later, the plugin uses v%d",
+			c.atpVersion)
+	}
+	traceParent, endSpan := c.startSpan(ctx, input)
+	ctx, cancel := context.WithCancel(ctx)
+	handle := &runHandle{
+		client:      c,
+		input:       input,
+		ctx:         ctx,
+		cancel:      cancel,
+		signals:     make(chan schema.Input, runSignalBufferSize),
+		blobs:       make(chan *BlobReader, runSignalBufferSize),
+		resultReady: make(chan struct{}),
+		started:     time.Now(),
+		endSpan:     endSpan,
+	}
+	if err := c.prepareResultChannels(c.newDecoder(), input, handle.signals, handle.blobs); err != nil {
+		cancel()
+		endSpan(err)
+		return nil, err
+	}
+	c.publishEvent(ClientEvent{Type: ClientEventRunStarted, RunID: input.RunID, StepID: input.ID})
+	if err := c.sendCBOR(RuntimeMessage{
+		MessageID: MessageTypeWorkStart,
+		RunID:     input.RunID,
+		MessageData: WorkStartMessage{
+			StepID:      input.ID,
+			Config:      input.InputData,
+			TraceParent: traceParent,
+		},
+	}); err != nil {
+		c.logger.Errorf("Step '%s' failed to write start work message: %v", input.ID, err)
+		cancel()
+		c.removeResultChannels(input.RunID)
+		err = fmt.Errorf("failed to write work start message (%w)", err)
+		c.publishEvent(ClientEvent{Type: ClientEventError, RunID: input.RunID, Err: err})
+		endSpan(err)
+		return nil, err
+	}
+	c.logger.Debugf("Step '%s' started.", input.ID)
+
+	go handle.waitForResult()
+	go handle.watchContext()
+	return handle, nil
+}
+
+func (h *runHandle) Wait() ExecutionResult {
+	<-h.resultReady
+	return h.result
+}
+
+func (h *runHandle) SendSignal(signalID string, data any) error {
+	return h.sendSignal(signalID, data, 0)
+}
+
+// sendSignal sends the signal to the step, asking for a reply if the request ID is not zero.
+func (h *runHandle) sendSignal(signalID string, data any, requestID uint64) error {
+	// The lock is held while sending, so no signal is sent once the run is done.
+	h.doneLock.Lock()
+	defer h.doneLock.Unlock()
+	if h.done || h.client.runFinished(h.input.RunID) {
+		return fmt.Errorf("cannot send signal '%s' to run '%s', the run is finished", signalID, h.input.RunID)
+	}
+	h.client.logger.Debugf("Sending signal with ID '%s' to step with run ID '%s'", signalID, h.input.RunID)
+	if err := h.client.sendCBOR(RuntimeMessage{
+		MessageID: MessageTypeSignal,
+		RunID:     h.input.RunID,
+		MessageData: SignalMessage{
+			SignalID:  signalID,
+			Data:      data,
+			RequestID: requestID,
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to write signal '%s' for run '%s' (%w)", signalID, h.input.RunID, err)
+	}
+	h.client.metrics.AddCount(h.input.RunID, MetricSignalsSent, 1)
+	h.client.publishEvent(ClientEvent{Type: ClientEventSignalSent, RunID: h.input.RunID, SignalID: signalID})
+	return nil
+}
+
+func (h *runHandle) Signals() <-chan schema.Input {
+	return h.signals
+}
+
+func (h *runHandle) Blobs() <-chan *BlobReader {
+	return h.blobs
+}
+
+func (h *runHandle) Cancel() {
+	h.cancel()
+}
+
+func (h *runHandle) waitForResult() {
+	result := h.client.validateOutput(h.input, h.client.getResultV2(h.input))
+	h.client.metrics.ObserveDuration(h.input.RunID, MetricRunDuration, time.Since(h.started))
+	h.endSpan(result.Error)
+	h.doneLock.Lock()
+	h.done = true
+	h.doneLock.Unlock()
+	h.result = result
+	close(h.resultReady)
+	h.cancel()
+}
+
+// watchContext sends the cancel signal to the step once the context of the run is cancelled. If the step does not
+// finish within the cancel timeout after that, the run fails.
+func (h *runHandle) watchContext() {
+	select {
+	case <-h.resultReady:
+		return
+	case <-h.ctx.Done():
+	}
+	// The context is also cancelled right after the result arrives, so check again.
+	select {
+	case <-h.resultReady:
+		return
+	default:
+	}
+	h.client.logger.Debugf("Run '%s' cancelled, sending cancel signal...", h.input.RunID)
+	if err := h.SendSignal(CancelSignalID, map[string]any{}); err != nil {
+		h.client.logger.Warningf("Failed to cancel run '%s': %v", h.input.RunID, err)
+	}
+	select {
+	case <-h.resultReady:
+	case <-time.After(h.client.cancelTimeout):
+		h.client.abandonRun(h.input.RunID, fmt.Errorf(
+			"run '%s' did not finish within %s after it was cancelled (%w)",
+			h.input.RunID,
+			h.client.cancelTimeout,
+			context.Cause(h.ctx),
+		))
+	}
+}
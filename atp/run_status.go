@@ -0,0 +1,231 @@
+package atp
+
+import (
+	"context"
+	"fmt"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RunState is the state of a run that is not finished yet.
+type RunState string
+
+// The states of a run that is not finished yet.
+const (
+	// RunStateQueued means the run waits for a run slot, see ServerOptions.MaxConcurrentRuns.
+	RunStateQueued RunState = "queued"
+	// RunStateRunning means the step handler is running.
+	RunStateRunning RunState = "running"
+	// RunStateFinishing means the step handler returned, and the server is sending the result.
+	RunStateFinishing RunState = "finishing"
+)
+
+// Started returns the time the server received the work start message of the run.
+func (r RunStatus) Started() time.Time {
+	return time.Unix(0, r.StartTime)
+}
+
+// RunStatusQuerier is implemented by the clients that can query the status of the runs of a plugin. All clients
+// created by this package implement it:
+//
+//	runs, err := client.(atp.RunStatusQuerier).QueryRunStatus(ctx, "")
+type RunStatusQuerier interface {
+	// QueryRunStatus asks the plugin for the status of the run with the given ID, or of all runs if the ID is empty.
+	// Finished and unknown runs are left out of the result. Requires the plugin to support FeatureRunStatus.
+	QueryRunStatus(ctx context.Context, runID string) ([]RunStatus, error)
+}
+
+// RunStatusReporter sets the status object of a running step, which the client can query. Step handlers running in an
+// ATP server can obtain one from the context they were called with using GetRunStatusReporter.
+type RunStatusReporter interface {
+	// SetStatus validates the status against the status schema declared for the step with
+	// schema.CallableSchema.WithRunStatus, serializes it, and keeps it as the status of the current run.
+	SetStatus(status any) error
+}
+
+type runStatusReporterContextKey struct{}
+
+// GetRunStatusReporter returns the run status reporter for the step run the context belongs to. It returns nil if the
+// context was not passed to a step handler by the ATP server.
+func GetRunStatusReporter(ctx context.Context) RunStatusReporter {
+	reporter, _ := ctx.Value(runStatusReporterContextKey{}).(RunStatusReporter)
+	return reporter
+}
+
+func withRunStatusReporter(ctx context.Context, reporter RunStatusReporter) context.Context {
+	return context.WithValue(ctx, runStatusReporterContextKey{}, reporter)
+}
+
+// activeRun holds the state of a run that is not done yet.
+type activeRun struct {
+	stepID  string
+	started time.Time
+	state   RunState
+	status  any // The serialized status the step reported last, if any.
+}
+
+func (r *activeRun) toRunStatus(runID string) RunStatus {
+	return RunStatus{
+		RunID:     runID,
+		StepID:    r.stepID,
+		State:     r.state,
+		StartTime: r.started.UnixNano(),
+		Status:    r.status,
+	}
+}
+
+// setRunState updates the state of the run, if it is still active.
+func (s *atpServerSession) setRunState(runID string, state RunState) {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	if run, found := s.activeRuns[runID]; found {
+		run.state = state
+	}
+}
+
+// runStatuses returns the status of the active run with the given ID, or of all active runs if the ID is empty, sorted
+// by run ID.
+func (s *atpServerSession) runStatuses(runID string) []RunStatus {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	runs := []RunStatus{}
+	for id, run := range s.activeRuns {
+		if runID == "" || id == runID {
+			runs = append(runs, run.toRunStatus(id))
+		}
+	}
+	slices.SortFunc(runs, func(a, b RunStatus) int {
+		return strings.Compare(a.RunID, b.RunID)
+	})
+	return runs
+}
+
+func (s *atpServerSession) handleRunStatusRequest(runID string, request RunStatusRequestMessage) {
+	if !s.runStatus {
+		s.workDone <- ServerError{
+			RunID:       runID,
+			Err:         fmt.Errorf("run status request received without the '%s' feature", FeatureRunStatus),
+			StepFatal:   false,
+			ServerFatal: false,
+			kind:        ErrorKindProtocol,
+		}
+		return
+	}
+	if err := s.sendRuntimeMessage(MessageTypeRunStatusResponse, runID, RunStatusResponseMessage{
+		RequestID: request.RequestID,
+		Runs:      s.runStatuses(runID),
+	}); err != nil {
+		s.workDone <- ServerError{
+			RunID:       runID,
+			Err:         fmt.Errorf("failed to send run status response (%w)", err),
+			StepFatal:   false,
+			ServerFatal: false,
+		}
+	}
+}
+
+type serverRunStatusReporter struct {
+	session *atpServerSession
+	runID   string
+	stepID  string
+}
+
+func (r serverRunStatusReporter) SetStatus(status any) error {
+	statusSchema := r.session.pluginSchema.RunStatusSchema(r.stepID)
+	if statusSchema == nil {
+		return schema.BadArgumentError{
+			Message: fmt.Sprintf("step '%s' does not declare a run status", r.stepID),
+		}
+	}
+	serializedStatus, err := statusSchema.Serialize(status)
+	if err != nil {
+		return schema.BadArgumentError{
+			Message: fmt.Sprintf("invalid status for run '%s'", r.runID),
+			Cause:   err,
+		}
+	}
+	r.session.runLock.Lock()
+	defer r.session.runLock.Unlock()
+	run, found := r.session.activeRuns[r.runID]
+	if !found {
+		return schema.IllegalStateError{
+			Cause: fmt.Errorf("cannot set the status of run '%s' after it finished", r.runID),
+		}
+	}
+	run.status = serializedStatus
+	return nil
+}
+
+// runStatusResult is the answer to a run status request of the client.
+type runStatusResult struct {
+	runs []RunStatus
+	err  error
+}
+
+func (c *client) QueryRunStatus(ctx context.Context, runID string) ([]RunStatus, error) {
+	if !slices.Contains(c.capabilities, FeatureRunStatus) {
+		return nil, fmt.Errorf("the plugin does not support the '%s' feature", FeatureRunStatus)
+	}
+	c.mutex.Lock()
+	if c.done {
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("cannot query the run status, the client is closed")
+	}
+	c.nextRequestID++
+	requestID := c.nextRequestID
+	results := make(chan runStatusResult, 1)
+	c.runStatusRequests[requestID] = results
+	c.startReadLoop(c.newDecoder())
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(c.runStatusRequests, requestID)
+	}()
+
+	if err := c.sendCBOR(RuntimeMessage{
+		MessageID:   MessageTypeRunStatusRequest,
+		RunID:       runID,
+		MessageData: RunStatusRequestMessage{RequestID: requestID},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to write run status request message (%w)", err)
+	}
+	select {
+	case result := <-results:
+		return result.runs, result.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("run status request cancelled (%w)", ctx.Err())
+	}
+}
+
+func (c *client) handleRunStatusResponseMessage(runtimeMessage DecodedRuntimeMessage) {
+	var response RunStatusResponseMessage
+	if err := c.messageDecMode.Unmarshal(runtimeMessage.RawMessageData, &response); err != nil {
+		c.logger.Errorf("ATP client failed to decode run status response message: %v", err)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	results, found := c.runStatusRequests[response.RequestID]
+	if !found {
+		c.logger.Debugf("Ignoring response to run status request %d, which is not waited for.", response.RequestID)
+		return
+	}
+	delete(c.runStatusRequests, response.RequestID)
+	results <- runStatusResult{runs: response.Runs}
+}
+
+// failRequests fails the run status requests and the signals waiting for a reply. The caller must have the mutex
+// locked while calling this function.
+func (c *client) failRequests(err error) {
+	for requestID, results := range c.runStatusRequests {
+		delete(c.runStatusRequests, requestID)
+		results <- runStatusResult{err: err}
+	}
+	for requestID, replies := range c.signalReplyRequests {
+		delete(c.signalReplyRequests, requestID)
+		replies <- signalReplyResult{err: err}
+	}
+}
@@ -0,0 +1,176 @@
+package atp_test
+
+import (
+	"context"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"testing"
+	"time"
+)
+
+// newRunStatusSchema creates a schema with a step that reports its progress as its status, and then waits until the
+// release channel is closed. The step reports every status it set on the statuses channel.
+func newRunStatusSchema(release <-chan struct{}, statuses chan<- error) *schema.CallableSchema {
+	return schema.NewCallableSchema(
+		schema.NewCallableStep[helloWorldInput](
+			/* id */ "hello-world",
+			/* input */ helloWorldInputSchema,
+			/* outputs */ helloWorldOutputSchemas,
+			/* Display */ nil,
+			/* step handler */ func(ctx context.Context, input helloWorldInput) (string, any) {
+				reporter := atp.GetRunStatusReporter(ctx)
+				statuses <- reporter.SetStatus(progressSignal{Percent: 150})
+				statuses <- reporter.SetStatus(progressSignal{Percent: 50})
+				<-release
+				return helloWorldStepHandler(ctx, nil, input)
+			},
+		),
+	).WithRunStatus("hello-world", progressSignalSchema.DataSchema().(*schema.ScopeSchema))
+}
+
+func TestRunStatus(t *testing.T) {
+	release := make(chan struct{})
+	statuses := make(chan error, 4)
+	cli := atp.NewInProcessClientWithOptions(
+		newRunStatusSchema(release, statuses),
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{MaxConcurrentRuns: 1, QueueRuns: true},
+	)
+	pluginSchema, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	// The status schema is part of the step schema.
+	assert.NotNil(t, pluginSchema.StepsValue["hello-world"].Status())
+
+	// No runs are running yet.
+	runs, err := cli.(atp.RunStatusQuerier).QueryRunStatus(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Equals(t, len(runs), 0)
+
+	started := time.Now()
+	var handles []atp.RunHandle
+	for _, runID := range []string{"run-1", "run-2"} {
+		handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+			RunID:     runID,
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		})
+		assert.NoError(t, err)
+		handles = append(handles, handle)
+	}
+	// The invalid status is rejected, and the valid one is kept.
+	assert.Error(t, <-statuses)
+	assert.NoError(t, <-statuses)
+
+	runs, err = cli.(atp.RunStatusQuerier).QueryRunStatus(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Equals(t, len(runs), 2)
+	assert.Equals(t, runs[0].RunID, "run-1")
+	assert.Equals(t, runs[0].StepID, "hello-world")
+	assert.Equals(t, runs[0].State, atp.RunStateRunning)
+	assert.Equals(t, runs[0].Started().Before(started.Add(-time.Second)), false)
+	assert.Equals(t, runs[0].Status.(map[any]any)["percent"].(uint64), 50)
+	// Only one run may run at a time, so the second one waits.
+	assert.Equals(t, runs[1].RunID, "run-2")
+	assert.Equals(t, runs[1].State, atp.RunStateQueued)
+	assert.Nil(t, runs[1].Status)
+
+	runs, err = cli.(atp.RunStatusQuerier).QueryRunStatus(context.Background(), "run-2")
+	assert.NoError(t, err)
+	assert.Equals(t, len(runs), 1)
+	assert.Equals(t, runs[0].RunID, "run-2")
+	runs, err = cli.(atp.RunStatusQuerier).QueryRunStatus(context.Background(), "unknown")
+	assert.NoError(t, err)
+	assert.Equals(t, len(runs), 0)
+
+	close(release)
+	for _, handle := range handles {
+		assert.NoError(t, handle.Wait().Error)
+	}
+	// The server may not be done with the runs right after sending their results.
+	runs, err = cli.(atp.RunStatusQuerier).QueryRunStatus(context.Background(), "")
+	assert.NoError(t, err)
+	for _, run := range runs {
+		assert.Equals(t, run.State, atp.RunStateFinishing)
+	}
+	assert.NoError(t, cli.Close())
+	_, err = cli.(atp.RunStatusQuerier).QueryRunStatus(context.Background(), "")
+	assert.Error(t, err)
+}
+
+func TestRunStatus_Undeclared(t *testing.T) {
+	statuses := make(chan error, 1)
+	cli := atp.NewInProcessClientWithOptions(
+		schema.NewCallableSchema(
+			schema.NewCallableStep[helloWorldInput](
+				/* id */ "hello-world",
+				/* input */ helloWorldInputSchema,
+				/* outputs */ helloWorldOutputSchemas,
+				/* Display */ nil,
+				/* step handler */ func(ctx context.Context, input helloWorldInput) (string, any) {
+					statuses <- atp.GetRunStatusReporter(ctx).SetStatus(progressSignal{Percent: 50})
+					return helloWorldStepHandler(ctx, nil, input)
+				},
+			),
+		),
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{},
+	)
+	pluginSchema, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	assert.Nil(t, pluginSchema.StepsValue["hello-world"].Status())
+	result := cli.Execute(schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.NoError(t, cli.Close())
+	err = <-statuses
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not declare a run status")
+}
+
+func TestRunStatus_Unsupported(t *testing.T) {
+	cli := atp.NewInProcessClientWithOptions(
+		helloWorldSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t), Features: []string{}},
+		atp.ServerOptions{},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	_, err = cli.(atp.RunStatusQuerier).QueryRunStatus(context.Background(), "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), atp.FeatureRunStatus)
+	assert.NoError(t, cli.Close())
+}
+
+func TestRunStatus_Unsupported_Schema(t *testing.T) {
+	// Clients without the feature may reject the unknown status key, so it is left out of the schema.
+	cli := atp.NewInProcessClientWithOptions(
+		newRunStatusSchema(nil, nil),
+		atp.ClientOptions{Logger: log.NewTestLogger(t), Features: []string{}},
+		atp.ServerOptions{},
+	)
+	pluginSchema, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	assert.Nil(t, pluginSchema.StepsValue["hello-world"].Status())
+	assert.NoError(t, cli.Close())
+}
+
+func TestRunStatus_Cancelled(t *testing.T) {
+	// The query gives up once its context is cancelled.
+	cli := atp.NewInProcessClientWithOptions(
+		helloWorldSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cli.(atp.RunStatusQuerier).QueryRunStatus(ctx, "")
+	assert.Error(t, err)
+	assert.NoError(t, cli.Close())
+}
@@ -2,15 +2,120 @@ package atp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/fxamacker/cbor/v2"
+	"go.arcalot.io/log/v2"
 	"go.flow.arcalot.io/pluginsdk/schema"
 	"io"
 	"os"
+	"runtime/debug"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultSendTimeout is the default maximum time sending a single message to the client may take.
+const DefaultSendTimeout = 60 * time.Second
+
+// DefaultMaxQueuedRuns is the default number of runs that can wait for a running step to finish with
+// ServerOptions.QueueRuns.
+const DefaultMaxQueuedRuns = 100
+
+// DefaultErrorChannelSize is the default number of errors that can wait to be reported to the client.
+const DefaultErrorChannelSize = 3
+
+// ServerOptions holds the settings of an ATP server. Fields left at their zero value use the default setting.
+type ServerOptions struct {
+	// DebugLogLimit is the maximum number of bytes of debug logs the server keeps for a single run. Messages logged
+	// after reaching the limit are dropped. Defaults to DefaultDebugLogLimit.
+	DebugLogLimit int
+	// SendTimeout is the maximum time sending a single message to the client may take. Defaults to
+	// DefaultSendTimeout.
+	SendTimeout time.Duration
+	// MaxConcurrentRuns limits the number of steps running at the same time. Zero means no limit.
+	MaxConcurrentRuns int
+	// QueueRuns makes runs started while MaxConcurrentRuns steps are running wait until another run finishes. The
+	// waiting runs are started in the order they were received. Otherwise, these runs fail with a step fatal error.
+	QueueRuns bool
+	// MaxQueuedRuns is the number of runs that can wait with QueueRuns. Runs started while the queue is full fail
+	// with a step fatal error. Defaults to DefaultMaxQueuedRuns.
+	MaxQueuedRuns int
+	// ErrorChannelSize is the number of errors that can wait to be reported to the client before the goroutines
+	// reporting them block. Defaults to DefaultErrorChannelSize.
+	ErrorChannelSize int
+	// OnError is called for every error the server reports to the client.
+	OnError func(ServerError)
+	// BlobWindowSize is the number of bytes of a blob stream sent to the client before the step has to wait for the
+	// client to acknowledge them. Defaults to DefaultBlobWindowSize.
+	BlobWindowSize int
+	// DrainPeriod is the time the running steps have to finish after the server context was cancelled. The server
+	// starts no new runs in the meantime, and reports the steps still running after it as aborted. Defaults to
+	// DefaultDrainPeriod.
+	DrainPeriod time.Duration
+	// Metrics receives the metrics the server records for each run. Defaults to discarding them.
+	Metrics MetricsSink
+	// Tracer creates the spans of the runs the client sent a trace context for. Defaults to a tracer that only creates
+	// child span IDs.
+	Tracer Tracer
+	// DecoderLimits limits the size and complexity of the messages the server accepts from the client. A message
+	// exceeding them is a server fatal error.
+	DecoderLimits DecoderLimits
+	// Format is the encoding of the messages. The client must use the same format. Defaults to FormatCBOR.
+	Format Format
+}
+
+// maxActiveRuns returns the number of runs that can be queued or running at the same time, or zero if it is not
+// limited.
+func (o ServerOptions) maxActiveRuns() int {
+	if o.MaxConcurrentRuns <= 0 {
+		return 0
+	}
+	if o.QueueRuns {
+		return o.MaxConcurrentRuns + o.MaxQueuedRuns
+	}
+	return o.MaxConcurrentRuns
+}
+
+func (o ServerOptions) withDefaults() ServerOptions {
+	if o.DebugLogLimit <= 0 {
+		o.DebugLogLimit = DefaultDebugLogLimit
+	}
+	if o.SendTimeout <= 0 {
+		o.SendTimeout = DefaultSendTimeout
+	}
+	if o.MaxQueuedRuns <= 0 {
+		o.MaxQueuedRuns = DefaultMaxQueuedRuns
+	}
+	if o.ErrorChannelSize <= 0 {
+		o.ErrorChannelSize = DefaultErrorChannelSize
+	}
+	if o.BlobWindowSize <= 0 {
+		o.BlobWindowSize = DefaultBlobWindowSize
+	}
+	if o.DrainPeriod <= 0 {
+		o.DrainPeriod = DefaultDrainPeriod
+	}
+	if o.Metrics == nil {
+		o.Metrics = noopMetrics{}
+	}
+	if o.Tracer == nil {
+		o.Tracer = childSpanTracer{}
+	}
+	o.DecoderLimits = o.DecoderLimits.withDefaults()
+	if o.Format == "" {
+		o.Format = FormatCBOR
+	}
+	return o
+}
+
+// serverSupportedVersions lists the protocol versions the server can speak.
+var serverSupportedVersions = []int64{3, 4}
+
+// legacyClientVersions lists the protocol versions assumed for clients that send an empty start message.
+var legacyClientVersions = []int64{1, 3}
+
 // RunATPServer runs an ArcaflowTransportProtocol server with a given schema.
 func RunATPServer(
 	ctx context.Context,
@@ -18,7 +123,45 @@ func RunATPServer(
 	stdout io.WriteCloser,
 	pluginSchema *schema.CallableSchema,
 ) []*ServerError {
-	session := initializeATPServerSession(ctx, stdin, stdout, pluginSchema)
+	return RunATPServerWithOptions(ctx, stdin, stdout, pluginSchema, ServerOptions{})
+}
+
+// RunATPServerWithOptions runs an ArcaflowTransportProtocol server with a given schema and settings.
+//
+// Cancelling the context shuts the server down: it starts no new runs, cancels the contexts of the running steps, and
+// gives them the drain period to finish. The runs still running after that fail with an error wrapping ErrRunAborted.
+// The server then returns without waiting for stdin to be closed, and sends no further messages.
+func RunATPServerWithOptions(
+	ctx context.Context,
+	stdin io.ReadCloser,
+	stdout io.WriteCloser,
+	pluginSchema *schema.CallableSchema,
+	options ServerOptions,
+) []*ServerError {
+	options = options.withDefaults()
+	decMode, err := options.DecoderLimits.decOptions().DecMode()
+	if err != nil {
+		return []*ServerError{{
+			RunID:       "",
+			Err:         fmt.Errorf("invalid decoder limits (%w)", err),
+			StepFatal:   true,
+			ServerFatal: true,
+		}}
+	}
+	format, err := ParseFormat(string(options.Format))
+	if err != nil {
+		return []*ServerError{{
+			RunID:       "",
+			Err:         err,
+			StepFatal:   true,
+			ServerFatal: true,
+		}}
+	}
+	if format == FormatJSONLines {
+		stdin = jsonLinesReadCloser{newJSONLinesReader(stdin, options.DecoderLimits.MaxMessageSize), stdin}
+		stdout = jsonLinesWriteCloser{&jsonLinesWriter{writer: stdout}, stdout}
+	}
+	session := initializeATPServerSession(ctx, stdin, stdout, pluginSchema, options, decMode)
 	session.wg.Add(1)
 
 	// Run needs to be run in its own goroutine to allow for the closure handling to happen simultaneously.
@@ -27,6 +170,16 @@ func RunATPServer(
 	}()
 
 	workError := session.handleClosure()
+	// Errors reported from now on cannot reach the client anymore.
+	go session.discardErrors()
+	if session.isShuttingDown() {
+		// The read loop may still be waiting for input, and aborted steps may still be running. Closing the streams
+		// ends the read loop, but the aborted steps only get a bounded time to return.
+		_ = stdin.Close()
+		_ = stdout.Close()
+		waitWithTimeout(shutdownWaitTimeout, session.wg)
+		return workError
+	}
 
 	// Ensure that the session is done.
 	session.wg.Wait()
@@ -38,12 +191,34 @@ type atpServerSession struct {
 	wg             *sync.WaitGroup
 	stdinCloser    io.ReadCloser
 	cborStdin      *cbor.Decoder
+	decMode        cbor.DecMode // Decodes the data of the messages with the decoder limits.
 	cborStdout     *cbor.Encoder
-	runningSteps   map[string]string // Maps run ID to step ID
+	stdoutCounter  *countingWriter // Counts the bytes sent, to measure the size of messages.
 	workDone       chan ServerError
 	runDoneChannel chan bool
 	pluginSchema   *schema.CallableSchema
 	encoderMutex   sync.Mutex
+	options        ServerOptions
+	capabilities   []string // The optional features enabled for the session.
+	logStreaming   bool     // Whether step logs are sent as log messages, or buffered until the step is done.
+	blobStreaming  bool     // Whether steps may open blob streams.
+	errorDetails   bool     // Whether error messages carry the kind and details of errors.
+	traceContext   bool     // Whether runs may be started with a trace context.
+	resourceUsage  bool     // Whether work done messages carry the resource usage of the run.
+	runStatus      bool     // Whether the client may query the status of the runs.
+	signalReplies  bool     // Whether the client may ask for the reply of signal handlers.
+	blobLock       sync.Mutex
+	runBlobStreams map[string]*blobStreams // Maps run ID to the blob streams of the run
+	blobsAborted   bool                    // Set once the client can no longer acknowledge blob data.
+	runLock        sync.Mutex
+	activeRuns     map[string]*activeRun // Maps run ID to the state of the runs that are not done yet.
+	runQueue       []queuedRun           // The runs waiting for a run worker, oldest first. Guarded by runLock.
+	runQueueCond   *sync.Cond            // Wakes the run workers. Nil if the concurrent runs are not limited.
+	runQueueClosed bool                  // Set once no more runs are queued. Guarded by runLock.
+	activeRunsWG   sync.WaitGroup
+	signalsWG      sync.WaitGroup // Counts the signal handlers that are running.
+	shuttingDown   bool           // Set once the context is cancelled, after which no new runs are started.
+	outputClosed   bool           // Set once the server stopped sending messages. Guarded by encoderMutex.
 }
 
 type ServerError struct {
@@ -51,54 +226,91 @@ type ServerError struct {
 	Err         error
 	StepFatal   bool
 	ServerFatal bool
+	debugLogs   string    // Debug logs of the failed run, sent along with the error message.
+	kind        ErrorKind // The kind of the error, if it cannot be told from the error types Err wraps.
+	stackTrace  string    // The stack trace of a panic.
+	traceParent string    // The trace context of the span of the failed run, if any.
 }
 
 func (e ServerError) String() string {
 	return fmt.Sprintf("RunID: '%s', err: %s, step fatal: %t, server fatal: %t", e.RunID, e.Err, e.StepFatal, e.ServerFatal)
 }
 
+// lastSessionID is the ID of the last server session started by the process.
+var lastSessionID atomic.Uint64
+
 func initializeATPServerSession(
 	ctx context.Context,
 	stdin io.ReadCloser,
 	stdout io.WriteCloser,
 	pluginSchema *schema.CallableSchema,
+	options ServerOptions,
+	decMode cbor.DecMode,
 ) *atpServerSession {
-	workDone := make(chan ServerError, 3)
+	workDone := make(chan ServerError, options.ErrorChannelSize)
 	// The ATP protocol uses CBOR.
-	cborStdin := cbor.NewDecoder(stdin)
-	cborStdout := cbor.NewEncoder(stdout)
+	cborStdin := options.DecoderLimits.newLimitedDecoder(decMode, stdin)
+	stdoutCounter := &countingWriter{Writer: stdout}
+	cborStdout := cbor.NewEncoder(stdoutCounter)
 	runDoneChannel := make(chan bool, 3) // Buffer to prevent it from hanging if something unexpected happens.
-
-	return &atpServerSession{
-		ctx:            ctx,
+	session := &atpServerSession{
+		// Run IDs are only unique within the session, while the schema may be shared with other sessions.
+		ctx:            schema.WithSession(ctx, fmt.Sprintf("atp-%d", lastSessionID.Add(1))),
 		cborStdin:      cborStdin,
+		decMode:        decMode,
 		stdinCloser:    stdin,
 		cborStdout:     cborStdout,
+		stdoutCounter:  stdoutCounter,
 		workDone:       workDone,
 		runDoneChannel: runDoneChannel,
 		pluginSchema:   pluginSchema,
 		wg:             &sync.WaitGroup{},
-		runningSteps:   make(map[string]string),
+		options:        options,
+		runBlobStreams: make(map[string]*blobStreams),
+		activeRuns:     make(map[string]*activeRun),
+	}
+	if options.MaxConcurrentRuns > 0 {
+		session.runQueueCond = sync.NewCond(&session.runLock)
 	}
+	return session
 }
 
 func (s *atpServerSession) sendRuntimeMessage(msgID uint32, runID string, message any) error {
+	return s.sendTracedRuntimeMessage(msgID, runID, "", message)
+}
+
+// sendTracedRuntimeMessage sends a runtime message that carries the trace context of the span of the run, if any.
+func (s *atpServerSession) sendTracedRuntimeMessage(msgID uint32, runID string, traceParent string, message any) error {
+	waitStart := time.Now()
 	s.encoderMutex.Lock()
+	if runID != "" {
+		s.options.Metrics.ObserveDuration(runID, MetricEncoderWait, time.Since(waitStart))
+	}
+	if s.outputClosed {
+		s.encoderMutex.Unlock()
+		return fmt.Errorf("cannot send message ID %d for run id %q, the server is stopped", msgID, runID)
+	}
 	doneChannel := make(chan error, 1)
 	go func() {
 		defer close(doneChannel)
-		doneChannel <- s.cborStdout.Encode(RuntimeMessage{
+		written := s.stdoutCounter.written.Load()
+		err := s.cborStdout.Encode(RuntimeMessage{
 			MessageID:   msgID,
 			RunID:       runID,
 			MessageData: message,
+			TraceParent: traceParent,
 		})
+		if runID != "" {
+			s.options.Metrics.AddCount(runID, MetricBytesOut, s.stdoutCounter.written.Load()-written)
+		}
+		doneChannel <- err
 	}()
 	defer s.encoderMutex.Unlock()
 	select {
 	case err := <-doneChannel:
 		return err
-	case <-time.After(time.Second * 60):
-		return fmt.Errorf("send timeout exceeded while sending message ID %q for run id %q", msgID, runID)
+	case <-time.After(s.options.SendTimeout):
+		return fmt.Errorf("send timeout exceeded while sending message ID %d for run id %q", msgID, runID)
 	}
 }
 
@@ -113,19 +325,7 @@ closeLoop:
 				break closeLoop
 			}
 			errors = append(errors, &errorSent)
-			err := s.sendRuntimeMessage(
-				MessageTypeError,
-				errorSent.RunID,
-				ErrorMessage{
-					Error:       errorSent.Err.Error(),
-					StepFatal:   errorSent.StepFatal,
-					ServerFatal: errorSent.ServerFatal,
-				},
-			)
-			// If that didn't send, just send to stderr now.
-			if err != nil {
-				_, _ = fmt.Fprintf(os.Stderr, "error while sending error message: %s\n", err)
-			}
+			err := s.reportError(errorSent)
 			// If either the error report sending failed, or the error was server fatal, stop here.
 			if err != nil || errorSent.ServerFatal {
 				err = s.stdinCloser.Close()
@@ -141,20 +341,43 @@ closeLoop:
 				}
 			}
 		case <-s.ctx.Done():
-			// Likely got sigterm. Just close. Ideally gracefully.
-			break closeLoop
+			// Likely got sigterm, so let the running steps finish first.
+			return append(errors, s.shutDown()...)
 		}
 	}
 	// Now close the pipe that it gets input from.
 	return errors
 }
 
+// reportError passes the error to the OnError function, and sends it to the client.
+func (s *atpServerSession) reportError(errorSent ServerError) error {
+	if s.options.OnError != nil {
+		s.options.OnError(errorSent)
+	}
+	errorMessage := ErrorMessage{
+		Error:       errorSent.Err.Error(),
+		StepFatal:   errorSent.StepFatal,
+		ServerFatal: errorSent.ServerFatal,
+		DebugLogs:   errorSent.debugLogs,
+	}
+	if s.errorDetails {
+		errorMessage.addDetails(errorSent)
+	}
+	err := s.sendTracedRuntimeMessage(MessageTypeError, errorSent.RunID, errorSent.traceParent, errorMessage)
+	// If that didn't send, just send to stderr now.
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "error while sending error message: %s\n", err)
+	}
+	return err
+}
+
 func (s *atpServerSession) runATPReadLoop() {
 	// The message is generic, so we must find the type and decode the full message next.
 	var runtimeMessage DecodedRuntimeMessage
 	for {
 		// First, decode the message
 		// Note: This blocks. To abort early, close stdin.
+		bytesRead := s.cborStdin.NumBytesRead()
 		if err := s.cborStdin.Decode(&runtimeMessage); err != nil {
 			// Failed to decode. If it's done, that's okay. If not, there's a problem.
 			done := false
@@ -169,10 +392,16 @@ func (s *atpServerSession) runATPReadLoop() {
 					Err:         fmt.Errorf("failed to read or decode runtime message: %w", err),
 					StepFatal:   true,
 					ServerFatal: true,
+					kind:        ErrorKindProtocol,
 				}
 			} // If done, it didn't get the work done message, which is not ideal.
 			return
 		}
+		if runtimeMessage.RunID != "" {
+			s.options.Metrics.AddCount(
+				runtimeMessage.RunID, MetricBytesIn, int64(s.cborStdin.NumBytesRead()-bytesRead),
+			)
+		}
 		done := s.onRuntimeMessageReceived(&runtimeMessage)
 		if done {
 			return
@@ -187,12 +416,13 @@ func (s *atpServerSession) onRuntimeMessageReceived(message *DecodedRuntimeMessa
 	switch message.MessageID {
 	case MessageTypeWorkStart:
 		var workStartMsg WorkStartMessage
-		if err := cbor.Unmarshal(message.RawMessageData, &workStartMsg); err != nil {
+		if err := s.decMode.Unmarshal(message.RawMessageData, &workStartMsg); err != nil {
 			s.workDone <- ServerError{
 				RunID:       runID,
 				Err:         fmt.Errorf("failed to decode work start message: %w", err),
 				StepFatal:   true,
 				ServerFatal: false,
+				kind:        ErrorKindProtocol,
 			}
 			return false
 		}
@@ -200,17 +430,46 @@ func (s *atpServerSession) onRuntimeMessageReceived(message *DecodedRuntimeMessa
 		return false
 	case MessageTypeSignal:
 		var signalMessage SignalMessage
-		if err := cbor.Unmarshal(message.RawMessageData, &signalMessage); err != nil {
+		if err := s.decMode.Unmarshal(message.RawMessageData, &signalMessage); err != nil {
 			s.workDone <- ServerError{
 				RunID:       runID,
 				Err:         fmt.Errorf("failed to decode signal message: %w", err),
 				StepFatal:   false,
 				ServerFatal: false,
+				kind:        ErrorKindProtocol,
 			}
 			return false
 		}
 		s.handleSignalMessage(runID, signalMessage)
 
+		return false
+	case MessageTypeBlobAck:
+		var ackMessage BlobAckMessage
+		if err := s.decMode.Unmarshal(message.RawMessageData, &ackMessage); err != nil {
+			s.workDone <- ServerError{
+				RunID:       runID,
+				Err:         fmt.Errorf("failed to decode blob ack message: %w", err),
+				StepFatal:   false,
+				ServerFatal: false,
+				kind:        ErrorKindProtocol,
+			}
+			return false
+		}
+		s.handleBlobAckMessage(runID, ackMessage)
+		return false
+	case MessageTypeRunStatusRequest:
+		var requestMessage RunStatusRequestMessage
+		if err := s.decMode.Unmarshal(message.RawMessageData, &requestMessage); err != nil {
+			s.workDone <- ServerError{
+				RunID:       runID,
+				Err:         fmt.Errorf("failed to decode run status request message: %w", err),
+				StepFatal:   false,
+				ServerFatal: false,
+				kind:        ErrorKindProtocol,
+			}
+			return false
+		}
+		s.handleRunStatusRequest(runID, requestMessage)
 		return false
 	case MessageTypeClientDone:
 		// It's now safe to close the channel
@@ -233,6 +492,7 @@ func (s *atpServerSession) onRuntimeMessageReceived(message *DecodedRuntimeMessa
 				message.MessageID),
 			StepFatal:   false,
 			ServerFatal: false,
+			kind:        ErrorKindProtocol,
 		}
 		return false
 	}
@@ -249,16 +509,141 @@ func (s *atpServerSession) handleWorkStartMessage(runID string, workStartMsg Wor
 		}
 		return
 	}
-	s.runningSteps[runID] = workStartMsg.StepID
+	if err := s.addActiveRun(runID, workStartMsg.StepID); err != nil {
+		s.workDone <- ServerError{
+			RunID: runID,
+			Err:   fmt.Errorf("cannot start run (%w)", err),
+			// The run that already uses the run ID goes on, so the client must not fail it.
+			StepFatal:   !errors.Is(err, errRunIDInUse),
+			ServerFatal: false,
+		}
+		return
+	}
+	run := queuedRun{runID, workStartMsg, time.Now()}
+	if s.runQueueCond != nil {
+		s.queueRun(run)
+		return
+	}
 	s.wg.Add(1) // Wait until the step is done
 	go func() {
-		s.runStep(runID, workStartMsg)
-		s.wg.Done()
+		defer s.wg.Done()
+		s.executeRun(run)
 	}()
 }
 
+// queuedRun is a run waiting for a run worker if the concurrent runs are limited.
+type queuedRun struct {
+	runID     string
+	workStart WorkStartMessage
+	received  time.Time
+}
+
+func (s *atpServerSession) queueRun(run queuedRun) {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	s.runQueue = append(s.runQueue, run)
+	s.runQueueCond.Signal()
+}
+
+// nextQueuedRun waits for a run to be queued, and removes it from the queue. Returns false once the queue is closed
+// and empty.
+func (s *atpServerSession) nextQueuedRun() (queuedRun, bool) {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	for len(s.runQueue) == 0 && !s.runQueueClosed {
+		s.runQueueCond.Wait()
+	}
+	if len(s.runQueue) == 0 {
+		return queuedRun{}, false
+	}
+	run := s.runQueue[0]
+	s.runQueue = s.runQueue[1:]
+	return run, true
+}
+
+// closeRunQueue stops the run workers once the queue is empty.
+func (s *atpServerSession) closeRunQueue() {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	s.runQueueClosed = true
+	s.runQueueCond.Broadcast()
+}
+
+// runWorker executes the queued runs in the order they were received, until the queue is closed.
+func (s *atpServerSession) runWorker() {
+	defer s.wg.Done()
+	for {
+		run, ok := s.nextQueuedRun()
+		if !ok {
+			return
+		}
+		if s.ctx.Err() != nil {
+			s.rejectQueuedRun(run)
+			continue
+		}
+		s.executeRun(run)
+	}
+}
+
+// rejectQueuedRuns fails the runs waiting in the queue, because the server shuts down.
+func (s *atpServerSession) rejectQueuedRuns() {
+	s.runLock.Lock()
+	runs := s.runQueue
+	s.runQueue = nil
+	s.runLock.Unlock()
+	for _, run := range runs {
+		s.rejectQueuedRun(run)
+	}
+}
+
+// cancelQueuedRun removes the run from the queue and fails it, since its step was not started yet. Returns false if
+// the run is not queued.
+func (s *atpServerSession) cancelQueuedRun(runID string) bool {
+	s.runLock.Lock()
+	index := slices.IndexFunc(s.runQueue, func(run queuedRun) bool {
+		return run.runID == runID
+	})
+	if index < 0 {
+		s.runLock.Unlock()
+		return false
+	}
+	s.runQueue = slices.Delete(s.runQueue, index, index+1)
+	s.runLock.Unlock()
+	s.workDone <- ServerError{
+		RunID:       runID,
+		Err:         fmt.Errorf("queued run cancelled (%w)", schema.StepCancelledError{RunID: runID}),
+		StepFatal:   true,
+		ServerFatal: false,
+	}
+	s.removeActiveRun(runID)
+	return true
+}
+
+func (s *atpServerSession) rejectQueuedRun(run queuedRun) {
+	s.workDone <- ServerError{
+		RunID:       run.runID,
+		Err:         fmt.Errorf("cannot start queued run (%w)", ErrServerShuttingDown),
+		StepFatal:   true,
+		ServerFatal: false,
+	}
+	s.removeActiveRun(run.runID)
+}
+
+func (s *atpServerSession) executeRun(run queuedRun) {
+	defer s.removeActiveRun(run.runID)
+	defer func() {
+		s.options.Metrics.ObserveDuration(run.runID, MetricRunDuration, time.Since(run.received))
+	}()
+	s.runStep(run.runID, run.workStart)
+}
+
 func (s *atpServerSession) handleSignalMessage(runID string, signalMessage SignalMessage) {
+	replyRequested := s.signalReplies && signalMessage.RequestID != 0
 	if runID == "" {
+		if replyRequested {
+			s.sendSignalReply(runID, signalMessage, nil, fmt.Errorf("run ID missing"))
+			return
+		}
 		s.workDone <- ServerError{
 			RunID:       "",
 			Err:         fmt.Errorf("RunID missing for signal '%s' in signal message", signalMessage.SignalID),
@@ -267,8 +652,12 @@ func (s *atpServerSession) handleSignalMessage(runID string, signalMessage Signa
 		}
 		return
 	}
-	stepID, found := s.runningSteps[runID]
+	stepID, found := s.activeRunStepID(runID)
 	if !found {
+		if replyRequested {
+			s.sendSignalReply(runID, signalMessage, nil, fmt.Errorf("unknown run ID '%s'", runID))
+			return
+		}
 		s.workDone <- ServerError{
 			RunID:       runID,
 			Err:         fmt.Errorf("unknown step with run ID '%s' in signal mesage", runID),
@@ -277,15 +666,35 @@ func (s *atpServerSession) handleSignalMessage(runID string, signalMessage Signa
 		}
 		return
 	}
+	s.options.Metrics.AddCount(runID, MetricSignalsReceived, 1)
+	if cancelSignalID, ok := s.pluginSchema.CancellationSignalID(); ok && signalMessage.SignalID == cancelSignalID &&
+		s.runQueueCond != nil && s.cancelQueuedRun(runID) {
+		// The step was never started, so it has nothing to cancel.
+		if replyRequested {
+			s.sendSignalReply(runID, signalMessage, nil, nil)
+		}
+		return
+	}
 	s.wg.Add(1) // Wait until the signal handler is done
+	s.signalsWG.Add(1)
 	go func() {
-		if err := s.pluginSchema.CallSignal(
-			s.ctx,
+		defer s.signalsWG.Done()
+		ctx := s.ctx
+		var reply *schema.SignalReply
+		if replyRequested {
+			reply = &schema.SignalReply{}
+			ctx = schema.WithSignalReply(ctx, reply)
+		}
+		err := s.pluginSchema.CallSignal(
+			ctx,
 			runID,
 			stepID,
 			signalMessage.SignalID,
 			signalMessage.Data,
-		); err != nil {
+		)
+		if replyRequested {
+			s.sendSignalReply(runID, signalMessage, reply.Data, err)
+		} else if err != nil {
 			s.workDone <- ServerError{
 				RunID: runID,
 				Err: fmt.Errorf("failed while running signal ID %s: %w",
@@ -301,9 +710,21 @@ func (s *atpServerSession) handleSignalMessage(runID string, signalMessage Signa
 func (s *atpServerSession) run() {
 	defer func() {
 		s.runDoneChannel <- true
+		if s.runQueueCond != nil {
+			// No runs are started without the read loop, so the run workers can stop once the queue is empty.
+			s.closeRunQueue()
+		}
+		// The steps and signal handlers report their errors on the channel, so it can only be closed once they are
+		// done.
+		s.activeRunsWG.Wait()
+		s.signalsWG.Wait()
 		close(s.workDone)
 		s.wg.Done()
 	}()
+	for i := 0; i < s.options.MaxConcurrentRuns; i++ {
+		s.wg.Add(1)
+		go s.runWorker()
+	}
 
 	err := s.sendInitialMessagesToClient()
 	if err != nil {
@@ -318,40 +739,95 @@ func (s *atpServerSession) run() {
 
 	// Now, loop through stdin inputs until the step ends.
 	s.runATPReadLoop()
+	// Without the read loop, blob data can no longer be acknowledged.
+	s.abortBlobStreams()
 }
 
 func (s *atpServerSession) runStep(runID string, req WorkStartMessage) {
+	s.setRunState(runID, RunStateRunning)
+	span, endSpan := s.startSpan(runID, req)
+	var runErr error
+	defer func() {
+		endSpan(runErr)
+	}()
+	emitter := newServerSignalEmitter(s, runID, req.StepID, span.String())
+	debugLogs := newDebugLogBuffer(s.options.DebugLogLimit)
+	var logWriter log.Writer = debugLogs
+	if s.logStreaming {
+		logWriter = &liveLogWriter{s, runID, debugLogs}
+	}
+	blobs := s.startBlobStreams(runID)
+	stepCtx := withSignalEmitter(s.ctx, emitter)
+	stepCtx = withLogger(stepCtx, log.NewLogger(log.LevelDebug, logWriter))
+	stepCtx = withBlobStreams(stepCtx, blobs)
+	stepCtx = withRunStatusReporter(stepCtx, serverRunStatusReporter{s, runID, req.StepID})
+	timings := &schema.StepTimings{}
+	stepCtx = schema.WithStepTimings(stepCtx, timings)
+	if span.IsValid() {
+		stepCtx = WithTraceContext(stepCtx, span)
+	}
 	// Call the step in the provided callable schema.
 	defer func() {
 		// Handle and properly report panics
 		if r := recover(); r != nil {
+			stackTrace := debug.Stack()
+			// Steps may be run in a different goroutine, which re-panics with the stack of the goroutine.
+			if panicWithStack, ok := r.(schema.PanicWithStack); ok {
+				stackTrace = panicWithStack.Stack
+			}
+			s.setRunState(runID, RunStateFinishing)
+			emitter.close()
+			s.finishBlobStreams(runID, blobs)
+			runErr = fmt.Errorf("panic while running step with Run ID '%s': (%v)", runID, r)
 			s.workDone <- ServerError{
 				RunID:       runID,
-				Err:         fmt.Errorf("panic while running step with Run ID '%s': (%v)", runID, r),
+				Err:         runErr,
 				StepFatal:   true,
 				ServerFatal: false,
+				debugLogs:   debugLogs.String(),
+				kind:        ErrorKindPanic,
+				stackTrace:  string(stackTrace),
+				traceParent: span.String(),
 			}
 		}
 	}()
-	outputID, outputData, err := s.pluginSchema.CallStep(s.ctx, runID, req.StepID, req.Config)
+	var resourcesAtStart resourceSnapshot
+	if s.resourceUsage {
+		resourcesAtStart = takeResourceSnapshot()
+	}
+	outputID, outputData, err := s.pluginSchema.CallStep(stepCtx, runID, req.StepID, req.Config)
+	s.setRunState(runID, RunStateFinishing)
+	s.observeStepTimings(runID, timings)
+	var resourceUsage *ResourceUsage
+	if s.resourceUsage {
+		resourceUsage = takeResourceSnapshot().usageSince(resourcesAtStart)
+	}
+	// The step is done, so no signals may be emitted after this point, and the open blob streams end.
+	emitter.close()
+	s.finishBlobStreams(runID, blobs)
 	if err != nil {
+		runErr = fmt.Errorf("error calling step (%w)", err)
 		s.workDone <- ServerError{
 			RunID:       runID,
-			Err:         fmt.Errorf("error calling step (%w)", err),
+			Err:         runErr,
 			StepFatal:   true,
 			ServerFatal: false,
+			debugLogs:   debugLogs.String(),
+			traceParent: span.String(),
 		}
 		return
 	}
 	// Lastly, send the work done message.
-	err = s.sendRuntimeMessage(
+	err = s.sendTracedRuntimeMessage(
 		MessageTypeWorkDone,
 		runID,
+		span.String(),
 		WorkDoneMessage{
-			req.StepID,
-			outputID,
-			outputData,
-			"",
+			StepID:        req.StepID,
+			OutputID:      outputID,
+			OutputData:    outputData,
+			DebugLogs:     debugLogs.String(),
+			ResourceUsage: resourceUsage,
 		},
 	)
 	if err != nil {
@@ -360,24 +836,94 @@ func (s *atpServerSession) runStep(runID string, req WorkStartMessage) {
 	}
 }
 
-func (s *atpServerSession) sendInitialMessagesToClient() error {
-	// Start by serializing the schema, since the protocol requires sending the schema on the hello message.
-	serializedSchema, err := s.pluginSchema.SelfSerialize()
-	if err != nil {
-		return err
+// startSpan starts the span of the run if the client sent a trace context for it. Otherwise, the returned trace
+// context is not valid.
+func (s *atpServerSession) startSpan(runID string, req WorkStartMessage) (TraceContext, func(error)) {
+	if !s.traceContext || req.TraceParent == "" {
+		return TraceContext{}, func(error) {}
 	}
+	// An invalid parent starts a new trace, as the W3C Trace Context specification recommends.
+	parent, _ := ParseTraceParent(req.TraceParent)
+	return s.options.Tracer.StartSpan(s.ctx, runID, req.StepID, parent)
+}
+
+// observeStepTimings records the time the step call spent in the phases it reached.
+func (s *atpServerSession) observeStepTimings(runID string, timings *schema.StepTimings) {
+	for metric, duration := range map[Metric]time.Duration{
+		MetricUnserializeDuration: timings.Unserialize,
+		MetricHandlerDuration:     timings.Handler,
+		MetricSerializeDuration:   timings.Serialize,
+	} {
+		if duration > 0 {
+			s.options.Metrics.ObserveDuration(runID, metric, duration)
+		}
+	}
+}
 
-	// First, the start message, which is just an empty message.
-	var empty any
-	err = s.cborStdin.Decode(&empty)
+func (s *atpServerSession) sendInitialMessagesToClient() error {
+	// First, the start message, which lists the versions and features the client supports.
+	var startMessage *StartMessage
+	err := s.cborStdin.Decode(&startMessage)
 	if err != nil {
 		return fmt.Errorf("failed to CBOR-decode start output message (%w)", err)
 	}
+	version, negotiated := s.negotiate(startMessage)
+	if !negotiated {
+		// Still send the hello message, so the client can report the version mismatch too.
+		version = ProtocolVersion
+	}
+	// The schema only includes the parts of the negotiated features, since clients reject the keys they do not know.
+	serializedSchema, err := s.pluginSchema.SelfSerializeWithOptions(schema.SelfSerializeOptions{
+		RunStatus:     s.runStatus,
+		SignalReplies: s.signalReplies,
+	})
+	if err != nil {
+		return err
+	}
 
 	// Next, send the hello message, which includes the version and schema.
-	err = s.cborStdout.Encode(HelloMessage{ProtocolVersion, serializedSchema})
+	err = s.cborStdout.Encode(HelloMessage{version, serializedSchema, s.capabilities})
 	if err != nil {
 		return fmt.Errorf("failed to CBOR-encode schema (%w)", err)
 	}
+	if !negotiated {
+		return fmt.Errorf(
+			"no common ATP version, client supports %v, server supports %v",
+			startMessage.Versions,
+			serverSupportedVersions,
+		)
+	}
 	return nil
 }
+
+// negotiate chooses the highest protocol version both the client and the server support, and enables the optional
+// features the client asked for that the version supports. Returns false if there is no common version.
+func (s *atpServerSession) negotiate(startMessage *StartMessage) (int64, bool) {
+	if startMessage == nil || len(startMessage.Versions) == 0 {
+		// Clients before ATP v4 send an empty start message.
+		startMessage = &StartMessage{Versions: legacyClientVersions}
+	}
+	version := int64(-1)
+	for _, clientVersion := range startMessage.Versions {
+		if clientVersion > version && slices.Contains(serverSupportedVersions, clientVersion) {
+			version = clientVersion
+		}
+	}
+	if version < 0 {
+		return 0, false
+	}
+	for _, feature := range startMessage.Features {
+		minVersion, supported := featureVersions[feature]
+		if supported && version >= minVersion && !slices.Contains(s.capabilities, feature) {
+			s.capabilities = append(s.capabilities, feature)
+		}
+	}
+	s.logStreaming = slices.Contains(s.capabilities, FeatureLogStreaming)
+	s.blobStreaming = slices.Contains(s.capabilities, FeatureBlobStreaming)
+	s.errorDetails = slices.Contains(s.capabilities, FeatureStructuredErrors)
+	s.traceContext = slices.Contains(s.capabilities, FeatureTraceContext)
+	s.resourceUsage = slices.Contains(s.capabilities, FeatureResourceUsage)
+	s.runStatus = slices.Contains(s.capabilities, FeatureRunStatus)
+	s.signalReplies = slices.Contains(s.capabilities, FeatureSignalReplies)
+	return version, true
+}
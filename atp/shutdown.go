@@ -0,0 +1,192 @@
+package atp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultDrainPeriod is the default time the running steps have to finish after the server context was cancelled.
+const DefaultDrainPeriod = 10 * time.Second
+
+// shutdownWaitTimeout is the time the server waits for the read loop and the aborted steps to return after it closed
+// its input and output at the end of the shutdown.
+const shutdownWaitTimeout = time.Second
+
+// ErrRunAborted is wrapped by the errors of runs the server aborted, because they did not finish within the drain
+// period after the server context was cancelled.
+var ErrRunAborted = errors.New("run aborted")
+
+// ErrServerShuttingDown is wrapped by the errors of runs the server did not start, because the server context was
+// cancelled.
+var ErrServerShuttingDown = errors.New("server is shutting down")
+
+// errRunIDInUse is wrapped by the error of a work start message for a run ID that is already used by an active run.
+var errRunIDInUse = errors.New("the run ID is already in use by an active run")
+
+// shutDown stops the server from starting new runs, and gives the running steps, whose contexts are cancelled along
+// with the server context, the drain period to finish. Steps still running after that are reported as aborted. No
+// messages are sent to the client once shutDown returns, so the client never receives a partial message.
+func (s *atpServerSession) shutDown() []*ServerError {
+	drained := s.startShutdown()
+	drainTimer := time.NewTimer(s.options.DrainPeriod)
+	defer drainTimer.Stop()
+	workDone := s.workDone
+	var errs []*ServerError
+	for {
+		select {
+		case errorSent, wasError := <-workDone:
+			if !wasError {
+				// The read loop ended, but steps may still be running.
+				workDone = nil
+				continue
+			}
+			errs = append(errs, &errorSent)
+			_ = s.reportError(errorSent)
+		case <-drained:
+			// The steps report their errors before they count as done, so these are waiting in the channel now.
+			for workDone != nil {
+				select {
+				case errorSent, wasError := <-workDone:
+					if !wasError {
+						workDone = nil
+						break
+					}
+					errs = append(errs, &errorSent)
+					_ = s.reportError(errorSent)
+				default:
+					workDone = nil
+				}
+			}
+			s.closeOutput()
+			return errs
+		case <-drainTimer.C:
+			errs = append(errs, s.abortRuns()...)
+			s.closeOutput()
+			return errs
+		}
+	}
+}
+
+// startShutdown stops the server from starting new runs, and returns a channel that is closed once the runs that are
+// already running are done.
+func (s *atpServerSession) startShutdown() <-chan struct{} {
+	s.runLock.Lock()
+	s.shuttingDown = true
+	s.runLock.Unlock()
+	if s.runQueueCond != nil {
+		// The run workers may be busy with running steps, so the waiting runs are failed right away.
+		go s.rejectQueuedRuns()
+	}
+	drained := make(chan struct{})
+	go func() {
+		// No runs are added once shuttingDown is set, so the wait group can be waited for safely.
+		s.activeRunsWG.Wait()
+		close(drained)
+	}()
+	return drained
+}
+
+func (s *atpServerSession) isShuttingDown() bool {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	return s.shuttingDown
+}
+
+// abortRuns reports the runs that are still running as failed.
+func (s *atpServerSession) abortRuns() []*ServerError {
+	s.runLock.Lock()
+	abortedRuns := make(map[string]string, len(s.activeRuns))
+	for runID, run := range s.activeRuns {
+		abortedRuns[runID] = run.stepID
+	}
+	s.runLock.Unlock()
+
+	errs := make([]*ServerError, 0, len(abortedRuns))
+	for runID, stepID := range abortedRuns {
+		serverError := ServerError{
+			RunID: runID,
+			Err: fmt.Errorf("%w: step '%s' did not finish within the drain period of %s after the server was stopped",
+				ErrRunAborted, stepID, s.options.DrainPeriod),
+			StepFatal:   true,
+			ServerFatal: false,
+		}
+		errs = append(errs, &serverError)
+		_ = s.reportError(serverError)
+	}
+	return errs
+}
+
+// closeOutput makes sending any further message fail. A message that is being sent is finished first.
+func (s *atpServerSession) closeOutput() {
+	s.encoderMutex.Lock()
+	defer s.encoderMutex.Unlock()
+	s.outputClosed = true
+}
+
+// addActiveRun registers a run that is about to start. Returns an error if the server is shutting down, the run ID is
+// in use, or the run limit is reached, in which case the run must not be started.
+func (s *atpServerSession) addActiveRun(runID string, stepID string) error {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	// The closure handling may not have noticed the cancelled context yet.
+	if s.shuttingDown || s.ctx.Err() != nil {
+		return ErrServerShuttingDown
+	}
+	if _, found := s.activeRuns[runID]; found {
+		return fmt.Errorf("%w: '%s'", errRunIDInUse, runID)
+	}
+	if maxActiveRuns := s.options.maxActiveRuns(); maxActiveRuns > 0 && s.unfinishedRuns() >= maxActiveRuns {
+		if s.options.QueueRuns {
+			return fmt.Errorf("the run queue is full, %d runs are waiting", s.options.MaxQueuedRuns)
+		}
+		return fmt.Errorf("the maximum number of concurrent runs (%d) is reached", s.options.MaxConcurrentRuns)
+	}
+	// The run counts as queued until its step is started.
+	s.activeRuns[runID] = &activeRun{
+		stepID:  stepID,
+		started: time.Now(),
+		state:   RunStateQueued,
+	}
+	s.activeRunsWG.Add(1)
+	return nil
+}
+
+// unfinishedRuns returns the number of active runs whose step did not return yet. The runs that are finishing only send
+// their result, so they do not count against the run limit, and the client can start the next run as soon as it
+// receives the result. The caller must have the run lock locked.
+func (s *atpServerSession) unfinishedRuns() int {
+	count := 0
+	for _, run := range s.activeRuns {
+		if run.state != RunStateFinishing {
+			count++
+		}
+	}
+	return count
+}
+
+// activeRunStepID returns the step ID of the run, if it is not done yet.
+func (s *atpServerSession) activeRunStepID(runID string) (string, bool) {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	run, found := s.activeRuns[runID]
+	if !found {
+		return "", false
+	}
+	return run.stepID, true
+}
+
+func (s *atpServerSession) removeActiveRun(runID string) {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	delete(s.activeRuns, runID)
+	s.activeRunsWG.Done()
+}
+
+// discardErrors drops the errors reported after the server stopped, so the goroutines reporting them do not block.
+// These are mostly read errors caused by closing the input after the server returned.
+func (s *atpServerSession) discardErrors() {
+	for range s.workDone {
+		// Nothing can be done with them.
+	}
+}
@@ -0,0 +1,142 @@
+package atp_test
+
+import (
+	"context"
+	"errors"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/plugin"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestProtocol_Server_Shutdown(t *testing.T) {
+	// Cancelling the server context must cancel the running steps, and give them the drain period to finish. Runs
+	// started during the drain period, and runs still running after it, must fail.
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	serverErrors := make(chan []*atp.ServerError, 1)
+	go func() {
+		serverErrors <- atp.RunATPServerWithOptions(
+			ctx,
+			stdinReader,
+			stdoutWriter,
+			newCancellableSchema(release),
+			atp.ServerOptions{DrainPeriod: 500 * time.Millisecond},
+		)
+		_ = stdoutWriter.Close()
+	}()
+
+	cli := atp.NewClientWithLogger(channel{
+		Reader:  stdoutReader,
+		Writer:  stdinWriter,
+		Context: nil,
+		cancel:  func() {},
+	}, log.NewTestLogger(t))
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	handles := map[string]atp.RunHandle{}
+	for _, name := range []string{"Arca Lot", "stubborn"} {
+		handles[name], err = cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+			RunID:     t.Name() + "_" + name,
+			ID:        "hello-world",
+			InputData: map[string]any{"name": name},
+		})
+		assert.NoError(t, err)
+	}
+	// The server answers the status request after it handled the work start messages, so the runs started first.
+	runs, err := cli.(atp.RunStatusQuerier).QueryRunStatus(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Equals(t, len(runs), 2)
+	cancel()
+	lateHandle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name() + "_late",
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+
+	result := handles["Arca Lot"].Wait()
+	assert.NoError(t, result.Error)
+	assert.Equals(t, result.OutputID, "success")
+	result = lateHandle.Wait()
+	assert.Error(t, result.Error)
+	assert.Contains(t, result.Error.Error(), atp.ErrServerShuttingDown.Error())
+	result = handles["stubborn"].Wait()
+	assert.Error(t, result.Error)
+	assert.Contains(t, result.Error.Error(), atp.ErrRunAborted.Error())
+
+	errs := <-serverErrors
+	assert.Equals(t, len(errs), 2)
+	for _, serverError := range errs {
+		assert.Equals(t, serverError.ServerFatal, false)
+		if !errors.Is(serverError.Err, atp.ErrServerShuttingDown) && !errors.Is(serverError.Err, atp.ErrRunAborted) {
+			t.Fatalf("unexpected server error: %s", serverError)
+		}
+	}
+	// The server closed its input once it stopped, so the client done message cannot be sent anymore.
+	assert.Error(t, cli.Close())
+}
+
+func TestProtocol_Server_Shutdown_Idle(t *testing.T) {
+	// Without running steps, cancelling the context must stop the server right away, even if the client is still
+	// connected.
+	ctx, cancel := context.WithCancel(context.Background())
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	defer func() {
+		_ = stdinWriter.Close()
+	}()
+	serverErrors := make(chan []*atp.ServerError, 1)
+	go func() {
+		serverErrors <- atp.RunATPServer(ctx, stdinReader, stdoutWriter, helloWorldSchema)
+		_ = stdoutWriter.Close()
+	}()
+	cli := atp.NewClientWithLogger(channel{
+		Reader:  stdoutReader,
+		Writer:  stdinWriter,
+		Context: nil,
+		cancel:  func() {},
+	}, log.NewTestLogger(t))
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	cancel()
+	select {
+	case errs := <-serverErrors:
+		assert.Equals(t, len(errs), 0)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server did not stop after the context was cancelled")
+	}
+}
+
+func TestStartPlugin_SIGTERM(t *testing.T) {
+	// A plugin stopped by SIGTERM must exit with the stopped exit code instead of failing.
+	t.Setenv(runPluginEnv, "1")
+	logBuffer := &lockedBufferWriter{BufferWriter: log.NewBufferWriter()}
+	cli, process, err := atp.StartPlugin(context.Background(), os.Args[0], nil, atp.PluginOptions{
+		ClientOptions: atp.ClientOptions{Logger: log.NewLogger(log.LevelDebug, logBuffer)},
+	})
+	assert.NoError(t, err)
+	_, err = cli.ReadSchema()
+	assert.NoError(t, err)
+	pluginProcess, err := os.FindProcess(process.Pid())
+	assert.NoError(t, err)
+	assert.NoError(t, pluginProcess.Signal(syscall.SIGTERM))
+	assert.Error(t, process.Wait())
+	assert.Equals(t, process.ExitCode(), plugin.ExitCodeStopped)
+	if strings.Contains(logBuffer.String(), "panic") {
+		t.Fatalf("plugin panicked on SIGTERM: %s", logBuffer.String())
+	}
+	// The plugin ended the session without the client done message, so closing the client may fail.
+	_ = cli.Close()
+}
@@ -0,0 +1,105 @@
+package atp
+
+import (
+	"context"
+	"fmt"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"sync"
+)
+
+// SignalEmitter sends signals from a running step to the client. Step handlers running in an ATP server can obtain
+// one from the context they were called with using GetSignalEmitter.
+type SignalEmitter interface {
+	// EmitSignal validates the data against the signal emitter schema declared by the step, serializes it, and sends
+	// it to the client as a signal for the current run.
+	EmitSignal(signalID string, data any) error
+}
+
+type signalEmitterContextKey struct{}
+
+// GetSignalEmitter returns the signal emitter for the step run the context belongs to. It returns nil if the context
+// was not passed to a step handler by the ATP server.
+func GetSignalEmitter(ctx context.Context) SignalEmitter {
+	emitter, _ := ctx.Value(signalEmitterContextKey{}).(SignalEmitter)
+	return emitter
+}
+
+func withSignalEmitter(ctx context.Context, emitter SignalEmitter) context.Context {
+	return context.WithValue(ctx, signalEmitterContextKey{}, emitter)
+}
+
+type serverSignalEmitter struct {
+	session     *atpServerSession
+	runID       string
+	step        schema.Step
+	traceParent string // The trace context of the span of the run, sent with the signals.
+	lock        sync.RWMutex
+	done        bool
+}
+
+func newServerSignalEmitter(
+	session *atpServerSession,
+	runID string,
+	stepID string,
+	traceParent string,
+) *serverSignalEmitter {
+	var step schema.Step
+	if callableStep, found := session.pluginSchema.StepsValue[stepID]; found {
+		step = callableStep
+	}
+	return &serverSignalEmitter{
+		session:     session,
+		runID:       runID,
+		step:        step,
+		traceParent: traceParent,
+	}
+}
+
+func (e *serverSignalEmitter) EmitSignal(signalID string, data any) error {
+	// The read lock is held until the signal is sent, so close() cannot complete while a signal is in flight.
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.done {
+		return schema.IllegalStateError{
+			Cause: fmt.Errorf("cannot emit signal '%s' after run '%s' finished", signalID, e.runID),
+		}
+	}
+	if e.step == nil {
+		return schema.BadArgumentError{
+			Message: fmt.Sprintf("cannot emit signal '%s' for run '%s' of an unknown step", signalID, e.runID),
+		}
+	}
+	signalSchema, found := e.step.SignalEmitters()[signalID]
+	if !found {
+		return schema.BadArgumentError{
+			Message: fmt.Sprintf("step '%s' does not declare an emitted signal with ID '%s'", e.step.ID(), signalID),
+		}
+	}
+	serializedData, err := signalSchema.DataSchema().Serialize(data)
+	if err != nil {
+		return schema.BadArgumentError{
+			Message: fmt.Sprintf("invalid data for emitted signal '%s'", signalID),
+			Cause:   err,
+		}
+	}
+	if err := e.session.sendTracedRuntimeMessage(
+		MessageTypeSignal,
+		e.runID,
+		e.traceParent,
+		SignalMessage{
+			SignalID: signalID,
+			Data:     serializedData,
+		},
+	); err != nil {
+		return err
+	}
+	e.session.options.Metrics.AddCount(e.runID, MetricSignalsSent, 1)
+	return nil
+}
+
+// close prevents further signals from being emitted once the run is finished.
+func (e *serverSignalEmitter) close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.done = true
+}
@@ -0,0 +1,97 @@
+package atp
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// DefaultSignalReplyTimeout is the default time the client waits for the reply to a signal.
+const DefaultSignalReplyTimeout = 30 * time.Second
+
+// sendSignalReply answers the signal the client asked a reply for with the reply or the error of the signal handler.
+func (s *atpServerSession) sendSignalReply(runID string, signalMessage SignalMessage, reply any, err error) {
+	replyMessage := SignalReplyMessage{
+		RequestID: signalMessage.RequestID,
+		SignalID:  signalMessage.SignalID,
+		Data:      reply,
+	}
+	if err != nil {
+		replyMessage.Data = nil
+		replyMessage.Error = err.Error()
+	}
+	if err := s.sendRuntimeMessage(MessageTypeSignalReply, runID, replyMessage); err != nil {
+		s.workDone <- ServerError{
+			RunID:       runID,
+			Err:         fmt.Errorf("failed to send reply to signal ID %s (%w)", signalMessage.SignalID, err),
+			StepFatal:   false,
+			ServerFatal: false,
+		}
+	}
+}
+
+// signalReplyResult is the answer to a signal the client asked a reply for.
+type signalReplyResult struct {
+	data any
+	err  error
+}
+
+func (h *runHandle) SendSignalWithReply(ctx context.Context, signalID string, data any) (any, error) {
+	c := h.client
+	if !slices.Contains(c.capabilities, FeatureSignalReplies) {
+		return nil, fmt.Errorf("the plugin does not support the '%s' feature", FeatureSignalReplies)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.signalReplyTimeout)
+	defer cancel()
+	c.mutex.Lock()
+	if c.done {
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("cannot send signal '%s', the client is closed", signalID)
+	}
+	c.nextRequestID++
+	requestID := c.nextRequestID
+	replies := make(chan signalReplyResult, 1)
+	c.signalReplyRequests[requestID] = replies
+	c.startReadLoop(c.newDecoder())
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(c.signalReplyRequests, requestID)
+	}()
+
+	if err := h.sendSignal(signalID, data, requestID); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-replies:
+		return reply.data, reply.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no reply to signal '%s' of run '%s' (%w)", signalID, h.input.RunID, ctx.Err())
+	}
+}
+
+func (c *client) handleSignalReplyMessage(runtimeMessage DecodedRuntimeMessage) {
+	var replyMessage SignalReplyMessage
+	if err := c.messageDecMode.Unmarshal(runtimeMessage.RawMessageData, &replyMessage); err != nil {
+		c.logger.Errorf("ATP client for run ID '%s' failed to decode signal reply message: %v",
+			runtimeMessage.RunID, err)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	replies, found := c.signalReplyRequests[replyMessage.RequestID]
+	if !found {
+		c.logger.Debugf("Ignoring reply to signal '%s' of run ID '%s', which is not waited for.",
+			replyMessage.SignalID, runtimeMessage.RunID)
+		return
+	}
+	delete(c.signalReplyRequests, replyMessage.RequestID)
+	if replyMessage.Error != "" {
+		replies <- signalReplyResult{err: fmt.Errorf("signal '%s' of run '%s' failed: %s",
+			replyMessage.SignalID, runtimeMessage.RunID, replyMessage.Error)}
+		return
+	}
+	replies <- signalReplyResult{data: replyMessage.Data}
+}
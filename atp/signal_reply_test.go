@@ -0,0 +1,151 @@
+package atp_test
+
+import (
+	"context"
+	"fmt"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSignalReplySchema creates a schema with a step that waits until the release channel is closed, and a signal
+// handler that replies with the length of the name as progress. The handler fails for the name "fail", and waits
+// until the release channel is closed for the name "slow".
+func newSignalReplySchema(t *testing.T, release <-chan struct{}) *schema.CallableSchema {
+	lengthSignal := schema.NewCallableSignalWithReply(
+		"length",
+		helloWorldInputSchema,
+		progressSignalSchema.DataSchema().(*schema.ScopeSchema),
+		nil,
+		func(_ context.Context, _ any, input helloWorldInput) (progressSignal, error) {
+			switch input.Name {
+			case "fail":
+				return progressSignal{}, fmt.Errorf("cannot measure %s", input.Name)
+			case "slow":
+				<-release
+			}
+			return progressSignal{Percent: int64(len(input.Name))}, nil
+		},
+	)
+	return schema.NewCallableSchema(
+		schema.NewCallableStepWithSignals[any, helloWorldInput](
+			/* id */ "hello-world",
+			/* input */ helloWorldInputSchema,
+			/* outputs */ helloWorldOutputSchemas,
+			/* signal handlers */ map[string]schema.CallableSignal{
+				"length":             lengthSignal,
+				"hello-world-signal": helloWorldCallableSignal,
+			},
+			/* signal emitters */ nil,
+			/* Display */ nil,
+			/* Initializer */ func() any { return t.Name() },
+			/* step handler */ func(ctx context.Context, _ any, input helloWorldInput) (string, any) {
+				<-release
+				return helloWorldStepHandler(ctx, nil, input)
+			},
+		),
+	)
+}
+
+func TestSignalReply(t *testing.T) {
+	release := make(chan struct{})
+	cli := atp.NewInProcessClientWithOptions(
+		newSignalReplySchema(t, release),
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{},
+	)
+	pluginSchema, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	// The reply schema is part of the signal schema.
+	assert.NotNil(t, pluginSchema.StepsValue["hello-world"].SignalHandlers()["length"].ReplySchema())
+	assert.Nil(t, pluginSchema.StepsValue["hello-world"].SignalHandlers()["hello-world-signal"].ReplySchema())
+
+	handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+
+	reply, err := handle.SendSignalWithReply(context.Background(), "length", map[string]any{"name": "Arca Lot"})
+	assert.NoError(t, err)
+	assert.Equals(t, reply.(map[any]any)["percent"].(uint64), 8)
+
+	// Handlers without a reply answer with nil once they are done.
+	reply, err = handle.SendSignalWithReply(context.Background(), "hello-world-signal", map[string]any{"name": "Arca"})
+	assert.NoError(t, err)
+	assert.Nil(t, reply)
+
+	// The error of the handler is returned.
+	_, err = handle.SendSignalWithReply(context.Background(), "length", map[string]any{"name": "fail"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot measure fail")
+
+	// The reply must match the reply schema.
+	_, err = handle.SendSignalWithReply(context.Background(), "length", map[string]any{"name": strings.Repeat("a", 101)})
+	assert.Error(t, err)
+
+	// Unknown signals fail.
+	_, err = handle.SendSignalWithReply(context.Background(), "unknown", map[string]any{"name": "Arca"})
+	assert.Error(t, err)
+
+	close(release)
+	assert.NoError(t, handle.Wait().Error)
+	assert.NoError(t, cli.Close())
+}
+
+func TestSignalReply_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	cli := atp.NewInProcessClientWithOptions(
+		newSignalReplySchema(t, release),
+		atp.ClientOptions{Logger: log.NewTestLogger(t), SignalReplyTimeout: 100 * time.Millisecond},
+		atp.ServerOptions{},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+
+	// The client gives up waiting after the reply timeout.
+	_, err = handle.SendSignalWithReply(context.Background(), "length", map[string]any{"name": "slow"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no reply")
+
+	close(release)
+	assert.NoError(t, handle.Wait().Error)
+	// The late reply fails to send if the client is closed first, which the client reports when closing.
+	_ = cli.Close()
+}
+
+func TestSignalReply_Unsupported(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	cli := atp.NewInProcessClientWithOptions(
+		newSignalReplySchema(t, release),
+		atp.ClientOptions{Logger: log.NewTestLogger(t), Features: []string{}},
+		atp.ServerOptions{},
+	)
+	pluginSchema, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	// Clients without the feature may reject the unknown reply schema key, so it is left out of the schema.
+	assert.Nil(t, pluginSchema.StepsValue["hello-world"].SignalHandlers()["length"].ReplySchema())
+	handle, err := cli.(atp.RunStarter).Start(context.Background(), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+	_, err = handle.SendSignalWithReply(context.Background(), "length", map[string]any{"name": "Arca Lot"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), atp.FeatureSignalReplies)
+	assert.NoError(t, handle.Wait().Error)
+	assert.NoError(t, cli.Close())
+}
@@ -0,0 +1,113 @@
+package atp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// traceParentVersion is the version of the W3C traceparent format the trace contexts are sent in.
+const traceParentVersion = "00"
+
+// TraceContext identifies a span of a distributed trace, in the W3C Trace Context format. The IDs are lowercase hex
+// strings of 32 and 16 characters.
+type TraceContext struct {
+	TraceID string
+	SpanID  string
+	Flags   byte
+}
+
+// ParseTraceParent parses a trace context in the W3C traceparent format, such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceParent(traceParent string) (TraceContext, error) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || parts[0] != traceParentVersion {
+		return TraceContext{}, fmt.Errorf("invalid traceparent '%s', expected the format 00-<trace ID>-<span ID>-<flags>",
+			traceParent)
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || len(parts[3]) != 2 || !isLowerHex(parts[3]) {
+		return TraceContext{}, fmt.Errorf("invalid flags '%s' in traceparent '%s'", parts[3], traceParent)
+	}
+	traceContext := TraceContext{
+		TraceID: parts[1],
+		SpanID:  parts[2],
+		Flags:   byte(flags),
+	}
+	if !traceContext.IsValid() {
+		return TraceContext{}, fmt.Errorf("invalid trace or span ID in traceparent '%s'", traceParent)
+	}
+	return traceContext, nil
+}
+
+// IsValid returns true if the trace and span IDs have the right length, and are not all zeros.
+func (t TraceContext) IsValid() bool {
+	return len(t.TraceID) == 32 && isLowerHex(t.TraceID) && strings.Trim(t.TraceID, "0") != "" &&
+		len(t.SpanID) == 16 && isLowerHex(t.SpanID) && strings.Trim(t.SpanID, "0") != ""
+}
+
+// String returns the trace context in the W3C traceparent format, or an empty string if it is not valid.
+func (t TraceContext) String() string {
+	if !t.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s-%s-%02x", traceParentVersion, t.TraceID, t.SpanID, t.Flags)
+}
+
+// NewChild returns the trace context of a new span in the same trace, with a random span ID. If the trace context is
+// not valid, the new span starts a new trace.
+func (t TraceContext) NewChild() TraceContext {
+	if !t.IsValid() {
+		return TraceContext{TraceID: randomHex(16), SpanID: randomHex(8)}
+	}
+	return TraceContext{TraceID: t.TraceID, SpanID: randomHex(8), Flags: t.Flags}
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(bytes int) string {
+	id := make([]byte, bytes)
+	// Reading random data never fails on the supported platforms.
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+type traceContextKey struct{}
+
+// WithTraceContext returns a context carrying the trace context. The ATP client sends the trace context of the context
+// passed to RunStarter.Start to the plugin as the parent of the run.
+func WithTraceContext(ctx context.Context, traceContext TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, traceContext)
+}
+
+// GetTraceContext returns the trace context carried by the context. The ATP server passes the trace context of the
+// span of the run to the step handler if the client sent one. Returns false if the context carries no trace context.
+func GetTraceContext(ctx context.Context) (TraceContext, bool) {
+	traceContext, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return traceContext, ok
+}
+
+// Tracer creates the spans of the runs, so they can be stitched into the traces of the other side.
+type Tracer interface {
+	// StartSpan starts the span of the run as a child of the parent, which is not valid if the run has no parent.
+	// Returns the trace context of the new span, and a function that ends the span with the error the run failed
+	// with, or nil.
+	StartSpan(ctx context.Context, runID string, stepID string, parent TraceContext) (TraceContext, func(err error))
+}
+
+// childSpanTracer is the tracer used if no tracer is configured. It only creates the IDs of the spans.
+type childSpanTracer struct{}
+
+func (childSpanTracer) StartSpan(_ context.Context, _ string, _ string, parent TraceContext) (TraceContext, func(error)) {
+	return parent.NewChild(), func(error) {}
+}
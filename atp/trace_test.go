@@ -0,0 +1,246 @@
+package atp_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/fxamacker/cbor/v2"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	traceContext, err := atp.ParseTraceParent(traceParent)
+	assert.NoError(t, err)
+	assert.Equals(t, traceContext, atp.TraceContext{
+		TraceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:  "00f067aa0ba902b7",
+		Flags:   1,
+	})
+	assert.Equals(t, traceContext.String(), traceParent)
+
+	for _, invalid := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-00",
+	} {
+		_, err := atp.ParseTraceParent(invalid)
+		assert.Error(t, err)
+	}
+
+	child := traceContext.NewChild()
+	assert.Equals(t, child.TraceID, traceContext.TraceID)
+	assert.Equals(t, child.Flags, traceContext.Flags)
+	assert.Equals(t, child.IsValid(), true)
+	assert.Equals(t, child.SpanID != traceContext.SpanID, true)
+	// Without a parent, a new trace is started.
+	assert.Equals(t, atp.TraceContext{}.NewChild().IsValid(), true)
+	assert.Equals(t, atp.TraceContext{}.String(), "")
+}
+
+// recordingTracer creates child spans and records them.
+type recordingTracer struct {
+	lock    sync.Mutex
+	parents []atp.TraceContext
+	spans   []atp.TraceContext
+	errs    []error
+}
+
+func (r *recordingTracer) StartSpan(
+	_ context.Context,
+	_ string,
+	_ string,
+	parent atp.TraceContext,
+) (atp.TraceContext, func(error)) {
+	span := parent.NewChild()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.parents = append(r.parents, parent)
+	r.spans = append(r.spans, span)
+	return span, func(err error) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.errs = append(r.errs, err)
+	}
+}
+
+// tracedSchema has a step that outputs the trace context it was called with, and emits a signal.
+var tracedSchema = schema.NewCallableSchema(
+	schema.NewCallableStepWithSignals[any, helloWorldInput](
+		/* id */ "hello-world",
+		/* input */ helloWorldInputSchema,
+		/* outputs */ helloWorldOutputSchemas,
+		/* signal handlers */ nil,
+		/* signal emitters */ map[string]*schema.SignalSchema{
+			"progress": progressSignalSchema,
+		},
+		/* Display */ nil,
+		/* Initializer */ nil,
+		/* step handler */ func(ctx context.Context, _ any, input helloWorldInput) (string, any) {
+			if err := atp.GetSignalEmitter(ctx).EmitSignal("progress", progressSignal{Percent: 50}); err != nil {
+				panic(err)
+			}
+			traceContext, found := atp.GetTraceContext(ctx)
+			if !found {
+				return "success", helloWorldOutput{Message: "no trace context"}
+			}
+			return "success", helloWorldOutput{Message: traceContext.String()}
+		},
+	),
+)
+
+func TestTraceContext(t *testing.T) {
+	clientTracer := &recordingTracer{}
+	serverTracer := &recordingTracer{}
+	cli := atp.NewInProcessClientWithOptions(
+		tracedSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t), Tracer: clientTracer},
+		atp.ServerOptions{Tracer: serverTracer},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+
+	parent, err := atp.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.NoError(t, err)
+	handle, err := cli.(atp.RunStarter).Start(atp.WithTraceContext(context.Background(), parent), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+	for range handle.Signals() {
+		// The signals channel is closed once the run is finished.
+	}
+	result := handle.Wait()
+	assert.NoError(t, result.Error)
+	assert.NoError(t, cli.Close())
+
+	// The client's span is a child of the context's span, and the plugin's span a child of the client's span.
+	assert.Equals(t, clientTracer.parents, []atp.TraceContext{parent})
+	assert.Equals(t, serverTracer.parents, clientTracer.spans)
+	assert.Equals(t, len(serverTracer.spans), 1)
+	pluginSpan := serverTracer.spans[0]
+	assert.Equals(t, pluginSpan.TraceID, parent.TraceID)
+	// The step handler gets the plugin's span, and the client gets it back with the result.
+	assert.Equals(t, result.OutputData.(map[any]any)["message"].(string), pluginSpan.String())
+	assert.Equals(t, result.TraceContext, pluginSpan)
+	assert.Equals(t, clientTracer.errs, []error{nil})
+	assert.Equals(t, serverTracer.errs, []error{nil})
+}
+
+func TestTraceContext_Error(t *testing.T) {
+	serverTracer := &recordingTracer{}
+	cli := atp.NewInProcessClientWithOptions(
+		panickingHelloWorldSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{Tracer: serverTracer},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	parent, err := atp.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.NoError(t, err)
+	handle, err := cli.(atp.RunStarter).Start(atp.WithTraceContext(context.Background(), parent), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+	result := handle.Wait()
+	assert.Error(t, result.Error)
+	assert.Error(t, cli.Close())
+	// Without a client tracer, the context's span is the parent of the plugin's span.
+	assert.Equals(t, serverTracer.parents, []atp.TraceContext{parent})
+	assert.Equals(t, result.TraceContext, serverTracer.spans[0])
+	assert.Equals(t, len(serverTracer.errs), 1)
+	assert.Error(t, serverTracer.errs[0])
+}
+
+func TestTraceContext_None(t *testing.T) {
+	// Runs started without a trace context have no span.
+	serverTracer := &recordingTracer{}
+	cli := atp.NewInProcessClientWithOptions(
+		tracedSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t)},
+		atp.ServerOptions{Tracer: serverTracer},
+	)
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	result := cli.Execute(schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.NoError(t, cli.Close())
+	assert.Equals(t, result.OutputData.(map[any]any)["message"].(string), "no trace context")
+	assert.Equals(t, result.TraceContext, atp.TraceContext{})
+	assert.Equals(t, len(serverTracer.spans), 0)
+}
+
+func TestTraceContext_Messages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	go func() {
+		defer wg.Done()
+		errors := atp.RunATPServer(ctx, stdinReader, stdoutWriter, tracedSchema)
+		assert.Equals(t, len(errors), 0)
+	}()
+	recording := &bytes.Buffer{}
+	recordingChannel := atp.NewRecordingChannel(channel{
+		Reader:  stdoutReader,
+		Writer:  stdinWriter,
+		Context: nil,
+		cancel:  cancel,
+	}, recording)
+	cli := atp.NewClientWithLogger(recordingChannel, log.NewTestLogger(t))
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	parent, err := atp.ParseTraceParent(traceParent)
+	assert.NoError(t, err)
+	handle, err := cli.(atp.RunStarter).Start(atp.WithTraceContext(context.Background(), parent), schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	})
+	assert.NoError(t, err)
+	for range handle.Signals() {
+		// The signals channel is closed once the run is finished.
+	}
+	result := handle.Wait()
+	assert.NoError(t, result.Error)
+	assert.NoError(t, cli.Close())
+	wg.Wait()
+	assert.NoError(t, recordingChannel.Close())
+
+	frames, err := atp.ReadRecording(recording)
+	assert.NoError(t, err)
+	// Start, hello, work start, signal, work done, and client done.
+	assert.Equals(t, len(frames), 6)
+	var workStart struct {
+		Data atp.WorkStartMessage `cbor:"data"`
+	}
+	assert.NoError(t, cbor.Unmarshal(frames[2].Data, &workStart))
+	assert.Equals(t, workStart.Data.TraceParent, traceParent)
+	// The signal and the work done message carry the plugin's span of the run.
+	for _, frame := range frames[3:5] {
+		var message atp.DecodedRuntimeMessage
+		assert.NoError(t, cbor.Unmarshal(frame.Data, &message))
+		assert.Equals(t, message.TraceParent, result.TraceContext.String())
+	}
+	assert.Equals(t, result.TraceContext.TraceID, parent.TraceID)
+}
@@ -0,0 +1,62 @@
+package atp
+
+import (
+	"fmt"
+	"go.flow.arcalot.io/pluginsdk/schema"
+)
+
+// stepSchema returns the schema of the step from the schema the plugin sent.
+func (c *client) stepSchema(stepID string) (*schema.StepSchema, error) {
+	if c.pluginSchema == nil {
+		return nil, schema.IllegalStateError{
+			Cause: fmt.Errorf("cannot validate step '%s', the plugin schema was not read yet", stepID),
+		}
+	}
+	step, found := c.pluginSchema.StepsValue[stepID]
+	if !found {
+		return nil, schema.NoSuchStepError{Step: stepID}
+	}
+	return step, nil
+}
+
+// validateInput checks the step ID and input of a run against the plugin schema before it is sent to the plugin, if
+// the client validates steps.
+func (c *client) validateInput(input schema.Input) error {
+	if !c.validateSteps {
+		return nil
+	}
+	step, err := c.stepSchema(input.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := step.Input().Unserialize(input.InputData); err != nil {
+		return schema.InvalidInputError{Cause: err}
+	}
+	return nil
+}
+
+// validateOutput checks the output of a successful run against the output schemas the step declares, if the client
+// validates steps. The output data of the returned result is unserialized with the output schema.
+func (c *client) validateOutput(input schema.Input, result ExecutionResult) ExecutionResult {
+	if !c.validateSteps || result.Error != nil {
+		return result
+	}
+	step, err := c.stepSchema(input.ID)
+	if err != nil {
+		return NewErrorExecutionResult(err)
+	}
+	output, found := step.Outputs()[result.OutputID]
+	if !found {
+		return NewErrorExecutionResult(schema.InvalidOutputError{
+			Cause: fmt.Errorf("undeclared output ID for step '%s': %s", input.ID, result.OutputID),
+		})
+	}
+	outputData, err := output.Unserialize(result.OutputData)
+	if err != nil {
+		return NewErrorExecutionResult(schema.InvalidOutputError{
+			Cause: fmt.Errorf("output '%s' of step '%s' does not match its schema (%w)", result.OutputID, input.ID, err),
+		})
+	}
+	result.OutputData = outputData
+	return result
+}
@@ -0,0 +1,153 @@
+package atp_test
+
+import (
+	"context"
+	"errors"
+	"github.com/fxamacker/cbor/v2"
+	"go.arcalot.io/assert"
+	"go.arcalot.io/log/v2"
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+	"io"
+	"testing"
+)
+
+func newValidatingClient(t *testing.T) atp.Client {
+	cli := atp.NewInProcessClientWithOptions(
+		helloWorldSchema,
+		atp.ClientOptions{Logger: log.NewTestLogger(t), ValidateSteps: true},
+		atp.ServerOptions{},
+	)
+	t.Cleanup(func() {
+		assert.NoError(t, cli.Close())
+	})
+	_, err := cli.ReadSchema()
+	assert.NoError(t, err)
+	return cli
+}
+
+func TestValidatingClient(t *testing.T) {
+	cli := newValidatingClient(t)
+	result := cli.Execute(
+		schema.Input{
+			RunID:     t.Name(),
+			ID:        "hello-world",
+			InputData: map[string]any{"name": "Arca Lot"},
+		}, nil, nil)
+	assert.NoError(t, result.Error)
+	assert.Equals(t, result.OutputID, "success")
+	// The output is unserialized with the output schema the plugin sent.
+	assert.Equals(t, result.OutputData.(map[string]any)["message"].(string), "Hello, Arca Lot!")
+}
+
+func TestValidatingClient_UnknownStep(t *testing.T) {
+	cli := newValidatingClient(t)
+	input := schema.Input{
+		RunID:     t.Name(),
+		ID:        "goodbye-world",
+		InputData: map[string]any{"name": "Arca Lot"},
+	}
+	result := cli.Execute(input, nil, nil)
+	var noSuchStepError schema.NoSuchStepError
+	assert.Equals(t, errors.As(result.Error, &noSuchStepError), true)
+	_, err := cli.(atp.RunStarter).Start(context.Background(), input)
+	assert.Equals(t, errors.As(err, &noSuchStepError), true)
+}
+
+func TestValidatingClient_InvalidInput(t *testing.T) {
+	cli := newValidatingClient(t)
+	input := schema.Input{
+		RunID:     t.Name(),
+		ID:        "hello-world",
+		InputData: map[string]any{},
+	}
+	result := cli.Execute(input, nil, nil)
+	var constraintError *schema.ConstraintError
+	assert.Equals(t, errors.As(result.Error, &constraintError), true)
+	assert.Equals(t, constraintError.Path, []string{"name"})
+	var invalidInputError schema.InvalidInputError
+	assert.Equals(t, errors.As(result.Error, &invalidInputError), true)
+	_, err := cli.(atp.RunStarter).Start(context.Background(), input)
+	assert.Equals(t, errors.As(err, &invalidInputError), true)
+	// The run was rejected by the client, so the run ID can still be used.
+	input.InputData = map[string]any{"name": "Arca Lot"}
+	result = cli.Execute(input, nil, nil)
+	assert.NoError(t, result.Error)
+}
+
+func TestValidatingClient_InvalidOutput(t *testing.T) {
+	testCases := map[string]atp.WorkDoneMessage{
+		"undeclared output ID": {
+			StepID:     "hello-world",
+			OutputID:   "failure",
+			OutputData: map[string]any{"message": "Hello, Arca Lot!"},
+		},
+		"invalid output data": {
+			StepID:     "hello-world",
+			OutputID:   "success",
+			OutputData: map[string]any{"greeting": "Hello, Arca Lot!"},
+		},
+	}
+	for name, doneMessage := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cli := atp.NewClientWithOptions(
+				newFakeServer(t, doneMessage),
+				atp.ClientOptions{Logger: log.NewTestLogger(t), ValidateSteps: true},
+			)
+			_, err := cli.ReadSchema()
+			assert.NoError(t, err)
+			result := cli.Execute(
+				schema.Input{
+					RunID:     t.Name(),
+					ID:        "hello-world",
+					InputData: map[string]any{"name": "Arca Lot"},
+				}, nil, nil)
+			var invalidOutputError schema.InvalidOutputError
+			assert.Equals(t, errors.As(result.Error, &invalidOutputError), true)
+			assert.NoError(t, cli.Close())
+		})
+	}
+}
+
+// newFakeServer returns the client side of a session with a server that answers every work start message with the
+// given work done message, whatever the schema of the step says.
+func newFakeServer(t *testing.T, doneMessage atp.WorkDoneMessage) atp.ClientChannel {
+	serializedSchema, err := helloWorldSchema.SelfSerialize()
+	assert.NoError(t, err)
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	go func() {
+		defer func() {
+			_ = stdoutWriter.Close()
+		}()
+		decoder := cbor.NewDecoder(stdinReader)
+		encoder := cbor.NewEncoder(stdoutWriter)
+		var startMessage atp.StartMessage
+		if decoder.Decode(&startMessage) != nil ||
+			encoder.Encode(atp.HelloMessage{Version: atp.ProtocolVersion, Schema: serializedSchema}) != nil {
+			return
+		}
+		for {
+			var message atp.DecodedRuntimeMessage
+			if decoder.Decode(&message) != nil || message.MessageID == atp.MessageTypeClientDone {
+				return
+			}
+			if message.MessageID != atp.MessageTypeWorkStart {
+				continue
+			}
+			if encoder.Encode(atp.RuntimeMessage{
+				MessageID:   atp.MessageTypeWorkDone,
+				RunID:       message.RunID,
+				MessageData: doneMessage,
+			}) != nil {
+				return
+			}
+		}
+	}()
+	return channel{
+		Reader:  stdoutReader,
+		Writer:  stdinWriter,
+		Context: nil,
+		cancel:  func() {},
+	}
+}
@@ -2,8 +2,14 @@ package plugin
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
 
 	"go.flow.arcalot.io/pluginsdk/atp"
 	"go.flow.arcalot.io/pluginsdk/schema"
@@ -11,9 +17,26 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// Exit codes of a plugin started with Run.
+const (
+	// ExitCodeOK means the ATP server finished without errors.
+	ExitCodeOK = 0
+	// ExitCodeFailed means the plugin failed, or the ATP server reported errors.
+	ExitCodeFailed = 1
+	// ExitCodeStopped means the ATP server was stopped by SIGTERM or SIGINT, and all runs finished in time.
+	ExitCodeStopped = 3
+	// ExitCodeRunsAborted means the ATP server was stopped by SIGTERM or SIGINT, and aborted runs that did not
+	// finish within the drain period.
+	ExitCodeRunsAborted = 4
+)
+
 func printUsage() {
-	fmt.Println("At least one of --atp, --schema, or --json-schema must be specified")
+	fmt.Println("At least one of --atp, --atp-listen, --schema, or --json-schema must be specified")
 	fmt.Println("--atp runs the ATP server to interface with the arcaflow engine.")
+	fmt.Println("--atp-listen unix:///path/to/socket or --atp-listen tcp://host:port runs the ATP server on a" +
+		" socket, with one session per connection.")
+	fmt.Println("--atp-format jsonl makes --atp or --atp-listen encode the ATP messages as JSON lines instead of" +
+		" CBOR, for debugging.")
 	fmt.Println("--schema outputs the arcaflow schema of the plugin as YAML")
 	fmt.Println("--json-schema outputs the schema of a specific step's input or output" +
 		" according to standardized formats for use with other applications, like" +
@@ -24,18 +47,38 @@ func printUsage() {
 // This is not required, but is recommended for standardization
 // of the interface between plugins.
 // Allows running ATP or exporting schema.
+//
+// On SIGTERM or SIGINT, the ATP server stops starting new runs, and gives the running steps the drain period to
+// finish. The process then exits with ExitCodeStopped, or ExitCodeRunsAborted if steps did not finish in time.
 func Run(s *schema.CallableSchema) {
-	if len(os.Args) != 2 {
+	RunWithOptions(s, atp.ServerOptions{})
+}
+
+// RunWithOptions is Run with the given ATP server settings.
+func RunWithOptions(s *schema.CallableSchema, options atp.ServerOptions) {
+	args, format, err := parseFormatArgs(os.Args[1:])
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
 		printUsage()
 		os.Exit(1)
 	}
-	switch os.Args[1] {
+	if format != "" {
+		options.Format = format
+	}
+	if listenAddress, ok := parseListenArgs(args); ok {
+		if exitCode := runListener(s, listenAddress, options); exitCode != ExitCodeOK {
+			os.Exit(exitCode)
+		}
+		return
+	}
+	if len(args) != 1 {
+		printUsage()
+		os.Exit(1)
+	}
+	switch args[0] {
 	case "--atp":
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		if err := atp.RunATPServer(ctx, os.Stdin, os.Stdout, s); err != nil {
-			panic(err)
+		if exitCode := runATP(s, options); exitCode != ExitCodeOK {
+			os.Exit(exitCode)
 		}
 	case "--schema":
 		serializedSchema, err := s.SelfSerialize()
@@ -53,8 +96,97 @@ func Run(s *schema.CallableSchema) {
 		_, _ = os.Stderr.WriteString("Json schema currently isn't supported by the Go SDK plugins.\n")
 		os.Exit(1)
 	default:
-		_, _ = fmt.Fprintf(os.Stderr, "%q is not a supported input.\n", os.Args[1])
+		_, _ = fmt.Fprintf(os.Stderr, "%q is not a supported input.\n", args[0])
 		printUsage()
 		os.Exit(1)
 	}
 }
+
+// parseFormatArgs removes --atp-format FORMAT or --atp-format=FORMAT from the arguments, and returns the format. The
+// format is empty if it was not given.
+func parseFormatArgs(args []string) ([]string, atp.Format, error) {
+	for i, arg := range args {
+		var name string
+		var rest []string
+		switch {
+		case arg == "--atp-format" && i+1 < len(args):
+			name = args[i+1]
+			rest = append(slices.Clone(args[:i]), args[i+2:]...)
+		case strings.HasPrefix(arg, "--atp-format="):
+			name = strings.TrimPrefix(arg, "--atp-format=")
+			rest = append(slices.Clone(args[:i]), args[i+1:]...)
+		default:
+			continue
+		}
+		format, err := atp.ParseFormat(name)
+		return rest, format, err
+	}
+	return args, "", nil
+}
+
+// parseListenArgs returns the address given as --atp-listen ADDRESS or --atp-listen=ADDRESS.
+func parseListenArgs(args []string) (string, bool) {
+	switch {
+	case len(args) == 2 && args[0] == "--atp-listen":
+		return args[1], true
+	case len(args) == 1 && strings.HasPrefix(args[0], "--atp-listen="):
+		return strings.TrimPrefix(args[0], "--atp-listen="), true
+	default:
+		return "", false
+	}
+}
+
+func runATP(s *schema.CallableSchema, options atp.ServerOptions) int {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	serverErrors := atp.RunATPServerWithOptions(ctx, os.Stdin, os.Stdout, s, options)
+	runsAborted := false
+	for _, serverError := range serverErrors {
+		_, _ = fmt.Fprintf(os.Stderr, "ATP server error: %s\n", serverError)
+		runsAborted = runsAborted || errors.Is(serverError.Err, atp.ErrRunAborted)
+	}
+	switch {
+	case runsAborted:
+		return ExitCodeRunsAborted
+	case ctx.Err() != nil:
+		return ExitCodeStopped
+	case len(serverErrors) > 0:
+		return ExitCodeFailed
+	default:
+		return ExitCodeOK
+	}
+}
+
+func runListener(s *schema.CallableSchema, address string, options atp.ServerOptions) int {
+	listener, err := atp.Listen(address)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		return ExitCodeFailed
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	// The sessions only report their errors to stderr, so watch for aborted runs on the way.
+	runsAborted := &atomic.Bool{}
+	onError := options.OnError
+	options.OnError = func(serverError atp.ServerError) {
+		if errors.Is(serverError.Err, atp.ErrRunAborted) {
+			runsAborted.Store(true)
+		}
+		if onError != nil {
+			onError(serverError)
+		}
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "ATP server listening on %s://%s\n", listener.Addr().Network(), listener.Addr())
+	if err := atp.ServeATP(ctx, listener, s, options); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		return ExitCodeFailed
+	}
+	switch {
+	case runsAborted.Load():
+		return ExitCodeRunsAborted
+	case ctx.Err() != nil:
+		return ExitCodeStopped
+	default:
+		return ExitCodeOK
+	}
+}
@@ -1,17 +1,39 @@
 package plugin
 
-import "go.flow.arcalot.io/pluginsdk/schema"
+import (
+	"time"
+
+	"go.flow.arcalot.io/pluginsdk/atp"
+	"go.flow.arcalot.io/pluginsdk/schema"
+)
 
 type CancelInput struct {
-	// Possibly add a time limit input
+	// GracePeriod is the time in nanoseconds the step has to finish after it was cancelled, before the run fails.
+	// If it is not set, the step may take as long as it needs.
+	GracePeriod *int64 `json:"grace_period,omitempty"`
 }
 
 var CancellationSignalSchema = schema.NewSignalSchema(
-	"cancel",
+	atp.CancelSignalID,
 	schema.NewScopeSchema(
 		schema.NewStructMappedObjectSchema[CancelInput](
 			"cancelInput",
-			map[string]*schema.PropertySchema{},
+			map[string]*schema.PropertySchema{
+				"grace_period": schema.NewPropertySchema(
+					schema.NewIntSchema(schema.PointerTo[int64](0), nil, schema.UnitDurationNanoseconds),
+					schema.NewDisplayValue(
+						schema.PointerTo("Grace period"),
+						schema.PointerTo("Time the step has to finish after it was cancelled, before the run fails."),
+						nil,
+					),
+					false,
+					nil,
+					nil,
+					nil,
+					nil,
+					nil,
+				),
+			},
 		),
 	),
 	schema.NewDisplayValue(
@@ -20,3 +42,18 @@ var CancellationSignalSchema = schema.NewSignalSchema(
 		nil,
 	),
 )
+
+// WithCancellation makes all steps of the schema handle the CancellationSignalSchema. When a step receives the
+// signal, the context passed to its handler is cancelled. If the step does not return within the grace period set
+// in the signal, the run fails with a step fatal error.
+func WithCancellation(s *schema.CallableSchema) *schema.CallableSchema {
+	return s.WithCancellation(CancellationSignalSchema, cancelGracePeriod)
+}
+
+func cancelGracePeriod(signalInput any) time.Duration {
+	cancelInput, ok := signalInput.(CancelInput)
+	if !ok || cancelInput.GracePeriod == nil {
+		return 0
+	}
+	return time.Duration(*cancelInput.GracePeriod)
+}
@@ -0,0 +1,198 @@
+package schema
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// pendingCancellationLifetime is how long a cancellation signal received for a run that is not running is kept, so a
+// step that is started shortly after still sees it.
+const pendingCancellationLifetime = time.Minute
+
+// stepCancellation cancels the context of running steps when the cancellation signal is received.
+type stepCancellation struct {
+	signal      *SignalSchema
+	gracePeriod func(signalInput any) time.Duration
+	lock        sync.Mutex
+	runs        map[runKey]*cancellableRun      // The runs whose step is running.
+	pending     map[runKey]*pendingCancellation // Cancellations received for runs whose step is not running.
+}
+
+// runKey identifies a run. Run IDs are only unique within a session, see WithSession.
+type runKey struct {
+	sessionID string
+	runID     string
+}
+
+// cancellableRun holds the cancellation state of a single running step.
+type cancellableRun struct {
+	lock        sync.Mutex
+	cancel      context.CancelFunc
+	gracePeriod time.Duration
+	expiryTimer *time.Timer   // Closes expired once the grace period is over. Nil until the run is cancelled.
+	expired     chan struct{} // Closed when the grace period after the cancellation is over.
+}
+
+// pendingCancellation is a cancellation signal received before the step of the run was started. It is dropped once
+// the step starts, or once its lifetime is over.
+type pendingCancellation struct {
+	signalInput any
+	timer       *time.Timer
+}
+
+type sessionContextKey struct{}
+
+// WithSession returns a context that scopes the run IDs of the step and signal calls made with it to the given session,
+// so that sessions sharing a CallableSchema can use the same run IDs. Calls without a session share the empty one.
+func WithSession(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, sessionID)
+}
+
+func getRunKey(ctx context.Context, runID string) runKey {
+	sessionID, _ := ctx.Value(sessionContextKey{}).(string)
+	return runKey{sessionID, runID}
+}
+
+func newStepCancellation(signal *SignalSchema, gracePeriod func(signalInput any) time.Duration) *stepCancellation {
+	return &stepCancellation{
+		signal:      signal,
+		gracePeriod: gracePeriod,
+		runs:        map[runKey]*cancellableRun{},
+		pending:     map[runKey]*pendingCancellation{},
+	}
+}
+
+// addSignalHandler returns a copy of the step schema that declares a handler for the cancellation signal.
+func (c *stepCancellation) addSignalHandler(step *StepSchema) *StepSchema {
+	if _, found := step.SignalHandlersValue[c.signal.ID()]; found {
+		return step
+	}
+	signalHandlers := make(map[string]*SignalSchema, len(step.SignalHandlersValue)+1)
+	for id, signal := range step.SignalHandlersValue {
+		signalHandlers[id] = signal
+	}
+	signalHandlers[c.signal.ID()] = c.signal
+	result := *step
+	result.SignalHandlersValue = signalHandlers
+	return &result
+}
+
+// addRun registers the running step of a run, and cancels it right away if the cancellation signal was received before.
+func (c *stepCancellation) addRun(key runKey, cancel context.CancelFunc) *cancellableRun {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	run := &cancellableRun{
+		cancel:  cancel,
+		expired: make(chan struct{}),
+	}
+	c.runs[key] = run
+	if pending, found := c.pending[key]; found {
+		pending.timer.Stop()
+		delete(c.pending, key)
+		c.cancelRunningStep(run, pending.signalInput)
+	}
+	return run
+}
+
+func (c *stepCancellation) removeRun(key runKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if run, found := c.runs[key]; found {
+		run.lock.Lock()
+		if run.expiryTimer != nil {
+			run.expiryTimer.Stop()
+		}
+		run.lock.Unlock()
+		delete(c.runs, key)
+	}
+}
+
+// call runs the step call with a context that is cancelled when the cancellation signal is received for the run.
+// If the call does not return within the grace period after the cancellation, a StepCancelledError is returned
+// without waiting for it any longer. The step call keeps running in the background in that case, as Go cannot stop
+// it, and its result is discarded.
+func (c *stepCancellation) call(
+	ctx context.Context,
+	runID string,
+	stepCall func(ctx context.Context) (outputID string, outputData any, err error),
+) (string, any, error) {
+	key := getRunKey(ctx, runID)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	run := c.addRun(key, cancel)
+	defer c.removeRun(key)
+
+	type stepResult struct {
+		outputID   string
+		outputData any
+		err        error
+		panic      *PanicWithStack
+	}
+	results := make(chan stepResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				results <- stepResult{panic: &PanicWithStack{r, debug.Stack()}}
+			}
+		}()
+		outputID, outputData, err := stepCall(ctx)
+		results <- stepResult{outputID, outputData, err, nil}
+	}()
+	select {
+	case result := <-results:
+		if result.panic != nil {
+			// Re-panic in the caller's goroutine so the panic is reported the same way as without cancellation.
+			panic(*result.panic)
+		}
+		return result.outputID, result.outputData, result.err
+	case <-run.expired:
+		run.lock.Lock()
+		defer run.lock.Unlock()
+		return "", nil, StepCancelledError{RunID: runID, GracePeriod: run.gracePeriod}
+	}
+}
+
+// cancelRun cancels the context of the given run, and starts the grace period the signal input asks for. If the step
+// of the run is not running, the cancellation is kept for a limited time in case the step is about to be started.
+func (c *stepCancellation) cancelRun(ctx context.Context, runID string, signalInput any) {
+	key := getRunKey(ctx, runID)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if run, found := c.runs[key]; found {
+		c.cancelRunningStep(run, signalInput)
+		return
+	}
+	if pending, found := c.pending[key]; found {
+		pending.timer.Stop()
+	}
+	pending := &pendingCancellation{signalInput: signalInput}
+	pending.timer = time.AfterFunc(pendingCancellationLifetime, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.pending[key] == pending {
+			delete(c.pending, key)
+		}
+	})
+	c.pending[key] = pending
+}
+
+// cancelRunningStep cancels the context of a running step, and starts its grace period. The caller must have the lock
+// of the stepCancellation locked while calling this function.
+func (c *stepCancellation) cancelRunningStep(run *cancellableRun, signalInput any) {
+	run.lock.Lock()
+	defer run.lock.Unlock()
+	run.cancel()
+	if c.gracePeriod == nil || run.expiryTimer != nil {
+		return
+	}
+	gracePeriod := c.gracePeriod(signalInput)
+	if gracePeriod <= 0 {
+		return
+	}
+	run.gracePeriod = gracePeriod
+	run.expiryTimer = time.AfterFunc(gracePeriod, func() {
+		close(run.expired)
+	})
+}
@@ -0,0 +1,181 @@
+package schema_test
+
+import (
+	"context"
+	"errors"
+	"go.arcalot.io/assert"
+	"testing"
+	"time"
+
+	"go.flow.arcalot.io/pluginsdk/schema"
+)
+
+type cancellationTestInput struct {
+	GracePeriod *int64 `json:"grace_period,omitempty"`
+}
+
+var cancellationTestSignal = schema.NewSignalSchema(
+	"cancel",
+	schema.NewScopeSchema(
+		schema.NewStructMappedObjectSchema[cancellationTestInput](
+			"cancelInput",
+			map[string]*schema.PropertySchema{
+				"grace_period": schema.NewPropertySchema(
+					schema.NewIntSchema(nil, nil, schema.UnitDurationNanoseconds),
+					nil,
+					false,
+					nil,
+					nil,
+					nil,
+					nil,
+					nil,
+				),
+			},
+		),
+	),
+	nil,
+)
+
+func cancellationTestGracePeriod(signalInput any) time.Duration {
+	input := signalInput.(cancellationTestInput)
+	if input.GracePeriod == nil {
+		return 0
+	}
+	return time.Duration(*input.GracePeriod)
+}
+
+// newCancellationTestSchema creates a schema with a single step that blocks until either its context is cancelled,
+// or, if ignoreCancel is set, until the returned channel is closed.
+func newCancellationTestSchema(ignoreCancel bool) (*schema.CallableSchema, chan struct{}) {
+	release := make(chan struct{})
+	step := schema.NewCallableStep[stepTestInputData](
+		"wait",
+		testStepSchema.Input().(*schema.ScopeSchema),
+		testStepSchema.Outputs(),
+		nil,
+		func(ctx context.Context, input stepTestInputData) (string, any) {
+			if ignoreCancel {
+				<-release
+			} else {
+				<-ctx.Done()
+			}
+			return "error", stepTestErrorOutput{Error: "cancelled"}
+		},
+	)
+	return schema.NewCallableSchema(step).WithCancellation(cancellationTestSignal, cancellationTestGracePeriod), release
+}
+
+func TestCallableSchema_WithCancellation(t *testing.T) {
+	s, _ := newCancellationTestSchema(false)
+	results := make(chan error, 1)
+	go func() {
+		outputID, _, err := s.CallStep(context.Background(), t.Name(), "wait", map[string]any{"name": "Arca Lot"})
+		if err == nil && outputID != "error" {
+			err = errors.New("unexpected output ID: " + outputID)
+		}
+		results <- err
+	}()
+	assert.NoError(t, s.CallSignal(context.Background(), t.Name(), "wait", "cancel", map[string]any{}))
+	select {
+	case err := <-results:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("step was not cancelled")
+	}
+}
+
+func TestCallableSchema_WithCancellation_BeforeStart(t *testing.T) {
+	// The signal may arrive before the step handler runs, in which case the context must be cancelled right away.
+	s, _ := newCancellationTestSchema(false)
+	assert.NoError(t, s.CallSignal(context.Background(), t.Name(), "wait", "cancel", map[string]any{}))
+	outputID, _, err := s.CallStep(context.Background(), t.Name(), "wait", map[string]any{"name": "Arca Lot"})
+	assert.NoError(t, err)
+	assert.Equals(t, outputID, "error")
+}
+
+func TestCallableSchema_WithCancellation_GracePeriod(t *testing.T) {
+	s, release := newCancellationTestSchema(true)
+	defer close(release)
+	results := make(chan error, 1)
+	go func() {
+		_, _, err := s.CallStep(context.Background(), t.Name(), "wait", map[string]any{"name": "Arca Lot"})
+		results <- err
+	}()
+	assert.NoError(t, s.CallSignal(
+		context.Background(), t.Name(), "wait", "cancel", map[string]any{"grace_period": int64(time.Millisecond)},
+	))
+	select {
+	case err := <-results:
+		var cancelledErr schema.StepCancelledError
+		assert.Equals(t, errors.As(err, &cancelledErr), true)
+		assert.Equals(t, cancelledErr.RunID, t.Name())
+		assert.Equals(t, cancelledErr.GracePeriod, time.Millisecond)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("grace period did not expire")
+	}
+}
+
+func TestCallableSchema_WithCancellation_SelfSerialize(t *testing.T) {
+	s, _ := newCancellationTestSchema(false)
+	serializedSchema, err := s.SelfSerialize()
+	assert.NoError(t, err)
+	unserializedSchema, err := schema.UnserializeSchema(serializedSchema)
+	assert.NoError(t, err)
+	_, found := unserializedSchema.Steps()["wait"].SignalHandlers()["cancel"]
+	assert.Equals(t, found, true)
+}
+
+func TestCallableSchema_WithCancellation_Sessions(t *testing.T) {
+	// Run IDs are only unique within a session, so the cancellation must only cancel the run of its own session.
+	s, _ := newCancellationTestSchema(false)
+	otherSession := schema.WithSession(context.Background(), "other")
+	results := make(chan error, 1)
+	go func() {
+		_, _, err := s.CallStep(
+			schema.WithSession(context.Background(), "step"), t.Name(), "wait", map[string]any{"name": "Arca Lot"},
+		)
+		results <- err
+	}()
+	assert.NoError(t, s.CallSignal(otherSession, t.Name(), "wait", "cancel", map[string]any{}))
+	select {
+	case <-results:
+		t.Fatalf("step of a different session was cancelled")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.NoError(t, s.CallSignal(
+		schema.WithSession(context.Background(), "step"), t.Name(), "wait", "cancel", map[string]any{},
+	))
+	select {
+	case err := <-results:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("step was not cancelled")
+	}
+	// The cancellation of the other session is still pending for a run that starts in that session.
+	outputID, _, err := s.CallStep(otherSession, t.Name(), "wait", map[string]any{"name": "Arca Lot"})
+	assert.NoError(t, err)
+	assert.Equals(t, outputID, "error")
+}
+
+func TestCallableSchema_WithCancellation_Panic(t *testing.T) {
+	// The panic of the step handler must be passed on along with the stack of the handler's goroutine.
+	s := schema.NewCallableSchema(schema.NewCallableStep[stepTestInputData](
+		"panic",
+		testStepSchema.Input().(*schema.ScopeSchema),
+		testStepSchema.Outputs(),
+		nil,
+		panickingCancellationTestStep,
+	)).WithCancellation(cancellationTestSignal, cancellationTestGracePeriod)
+	defer func() {
+		panicWithStack, ok := recover().(schema.PanicWithStack)
+		assert.Equals(t, ok, true)
+		assert.Equals(t, panicWithStack.String(), "step panicked")
+		assert.Contains(t, string(panicWithStack.Stack), "panickingCancellationTestStep")
+	}()
+	_, _, _ = s.CallStep(context.Background(), t.Name(), "panic", map[string]any{"name": "Arca Lot"})
+	t.Fatalf("step did not panic")
+}
+
+func panickingCancellationTestStep(_ context.Context, _ stepTestInputData) (string, any) {
+	panic("step panicked")
+}
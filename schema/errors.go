@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 )
 
 // ConstraintError indicates that the passed data violated one or more constraints defined in the schema.
@@ -130,6 +131,34 @@ func (i InvalidOutputError) Unwrap() error {
 	return i.Cause
 }
 
+// StepCancelledError indicates that a step did not return within the grace period after it was cancelled. The grace
+// period is zero if the run was cancelled before its step was started.
+type StepCancelledError struct {
+	RunID       string
+	GracePeriod time.Duration
+}
+
+// Error returns the error message.
+func (s StepCancelledError) Error() string {
+	if s.GracePeriod == 0 {
+		return fmt.Sprintf("run ID '%s' was cancelled before its step was started", s.RunID)
+	}
+	return fmt.Sprintf("step with run ID '%s' did not finish within the %s grace period after it was cancelled",
+		s.RunID, s.GracePeriod)
+}
+
+// PanicWithStack is the value a step call panics with if the step handler panicked in a different goroutine. It holds
+// the original panic value and the stack of the goroutine the handler panicked in.
+type PanicWithStack struct {
+	Value any
+	Stack []byte
+}
+
+// String returns the original panic value.
+func (p PanicWithStack) String() string {
+	return fmt.Sprintf("%v", p.Value)
+}
+
 // IllegalStateError is for when something is called when it shouldn't have.
 type IllegalStateError struct {
 	Cause error
@@ -0,0 +1,77 @@
+package schema
+
+import (
+	"context"
+)
+
+// StepCallFunc calls a step with the serialized input data and returns the ID and serialized data of its output.
+type StepCallFunc func(
+	ctx context.Context,
+	runID string,
+	stepID string,
+	serializedInputData any,
+) (outputID string, serializedOutputData any, err error)
+
+// SignalCallFunc calls the handler of a signal with the serialized input data.
+type SignalCallFunc func(
+	ctx context.Context,
+	runID string,
+	stepID string,
+	signalID string,
+	serializedInputData any,
+) error
+
+// Interceptor wraps the step and signal calls of a CallableSchema, for example for audit logging, input redaction,
+// timing, or converting panics to errors. Each function gets the call and the next function in the chain, which it
+// calls to continue the call. It may inspect or replace the input before calling next, and the output or error after
+// it, or not call next at all. Either function may be nil to pass the calls through unchanged.
+type Interceptor struct {
+	// Step intercepts the step calls. The input and output data are serialized, and the step ID may be invalid, in
+	// which case next returns a BadArgumentError.
+	Step func(
+		ctx context.Context,
+		runID string,
+		stepID string,
+		serializedInputData any,
+		next StepCallFunc,
+	) (outputID string, serializedOutputData any, err error)
+	// Signal intercepts the signal calls, including the cancellation signal. The input data is serialized.
+	Signal func(
+		ctx context.Context,
+		runID string,
+		stepID string,
+		signalID string,
+		serializedInputData any,
+		next SignalCallFunc,
+	) error
+}
+
+// interceptStep wraps the step call in the step functions of the interceptors, the first interceptor outermost.
+func interceptStep(interceptors []Interceptor, call StepCallFunc) StepCallFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		intercept := interceptors[i].Step
+		if intercept == nil {
+			continue
+		}
+		next := call
+		call = func(ctx context.Context, runID string, stepID string, serializedInputData any) (string, any, error) {
+			return intercept(ctx, runID, stepID, serializedInputData, next)
+		}
+	}
+	return call
+}
+
+// interceptSignal wraps the signal call in the signal functions of the interceptors, the first interceptor outermost.
+func interceptSignal(interceptors []Interceptor, call SignalCallFunc) SignalCallFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		intercept := interceptors[i].Signal
+		if intercept == nil {
+			continue
+		}
+		next := call
+		call = func(ctx context.Context, runID string, stepID string, signalID string, serializedInputData any) error {
+			return intercept(ctx, runID, stepID, signalID, serializedInputData, next)
+		}
+	}
+	return call
+}
@@ -0,0 +1,126 @@
+package schema_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.arcalot.io/assert"
+	"testing"
+
+	"go.flow.arcalot.io/pluginsdk/schema"
+)
+
+func TestCallableSchema_WithInterceptors(t *testing.T) {
+	var calls []string
+	s := schema.NewCallableSchema(testStepSchema).WithInterceptors(
+		schema.Interceptor{
+			Step: func(
+				ctx context.Context,
+				runID string,
+				stepID string,
+				serializedInputData any,
+				next schema.StepCallFunc,
+			) (string, any, error) {
+				calls = append(calls, fmt.Sprintf("audit %s %s", runID, stepID))
+				outputID, outputData, err := next(ctx, runID, stepID, serializedInputData)
+				calls = append(calls, "audit "+outputID)
+				return outputID, outputData, err
+			},
+		},
+		// Interceptors without a step function are skipped.
+		schema.Interceptor{},
+		schema.Interceptor{
+			Step: func(
+				ctx context.Context,
+				runID string,
+				stepID string,
+				serializedInputData any,
+				next schema.StepCallFunc,
+			) (string, any, error) {
+				calls = append(calls, "redact")
+				outputID, outputData, err := next(ctx, runID, stepID, map[string]any{"name": "Redacted"})
+				if err != nil {
+					return "", nil, err
+				}
+				message := outputData.(map[string]any)["message"].(string)
+				return outputID, map[string]any{"message": message + " (intercepted)"}, nil
+			},
+		},
+	)
+	outputID, outputData, err := s.CallStep(context.Background(), t.Name(), "hello", map[string]any{"name": "Arca Lot"})
+	assert.NoError(t, err)
+	assert.Equals(t, outputID, "success")
+	assert.Equals(t, outputData.(map[string]any)["message"].(string), "Hello, Redacted! (intercepted)")
+	assert.Equals(t, calls, []string{"audit " + t.Name() + " hello", "redact", "audit success"})
+
+	// The interceptors also see calls to unknown steps.
+	calls = nil
+	_, _, err = s.CallStep(context.Background(), t.Name(), "unknown", map[string]any{"name": "Arca Lot"})
+	var badArgumentError schema.BadArgumentError
+	assert.Equals(t, errors.As(err, &badArgumentError), true)
+	assert.Equals(t, calls, []string{"audit " + t.Name() + " unknown", "redact", "audit "})
+}
+
+func TestCallableSchema_WithInterceptors_Panic(t *testing.T) {
+	step := schema.NewCallableStep[stepTestInputData](
+		"hello",
+		testStepSchema.Input().(*schema.ScopeSchema),
+		testStepSchema.Outputs(),
+		nil,
+		func(_ context.Context, _ stepTestInputData) (string, any) {
+			panic("Arca Lot")
+		},
+	)
+	s := schema.NewCallableSchema(step).WithInterceptors(schema.Interceptor{
+		Step: func(
+			ctx context.Context,
+			runID string,
+			stepID string,
+			serializedInputData any,
+			next schema.StepCallFunc,
+		) (outputID string, outputData any, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					outputID, outputData, err = "", nil, fmt.Errorf("step panicked: %v", r)
+				}
+			}()
+			return next(ctx, runID, stepID, serializedInputData)
+		},
+	})
+	_, _, err := s.CallStep(context.Background(), t.Name(), "hello", map[string]any{"name": "Arca Lot"})
+	assert.Error(t, err)
+	assert.Equals(t, err.Error(), "step panicked: Arca Lot")
+}
+
+func TestCallableSchema_WithInterceptors_Signal(t *testing.T) {
+	var signals []string
+	s, _ := newCancellationTestSchema(false)
+	s.WithInterceptors(schema.Interceptor{
+		Signal: func(
+			ctx context.Context,
+			runID string,
+			stepID string,
+			signalID string,
+			serializedInputData any,
+			next schema.SignalCallFunc,
+		) error {
+			signals = append(signals, stepID+"/"+signalID)
+			if signalID != "cancel" {
+				return errors.New("signal disabled")
+			}
+			return next(ctx, runID, stepID, signalID, serializedInputData)
+		},
+	})
+	assert.NoError(t, s.CallSignal(context.Background(), t.Name(), "wait", "cancel", map[string]any{}))
+	err := s.CallSignal(context.Background(), t.Name(), "wait", "unknown", map[string]any{})
+	assert.Error(t, err)
+	assert.Equals(t, err.Error(), "signal disabled")
+	assert.Equals(t, signals, []string{"wait/cancel", "wait/unknown"})
+
+	// The step calls pass through the interceptor without a step function.
+	outputID, _, err := schema.NewCallableSchema(testStepSchema).
+		WithInterceptors(schema.Interceptor{}).
+		CallStep(context.Background(), t.Name(), "hello", map[string]any{"name": "Arca Lot"})
+	assert.NoError(t, err)
+	assert.Equals(t, outputID, "success")
+}
@@ -3,6 +3,8 @@ package schema
 import (
 	"context"
 	"fmt"
+	"maps"
+	"time"
 )
 
 // Schema is a collection of steps supported by a plugin.
@@ -52,6 +54,9 @@ func (s SchemaSchema) applyNamespace() {
 		for _, output := range step.OutputsValue {
 			output.Schema().ApplySelf()
 		}
+		if step.StatusValue != nil {
+			step.StatusValue.ApplySelf()
+		}
 	}
 }
 
@@ -64,14 +69,62 @@ func NewCallableSchema(
 	}
 
 	return &CallableSchema{
-		stepMap,
+		StepsValue: stepMap,
 	}
 }
 
 type CallableSchema struct {
-	StepsValue map[string]CallableStep `json:"steps"`
+	StepsValue   map[string]CallableStep `json:"steps"`
+	cancellation *stepCancellation
+	interceptors []Interceptor
+	runStatus    map[string]*ScopeSchema // Maps step ID to the schema of the status the step reports.
+}
+
+// WithCancellation makes every step handle the given cancellation signal, even if the step does not declare a
+// handler for it. When the signal is received, the context passed to the step handler is cancelled, and then the
+// handler the step declares for the signal, if any, is called. If gracePeriod returns a positive duration for the
+// signal input and the step handler has not returned once it passed, CallStep stops waiting for the handler and
+// returns a StepCancelledError. The gracePeriod function may be nil to wait for the handler indefinitely.
+func (s *CallableSchema) WithCancellation(
+	signal *SignalSchema,
+	gracePeriod func(signalInput any) time.Duration,
+) *CallableSchema {
+	s.cancellation = newStepCancellation(signal, gracePeriod)
+	return s
 }
 
+// CancellationSignalID returns the ID of the cancellation signal set with WithCancellation, if any.
+func (s CallableSchema) CancellationSignalID() (string, bool) {
+	if s.cancellation == nil {
+		return "", false
+	}
+	return s.cancellation.signal.ID(), true
+}
+
+// WithRunStatus declares the schema of the status object the step with the given ID reports while it runs. The schema
+// is serialized as part of the step schema, unless SelfSerializeWithOptions leaves it out.
+func (s *CallableSchema) WithRunStatus(stepID string, status *ScopeSchema) *CallableSchema {
+	if s.runStatus == nil {
+		s.runStatus = map[string]*ScopeSchema{}
+	}
+	s.runStatus[stepID] = status
+	return s
+}
+
+// RunStatusSchema returns the schema of the status object the step with the given ID reports, or nil if the step
+// declares none.
+func (s CallableSchema) RunStatusSchema(stepID string) *ScopeSchema {
+	return s.runStatus[stepID]
+}
+
+// WithInterceptors adds interceptors that wrap the step and signal calls. The first interceptor is the outermost one,
+// and interceptors added by later calls are wrapped by the earlier ones.
+func (s *CallableSchema) WithInterceptors(interceptors ...Interceptor) *CallableSchema {
+	s.interceptors = append(s.interceptors, interceptors...)
+	return s
+}
+
+// CallStep calls the step with the given ID through the interceptors.
 func (s CallableSchema) CallStep(
 	ctx context.Context,
 	runID string,
@@ -81,6 +134,19 @@ func (s CallableSchema) CallStep(
 	outputID string,
 	serializedOutputData any,
 	err error,
+) {
+	return interceptStep(s.interceptors, s.callStep)(ctx, runID, stepID, serializedInputData)
+}
+
+func (s CallableSchema) callStep(
+	ctx context.Context,
+	runID string,
+	stepID string,
+	serializedInputData any,
+) (
+	outputID string,
+	serializedOutputData any,
+	err error,
 ) {
 	step, ok := s.StepsValue[stepID]
 	if !ok {
@@ -88,22 +154,41 @@ func (s CallableSchema) CallStep(
 			Message: fmt.Sprintf("Invalid step called: %s", stepID),
 		}
 	}
+	timings := getStepTimings(ctx)
+	phaseStart := time.Now()
 	unserializedInputData, err := step.Input().Unserialize(serializedInputData)
+	timings.Unserialize = time.Since(phaseStart)
 	if err != nil {
 		return "", nil, InvalidInputError{err}
 	}
-	outputID, unserializedOutput, err := step.Call(ctx, runID, unserializedInputData)
+	var unserializedOutput any
+	phaseStart = time.Now()
+	if s.cancellation != nil {
+		outputID, unserializedOutput, err = s.cancellation.call(
+			ctx,
+			runID,
+			func(ctx context.Context) (string, any, error) {
+				return step.Call(ctx, runID, unserializedInputData)
+			},
+		)
+	} else {
+		outputID, unserializedOutput, err = step.Call(ctx, runID, unserializedInputData)
+	}
+	timings.Handler = time.Since(phaseStart)
 	if err != nil {
 		return outputID, nil, err
 	}
 	output := step.Outputs()[outputID]
+	phaseStart = time.Now()
 	serializedData, err := output.Schema().Serialize(unserializedOutput)
+	timings.Serialize = time.Since(phaseStart)
 	if err != nil {
 		return "", nil, InvalidOutputError{err}
 	}
 	return outputID, serializedData, nil
 }
 
+// CallSignal calls the handler of the signal with the given ID through the interceptors.
 func (s CallableSchema) CallSignal(
 	ctx context.Context,
 	runID string,
@@ -112,6 +197,18 @@ func (s CallableSchema) CallSignal(
 	serializedInputData any,
 ) (
 	err error,
+) {
+	return interceptSignal(s.interceptors, s.callSignal)(ctx, runID, stepID, signalID, serializedInputData)
+}
+
+func (s CallableSchema) callSignal(
+	ctx context.Context,
+	runID string,
+	stepID string,
+	signalID string,
+	serializedInputData any,
+) (
+	err error,
 ) {
 	step, ok := s.StepsValue[stepID]
 
@@ -120,7 +217,23 @@ func (s CallableSchema) CallSignal(
 			Message: fmt.Sprintf("Invalid step called: %s", stepID),
 		}
 	}
-	unserializedInputData, err := step.SignalHandlers()[signalID].DataSchema().Unserialize(serializedInputData)
+	signalHandler, hasHandler := step.SignalHandlers()[signalID]
+	if s.cancellation != nil && signalID == s.cancellation.signal.ID() {
+		cancelInput, err := s.cancellation.signal.DataSchema().Unserialize(serializedInputData)
+		if err != nil {
+			return InvalidInputError{err}
+		}
+		s.cancellation.cancelRun(ctx, runID, cancelInput)
+		if !hasHandler {
+			return nil
+		}
+	}
+	if !hasHandler {
+		return BadArgumentError{
+			Message: fmt.Sprintf("Invalid signal called for step %s: %s", stepID, signalID),
+		}
+	}
+	unserializedInputData, err := signalHandler.DataSchema().Unserialize(serializedInputData)
 	if err != nil {
 		return InvalidInputError{err}
 	}
@@ -129,17 +242,77 @@ func (s CallableSchema) CallSignal(
 	if err != nil {
 		return err
 	}
+	if reply := getSignalReply(ctx); reply != nil && signalHandler.ReplySchemaValue != nil {
+		serializedReply, err := signalHandler.ReplySchemaValue.Serialize(reply.Data)
+		if err != nil {
+			return InvalidOutputError{err}
+		}
+		reply.Data = serializedReply
+	}
 	return nil
 }
 
+// SelfSerializeOptions selects the optional parts of the schema that SelfSerializeWithOptions includes. Readers of the
+// schema that do not know about a part reject the schema if it is included.
+type SelfSerializeOptions struct {
+	// RunStatus includes the status schemas declared with WithRunStatus.
+	RunStatus bool
+	// SignalReplies includes the reply schemas of the signal handlers created with NewCallableSignalWithReply.
+	SignalReplies bool
+}
+
+// SelfSerialize serializes the schema with all of its optional parts.
 func (s CallableSchema) SelfSerialize() (any, error) {
+	return s.SelfSerializeWithOptions(SelfSerializeOptions{
+		RunStatus:     true,
+		SignalReplies: true,
+	})
+}
+
+// SelfSerializeWithOptions serializes the schema with the optional parts the options select.
+func (s CallableSchema) SelfSerializeWithOptions(options SelfSerializeOptions) (any, error) {
 	steps := make(map[string]*StepSchema, len(s.StepsValue))
 
 	for id, step := range s.StepsValue {
-		steps[id] = step.ToStepSchema()
+		stepSchema := step.ToStepSchema()
+		if s.cancellation != nil {
+			stepSchema = s.cancellation.addSignalHandler(stepSchema)
+		}
+		if !options.SignalReplies {
+			stepSchema = withoutSignalReplies(stepSchema)
+		}
+		if status, found := s.runStatus[id]; found && options.RunStatus {
+			result := *stepSchema
+			result.StatusValue = status
+			stepSchema = &result
+		}
+		steps[id] = stepSchema
 	}
 
 	return schemaSchema.Serialize(&SchemaSchema{
 		steps,
 	})
 }
+
+// withoutSignalReplies returns a copy of the step schema without the reply schemas of its signal handlers, or the step
+// schema itself if none of them replies.
+func withoutSignalReplies(step *StepSchema) *StepSchema {
+	var signalHandlers map[string]*SignalSchema
+	for id, signal := range step.SignalHandlersValue {
+		if signal.ReplySchemaValue == nil {
+			continue
+		}
+		if signalHandlers == nil {
+			signalHandlers = maps.Clone(step.SignalHandlersValue)
+		}
+		withoutReply := *signal
+		withoutReply.ReplySchemaValue = nil
+		signalHandlers[id] = &withoutReply
+	}
+	if signalHandlers == nil {
+		return step
+	}
+	result := *step
+	result.SignalHandlersValue = signalHandlers
+	return &result
+}
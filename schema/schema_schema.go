@@ -1174,6 +1174,23 @@ var signalSchemaObject = NewStructMappedObjectSchema[*SignalSchema](
 			nil,
 			nil,
 		),
+		"reply_schema": NewPropertySchema(
+			NewRefSchema(
+				"Scope",
+				nil,
+			),
+			NewDisplayValue(
+				PointerTo("Reply Schema"),
+				PointerTo("The data schema of the reply a signal handler sends back to the caller, if any."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
 	},
 )
 var stepSchemaObject = NewStructMappedObjectSchema[*StepSchema](
@@ -1277,6 +1294,23 @@ var stepSchemaObject = NewStructMappedObjectSchema[*StepSchema](
 			nil,
 			nil,
 		),
+		"status": NewPropertySchema(
+			NewRefSchema(
+				"Scope",
+				nil,
+			),
+			NewDisplayValue(
+				PointerTo("Status"),
+				PointerTo("Schema of the status object the step reports while it runs."),
+				nil,
+			),
+			false,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
+		),
 	},
 )
 var stepOutputSchema = NewScopeSchema(
@@ -2,6 +2,7 @@ package schema_test
 
 import (
 	"context"
+	"errors"
 	"go.arcalot.io/assert"
 	"testing"
 
@@ -24,3 +25,167 @@ func TestSchemaCall(t *testing.T) {
 	typedData := outputData.(map[string]any)
 	assert.Equals(t, typedData["message"].(string), "Hello, Arca Lot!")
 }
+
+func TestSchemaCall_StepTimings(t *testing.T) {
+	timings := &schema.StepTimings{}
+	ctx := schema.WithStepTimings(context.Background(), timings)
+	_, _, err := schemaTestSchema.CallStep(ctx, t.Name(), "hello", map[string]any{"name": "Arca Lot"})
+	assert.NoError(t, err)
+	assert.Equals(t, timings.Unserialize > 0, true)
+	assert.Equals(t, timings.Handler > 0, true)
+	assert.Equals(t, timings.Serialize > 0, true)
+
+	// The later phases are not reached with invalid input.
+	timings = &schema.StepTimings{}
+	ctx = schema.WithStepTimings(context.Background(), timings)
+	_, _, err = schemaTestSchema.CallStep(ctx, t.Name(), "hello", map[string]any{})
+	assert.Error(t, err)
+	assert.Equals(t, timings.Handler, 0)
+	assert.Equals(t, timings.Serialize, 0)
+}
+
+func TestCallableSchema_WithRunStatus(t *testing.T) {
+	statusSchema := testStepSchema.Outputs()["success"].Schema().(*schema.ScopeSchema)
+	s := schema.NewCallableSchema(testStepSchema).WithRunStatus("hello", statusSchema)
+	assert.Equals(t, s.RunStatusSchema("hello"), statusSchema)
+	assert.Nil(t, s.RunStatusSchema("unknown"))
+
+	serializedSchema, err := s.SelfSerialize()
+	assert.NoError(t, err)
+	unserializedSchema, err := schema.UnserializeSchema(serializedSchema)
+	assert.NoError(t, err)
+	status := unserializedSchema.StepsValue["hello"].Status()
+	assert.NotNil(t, status)
+	_, err = status.Unserialize(map[string]any{"message": "Hello, Arca Lot!"})
+	assert.NoError(t, err)
+
+	// Steps without a status schema do not serialize one.
+	serializedSchema, err = schemaTestSchema.SelfSerialize()
+	assert.NoError(t, err)
+	unserializedSchema, err = schema.UnserializeSchema(serializedSchema)
+	assert.NoError(t, err)
+	assert.Nil(t, unserializedSchema.StepsValue["hello"].Status())
+}
+
+func newSignalReplyTestSchema() *schema.CallableSchema {
+	inputSchema := testStepSchema.Input().(*schema.ScopeSchema)
+	replySchema := testStepSchema.Outputs()["success"].Schema().(*schema.ScopeSchema)
+	return schema.NewCallableSchema(
+		schema.NewCallableStepWithSignals[string, stepTestInputData](
+			"hello",
+			inputSchema,
+			testStepSchema.Outputs(),
+			map[string]schema.CallableSignal{
+				"greet": schema.NewCallableSignalWithReply(
+					"greet",
+					inputSchema,
+					replySchema,
+					nil,
+					func(_ context.Context, _ string, input stepTestInputData) (any, error) {
+						switch input.Name {
+						case "fail":
+							return nil, errors.New("greeting failed")
+						case "invalid":
+							return map[string]any{}, nil
+						}
+						return stepTestSuccessOutput{Message: "Hello, " + input.Name + "!"}, nil
+					},
+				),
+			},
+			nil,
+			nil,
+			nil,
+			func(_ context.Context, _ string, input stepTestInputData) (string, any) {
+				return "success", stepTestSuccessOutput{Message: "Hello, " + input.Name + "!"}
+			},
+		),
+	)
+}
+
+func TestCallableSchema_SignalReply(t *testing.T) {
+	s := newSignalReplyTestSchema()
+	reply := &schema.SignalReply{}
+	ctx := schema.WithSignalReply(context.Background(), reply)
+	assert.NoError(t, s.CallSignal(ctx, t.Name(), "hello", "greet", map[string]any{"name": "Arca Lot"}))
+	assert.Equals(t, reply.Data.(map[string]any)["message"].(string), "Hello, Arca Lot!")
+
+	// The reply is dropped without a SignalReply in the context.
+	assert.NoError(t, s.CallSignal(context.Background(), t.Name(), "hello", "greet", map[string]any{"name": "Arca"}))
+
+	err := s.CallSignal(ctx, t.Name(), "hello", "greet", map[string]any{"name": "fail"})
+	assert.Error(t, err)
+	assert.Equals(t, err.Error(), "greeting failed")
+
+	err = s.CallSignal(ctx, t.Name(), "hello", "greet", map[string]any{"name": "invalid"})
+	assert.Error(t, err)
+	var outputErr schema.InvalidOutputError
+	assert.Equals(t, errors.As(err, &outputErr), true)
+
+	// The reply schema is part of the serialized signal schema.
+	serializedSchema, err := s.SelfSerialize()
+	assert.NoError(t, err)
+	unserializedSchema, err := schema.UnserializeSchema(serializedSchema)
+	assert.NoError(t, err)
+	replySchema := unserializedSchema.StepsValue["hello"].SignalHandlers()["greet"].ReplySchema()
+	assert.NotNil(t, replySchema)
+	_, err = replySchema.Unserialize(map[string]any{"message": "Hello, Arca Lot!"})
+	assert.NoError(t, err)
+}
+
+func TestCallableSchema_SelfSerializeWithOptions(t *testing.T) {
+	statusSchema := testStepSchema.Outputs()["success"].Schema().(*schema.ScopeSchema)
+	s := schema.NewCallableSchema(testStepSchema).WithRunStatus("hello", statusSchema)
+
+	// Readers that do not know about run statuses must not get the status schema.
+	serializedSchema, err := s.SelfSerializeWithOptions(schema.SelfSerializeOptions{})
+	assert.NoError(t, err)
+	steps := serializedSchema.(map[string]any)["steps"].(map[any]any)
+	_, found := steps["hello"].(map[string]any)["status"]
+	assert.Equals(t, found, false)
+
+	serializedSchema, err = s.SelfSerializeWithOptions(schema.SelfSerializeOptions{RunStatus: true})
+	assert.NoError(t, err)
+	steps = serializedSchema.(map[string]any)["steps"].(map[any]any)
+	_, found = steps["hello"].(map[string]any)["status"]
+	assert.Equals(t, found, true)
+}
+
+func TestCallableSchema_SelfSerializeWithOptions_SignalReplies(t *testing.T) {
+	replySignal := schema.NewCallableSignalWithReply(
+		"measure",
+		testStepSchema.Input().(*schema.ScopeSchema),
+		testStepSchema.Input().(*schema.ScopeSchema),
+		nil,
+		func(_ context.Context, _ any, input map[string]any) (map[string]any, error) {
+			return input, nil
+		},
+	)
+	s := schema.NewCallableSchema(
+		schema.NewCallableStepWithSignals[any, map[string]any](
+			"hello",
+			testStepSchema.Input().(*schema.ScopeSchema),
+			testStepSchema.Outputs(),
+			map[string]schema.CallableSignal{"measure": replySignal},
+			nil,
+			nil,
+			nil,
+			func(_ context.Context, _ any, _ map[string]any) (string, any) {
+				return "success", map[string]any{"message": "Hello!"}
+			},
+		),
+	)
+
+	serializedSchema, err := s.SelfSerializeWithOptions(schema.SelfSerializeOptions{})
+	assert.NoError(t, err)
+	unserializedSchema, err := schema.UnserializeSchema(serializedSchema)
+	assert.NoError(t, err)
+	assert.Nil(t, unserializedSchema.StepsValue["hello"].SignalHandlers()["measure"].ReplySchema())
+
+	serializedSchema, err = s.SelfSerializeWithOptions(schema.SelfSerializeOptions{SignalReplies: true})
+	assert.NoError(t, err)
+	unserializedSchema, err = schema.UnserializeSchema(serializedSchema)
+	assert.NoError(t, err)
+	assert.NotNil(t, unserializedSchema.StepsValue["hello"].SignalHandlers()["measure"].ReplySchema())
+	// Leaving the reply schemas out does not change the schema of the step itself.
+	assert.NotNil(t, s.StepsValue["hello"].ToStepSchema().SignalHandlers()["measure"].ReplySchema())
+}
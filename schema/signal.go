@@ -28,6 +28,7 @@ func NewSignalSchema(
 		id,
 		dataSchema,
 		display,
+		nil,
 	}
 }
 
@@ -37,6 +38,9 @@ type SignalSchema struct {
 	IDValue         string  `json:"id"`
 	DataSchemaValue Scope   `json:"data_schema"`
 	DisplayValue    Display `json:"display"`
+	// ReplySchemaValue describes the reply of a signal handler that answers the signal, if any. See
+	// NewCallableSignalWithReply.
+	ReplySchemaValue Scope `json:"reply_schema"`
 }
 
 func (s SignalSchema) ID() string {
@@ -51,6 +55,11 @@ func (s SignalSchema) Display() Display {
 	return s.DisplayValue
 }
 
+// ReplySchema returns the schema of the reply of the signal handler, or nil if the handler does not reply.
+func (s SignalSchema) ReplySchema() Scope {
+	return s.ReplySchemaValue
+}
+
 // NewCallableSignalFromSchema creates a callable signal definition from a schema and handler.
 func NewCallableSignalFromSchema[StepData any, InputType any](
 	s *SignalSchema,
@@ -74,13 +83,36 @@ func NewCallableSignal[StepData any, InputType any](
 	}
 }
 
+// NewCallableSignalWithReply creates a callable signal definition whose handler answers the signal with a reply. The
+// reply is validated against the reply schema, and returned to the caller of CallableSchema.CallSignal through the
+// SignalReply in the context. An error the handler returns is returned to the caller instead.
+func NewCallableSignalWithReply[StepData any, InputType any, ReplyType any](
+	id string,
+	input *ScopeSchema,
+	reply *ScopeSchema,
+	display Display,
+	handler func(context.Context, StepData, InputType) (ReplyType, error),
+) CallableSignal {
+	return &CallableSignalSchema[StepData, InputType]{
+		IDValue:      id,
+		InputValue:   input,
+		ReplyValue:   reply,
+		DisplayValue: display,
+		replyHandler: func(ctx context.Context, stepData StepData, input InputType) (any, error) {
+			return handler(ctx, stepData, input)
+		},
+	}
+}
+
 // CallableSignalSchema is a signal that can be directly called and is typed to a specific input type.
 // This is an input-only representation of the signal.
 type CallableSignalSchema[StepData any, InputType any] struct {
 	IDValue      string       `json:"id"`
 	InputValue   *ScopeSchema `json:"data_input_schema"`
+	ReplyValue   *ScopeSchema `json:"reply_schema"`
 	DisplayValue Display      `json:"display"`
 	handler      func(context.Context, StepData, InputType)
+	replyHandler func(context.Context, StepData, InputType) (any, error)
 }
 
 func (s CallableSignalSchema[StepData, InputType]) ID() string {
@@ -96,11 +128,15 @@ func (s CallableSignalSchema[StepData, InputType]) Display() Display {
 }
 
 func (s CallableSignalSchema[StepData, InputType]) ToSignalSchema() *SignalSchema {
-	return &SignalSchema{
+	result := &SignalSchema{
 		IDValue:         s.IDValue,
 		DataSchemaValue: s.InputValue,
 		DisplayValue:    s.DisplayValue,
 	}
+	if s.ReplyValue != nil {
+		result.ReplySchemaValue = s.ReplyValue
+	}
+	return result
 }
 
 func (s CallableSignalSchema[StepData, InputType]) Call(ctx context.Context, stepData any, input any) error {
@@ -108,6 +144,35 @@ func (s CallableSignalSchema[StepData, InputType]) Call(ctx context.Context, ste
 		return InvalidInputError{err}
 	}
 
-	s.handler(ctx, stepData.(StepData), input.(InputType))
+	if s.replyHandler == nil {
+		s.handler(ctx, stepData.(StepData), input.(InputType))
+		return nil
+	}
+	reply, err := s.replyHandler(ctx, stepData.(StepData), input.(InputType))
+	if err != nil {
+		return err
+	}
+	if signalReply := getSignalReply(ctx); signalReply != nil {
+		signalReply.Data = reply
+	}
 	return nil
 }
+
+// SignalReply receives the reply of a signal handler created with NewCallableSignalWithReply. Once
+// CallableSchema.CallSignal returns without an error, it holds the serialized reply.
+type SignalReply struct {
+	Data any
+}
+
+type signalReplyContextKey struct{}
+
+// WithSignalReply returns a context that makes CallableSchema.CallSignal store the reply of the signal handler in the
+// given SignalReply.
+func WithSignalReply(ctx context.Context, reply *SignalReply) context.Context {
+	return context.WithValue(ctx, signalReplyContextKey{}, reply)
+}
+
+func getSignalReply(ctx context.Context) *SignalReply {
+	reply, _ := ctx.Value(signalReplyContextKey{}).(*SignalReply)
+	return reply
+}
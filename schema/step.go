@@ -40,6 +40,7 @@ func NewStepSchema(
 		signalHandlers,
 		signalEmitters,
 		display,
+		nil,
 	}
 }
 
@@ -52,6 +53,8 @@ type StepSchema struct {
 	SignalHandlersValue map[string]*SignalSchema     `json:"signal_handlers"`
 	SignalEmittersValue map[string]*SignalSchema     `json:"signal_emitters"`
 	DisplayValue        Display                      `json:"display"`
+	// StatusValue describes the status object the step reports while it runs, if any. See CallableSchema.WithRunStatus.
+	StatusValue Scope `json:"status"`
 }
 
 func (s StepSchema) ID() string {
@@ -78,6 +81,11 @@ func (s StepSchema) Display() Display {
 	return s.DisplayValue
 }
 
+// Status returns the schema of the status object the step reports while it runs, or nil if it reports none.
+func (s StepSchema) Status() Scope {
+	return s.StatusValue
+}
+
 // NewCallableStep creates a callable step definition.
 func NewCallableStep[StepInputType any](
 	id string,
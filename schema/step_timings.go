@@ -0,0 +1,35 @@
+package schema
+
+import (
+	"context"
+	"time"
+)
+
+// StepTimings holds the time CallableSchema.CallStep spent in each phase of a step call. Phases that were not
+// reached, because an earlier phase failed, are left at zero.
+type StepTimings struct {
+	// Unserialize is the time spent unserializing the step input.
+	Unserialize time.Duration
+	// Handler is the time spent in the step handler, including the validation of its input and output.
+	Handler time.Duration
+	// Serialize is the time spent serializing the step output.
+	Serialize time.Duration
+}
+
+type stepTimingsKey struct{}
+
+// WithStepTimings returns a context that makes CallableSchema.CallStep record the time it spends in each phase of
+// the step call in the given timings.
+func WithStepTimings(ctx context.Context, timings *StepTimings) context.Context {
+	return context.WithValue(ctx, stepTimingsKey{}, timings)
+}
+
+// getStepTimings returns the timings to record the step call in. The result is never nil, so the timings can be
+// recorded without checking whether anyone asked for them.
+func getStepTimings(ctx context.Context) *StepTimings {
+	timings, ok := ctx.Value(stepTimingsKey{}).(*StepTimings)
+	if !ok || timings == nil {
+		return &StepTimings{}
+	}
+	return timings
+}